@@ -7,16 +7,19 @@ import (
 	"MQTT-GO/network"
 	"MQTT-GO/packets"
 	"MQTT-GO/structures"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	// ConnectionType is the type of transport protocol that is used
-	// It is set by main.go, and can be either TCP, UDP or QUIC
+	// It is set by main.go, and can be either TCP, UDP, QUIC or TLS
 	ConnectionType          = network.TCP
 	PublishToWildcards      = false
 	PrintOutput             = false
@@ -25,37 +28,121 @@ var (
 	ReceivingLatencyChannel = make(chan *network.LatencyStruct, 1000000)
 )
 
+const (
+	// DefaultKeepAlive is the keep alive clients are created with
+	DefaultKeepAlive = 60 * time.Second
+	// DefaultPingTimeout is how long clients wait for a PINGRESP by default
+	DefaultPingTimeout = 5 * time.Second
+	// DefaultReconnectDelay is how long clients wait before reconnecting the first time by default
+	DefaultReconnectDelay = time.Second
+	// DefaultMaxReconnectDelay is the longest clients wait between reconnection attempts by default
+	DefaultMaxReconnectDelay = 2 * time.Minute
+	// DefaultReconnectJitter is the fraction of the reconnect delay that is randomised by default
+	DefaultReconnectJitter = 0.5
+)
+
 // Client is the main struct that is used to create a client and connect to a broker.
-// It stores the ClientID, the connection to the broker, a buffer for incmoing packets,
+// It stores the ClientID, the connection to the broker, the handlers for incoming messages,
 // and a list of packets that are waiting for an ACK.
+// It also stores the identifiers of QoS 2 messages from the broker that haven't been released.
 type Client struct {
-	ClientID         string
+	ClientID string
+	// BrokerConnection is replaced whenever the client reconnects. While a client started with Connect
+	// may be reconnecting, it should only be used through the client's methods.
 	BrokerConnection network.Conn
+	connectionLock   sync.RWMutex
+	// ReceivedPackets stores every PUBLISH from the broker if StoreReceivedPackets has been turned on
 	ReceivedPackets  structures.LinkedList[*packets.Packet]
 	WaitingAckStruct *WaitingAcks
+	// KeepAlive is sent to the broker in the CONNECT. If nothing has been sent for this long
+	// the client sends a PINGREQ. A KeepAlive of zero turns the pinger off.
+	KeepAlive time.Duration
+	// PingTimeout is how long to wait for a PINGRESP before treating the broker as dead
+	PingTimeout time.Duration
+	// CleanSession asks the broker to throw away our session when we disconnect.
+	// If it is false the broker keeps our subscriptions and queues messages while we're offline.
+	CleanSession bool
+	// SessionPresent is set if the broker resumed a previous session when we connected
+	SessionPresent bool
+	// Username and Password are sent in the CONNECT if they're set
+	Username string
+	Password []byte
+	// Transport is the transport protocol the client connects with. CreateClient sets it to the ConnectionType.
+	Transport byte
+	// TLSConfig is used to connect when the Transport is TLS. If it is nil the
+	// broker is verified against the system's roots.
+	TLSConfig *tls.Config
+	// Bridge tells the broker that we are a bridge, so that it doesn't send us our own messages
+	Bridge bool
+	// AutoReconnect reconnects to the broker whenever a client started with Connect loses its connection.
+	// The first attempt is made after about ReconnectDelay, which doubles after every failed attempt
+	// up to MaxReconnectDelay. ReconnectJitter is the fraction of each delay that is randomised,
+	// so that clients that lost their connection together don't all reconnect at once.
+	AutoReconnect     bool
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+	ReconnectJitter   float64
+	// OnConnectionLost is called with the reason when a client started with Connect loses its connection,
+	// unless it was disconnected with SendDisconnect
+	OnConnectionLost func(err error)
+	// OnReconnect is called once the client has reconnected, subscribed to its topics again, finished the
+	// messages the broker hadn't acknowledged and sent its Queue
+	OnReconnect func()
+	// Queue holds the messages published while the client is disconnected or reconnecting.
+	// If it is nil, publishing while disconnected returns an error.
+	Queue *OutboundQueue
+
+	// handlers are the MessageHandlers registered with OnMessage, in the order they were registered
+	handlers      []*messageRoute
+	handlersLock  sync.RWMutex
+	storeReceived atomic.Bool
+
+	awaitingRelease *structures.SafeMap[int, struct{}]
+	// outbound stores our QoS 1 and 2 messages that the broker hasn't finished acknowledging,
+	// which are sent again after reconnecting. Their packet identifiers aren't reused until they're done.
+	outbound      *structures.SafeMap[int, outboundMessage]
+	outboundOrder atomic.Int64
+	// resendLock stops the outbound messages being sent again by more than one goroutine
+	resendLock sync.Mutex
+
+	// subscriptions are the topic filters the broker has accepted, with their QoS, which are
+	// subscribed to again after reconnecting
+	subscriptions *structures.SafeMap[string, packets.TopicWithQoS]
+	// disconnecting is set by SendDisconnect, so that the lost connection isn't reconnected
+	disconnecting atomic.Bool
+
+	// lastSent and lastReceived are the times we last sent a packet to the broker
+	// and received one from it, in Unix nanoseconds
+	lastSent      atomic.Int64
+	lastReceived  atomic.Int64
+	pingResponses chan struct{}
 }
 
 // CreateClient creates a new client with a random ClientID, and a buffer for incoming packets.
 func CreateClient() *Client {
 	waitingPackets := CreateWaitingAckList()
 	return &Client{
-		ReceivedPackets:  *structures.CreateLinkedList[*packets.Packet](),
-		ClientID:         generateRandomClientID(),
-		WaitingAckStruct: waitingPackets,
+		ReceivedPackets:   *structures.CreateLinkedList[*packets.Packet](),
+		ClientID:          generateRandomClientID(),
+		WaitingAckStruct:  waitingPackets,
+		KeepAlive:         DefaultKeepAlive,
+		PingTimeout:       DefaultPingTimeout,
+		CleanSession:      true,
+		Transport:         ConnectionType,
+		awaitingRelease:   structures.CreateSafeMap[int, struct{}](),
+		outbound:          structures.CreateSafeMap[int, outboundMessage](),
+		subscriptions:     structures.CreateSafeMap[string, packets.TopicWithQoS](),
+		ReconnectDelay:    DefaultReconnectDelay,
+		MaxReconnectDelay: DefaultMaxReconnectDelay,
+		ReconnectJitter:   DefaultReconnectJitter,
+		pingResponses:     make(chan struct{}, 1),
 	}
 }
 
 // CreateAndConnectClient creates a new client, sends a connect packet to the broker, and starts listening for packets.
 func CreateAndConnectClient(ip string, port int) (*Client, error) {
 	client := CreateClient()
-	err := client.SetClientConnection(ip, port)
-
-	if err != nil {
-		return nil, err
-	}
-	err = client.SendConnect(ip, port)
-	go client.ListenForPackets()
-
+	err := client.Connect(ip, port)
 	if err != nil {
 		return nil, err
 	}
@@ -64,19 +151,37 @@ func CreateAndConnectClient(ip string, port int) (*Client, error) {
 
 // SetClientConnection sets the connection to the broker.
 func (client *Client) SetClientConnection(ip string, port int) error {
-	connection, err := network.NewConn(ConnectionType)
-	if err != nil {
-		return err
+	var (
+		connection network.Conn
+		err        error
+	)
+	if client.Transport == network.TLS {
+		connection = network.NewTLSConn(client.TLSConfig)
+	} else {
+		connection, err = network.NewConn(client.Transport)
+		if err != nil {
+			return err
+		}
 	}
 	err = connection.Connect(ip, port)
 	if err != nil {
 		return err
 	}
 
+	client.connectionLock.Lock()
 	client.BrokerConnection = connection
+	client.connectionLock.Unlock()
 	return nil
 }
 
+// connection returns the connection to the broker. Each operation uses a single connection,
+// so that it isn't split between an old connection and a new one.
+func (client *Client) connection() network.Conn {
+	client.connectionLock.RLock()
+	defer client.connectionLock.RUnlock()
+	return client.BrokerConnection
+}
+
 func listenForExit(client *Client) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -100,9 +205,9 @@ func cleanupAndExit(client *Client) {
 		fmt.Println("Error while disconnecting:", err)
 	}
 
-	if client.BrokerConnection != nil {
+	if connection := client.connection(); connection != nil {
 		time.Sleep(time.Millisecond * 500)
-		err = client.BrokerConnection.Close()
+		err = connection.Close()
 		if err != nil {
 			fmt.Println("Error while closing connection:", err)
 		}
@@ -3,6 +3,7 @@ package client
 import (
 	"errors"
 	"fmt"
+	"io"
 	"strings"
 	"time"
 
@@ -15,28 +16,44 @@ import (
 
 var (
 	errConnectionClosed = errors.New("error: connection is closed")
+	errConnectionLost   = errors.New("error: connection was lost before the broker acknowledged the packet")
 )
 
 // SendConnect encodes a connect packet and sends it to the broker.
 func (client *Client) SendConnect(ip string, port int) error {
-	if client.BrokerConnection == nil {
+	connection := client.connection()
+	if connection == nil {
 		return errors.New("error: Client does not have a broker connection")
 	}
 
 	controlHeader := packets.ControlHeader{Type: packets.CONNECT, Flags: 0}
-	varHeader := packets.ConnectVariableHeader{KeepAlive: 3600}
+	varHeader := packets.ConnectVariableHeader{KeepAlive: client.keepAliveSeconds()}
+	if client.Bridge {
+		varHeader.ProtocolLevel = packets.ProtocolLevel | packets.BridgeFlag
+	}
+	if client.CleanSession {
+		varHeader.ConnectFlags |= packets.CleanSessionFlag
+	}
 	payload := packets.PacketPayload{}
 	payload.ClientID = client.ClientID
+	if client.Username != "" {
+		varHeader.ConnectFlags |= packets.UsernameFlag
+		payload.Username = client.Username
+	}
+	if client.Password != nil {
+		varHeader.ConnectFlags |= packets.PasswordFlag
+		payload.Password = &client.Password
+	}
 
 	connectPacket := packets.CombinePacketSections(&controlHeader, &varHeader, &payload)
 	connectPacketArr, err := packets.EncodeConnect(connectPacket)
 	if err != nil {
 		return err
 	}
-	if client.BrokerConnection == nil {
+	if client.connection() == nil {
 		return errConnectionClosed
 	}
-	_, err = client.BrokerConnection.Write(connectPacketArr)
+	_, err = client.write(connectPacketArr)
 
 	if err != nil {
 		return err
@@ -46,8 +63,10 @@ func (client *Client) SendConnect(ip string, port int) error {
 
 	readPacketChannel := make(chan []byte, 1)
 	go func() {
-		buffer := make([]byte, 1024*3)
-		n, _ := client.BrokerConnection.Read(buffer)
+		// A CONNACK is always 4 bytes. We mustn't read any further, as the broker
+		// may send messages from our previous session straight after it
+		buffer := make([]byte, 4)
+		n, _ := io.ReadFull(connection, buffer)
 		readPacketChannel <- buffer[:n]
 	}()
 
@@ -59,7 +78,7 @@ func (client *Client) SendConnect(ip string, port int) error {
 			}
 		case <-getTimeoutChannel(1 * time.Second):
 			{
-				_, err = client.BrokerConnection.Write(connectPacketArr)
+				_, err = client.write(connectPacketArr)
 				continue
 			}
 		}
@@ -76,20 +95,13 @@ func (client *Client) SendConnect(ip string, port int) error {
 		structures.PrintInterface(packet)
 		return errors.New("error: Received packet other than CONNACK from server")
 
-	} else if packet.VariableLengthHeader.(*packets.ConnackVariableHeader).ConnectReturnCode == 2 {
-		fmt.Println("      ClientID already exists, generating new one...")
-		// If the clientID already exists then we wait
-		time.Sleep(time.Millisecond)
-		client.ClientID = generateRandomClientID()
-		client.BrokerConnection.Close()
-		err := client.SetClientConnection(ip, port)
-		if err != nil {
-			fmt.Println("Error while setting client connection")
-			return err
-		}
-		return client.SendConnect(ip, port)
+	} else if returnCode := packet.VariableLengthHeader.(*packets.ConnackVariableHeader).ConnectReturnCode; returnCode != 0 {
+		connection.Close()
+		return fmt.Errorf("error: broker refused the connection with return code %v", returnCode)
 	}
 
+	connackFlags := packet.VariableLengthHeader.(*packets.ConnackVariableHeader).ConnectAcknowledgementFlags
+	client.SessionPresent = connackFlags&1 != 0
 	return nil
 }
 
@@ -105,54 +117,144 @@ func getTimeoutChannel(timeout time.Duration) chan struct{} {
 // TODO: Handle readPacketFromConnection error properly
 // TODO: Check if everything you would need for a publish packet is present!
 
-// SendPublish encodes a publish packet and sends it to the broker.
+// SendPublish encodes a publish packet and sends it to the broker with a QoS of 0.
 func (client *Client) SendPublish(applicationMessage []byte, topic string) error {
+	return client.SendPublishWithQoS(applicationMessage, topic, 0)
+}
+
+// SendPublishWithQoS encodes a publish packet and sends it to the broker with the given QoS.
+// For a QoS of 1 it waits for the broker to send a PUBACK before returning.
+// For a QoS of 2 it waits for a PUBREC, releases the message with a PUBREL and then
+// waits for the PUBCOMP before returning.
+// If the client has a Queue, a message published while the client is disconnected or reconnecting,
+// or whose connection is lost before the broker has it, is queued and sent once the client has connected.
+// Without a Queue, a message whose connection is lost after it was sent, but before it was acknowledged,
+// returns an error, but is still sent again as a duplicate, or released, once the client has connected.
+func (client *Client) SendPublishWithQoS(applicationMessage []byte, topic string, qos byte) error {
+	return client.sendPublish(applicationMessage, topic, qos, false)
+}
+
+// SendRetainedPublish is SendPublishWithQoS for a PUBLISH with the RETAIN flag set,
+// which the broker stores and sends to clients that subscribe to the topic later.
+func (client *Client) SendRetainedPublish(applicationMessage []byte, topic string, qos byte) error {
+	return client.sendPublish(applicationMessage, topic, qos, true)
+}
+
+func (client *Client) sendPublish(applicationMessage []byte, topic string, qos byte, retain bool) error {
 	// If the topic contains wildcards and we don't want to publish to wildcards then return an error
 	if !PublishToWildcards && (strings.Contains(topic, "+") || strings.Contains(topic, "#")) {
 		return errors.New("error: Cannot publish to topics with wildcards + or #")
 	}
+	if qos > 2 {
+		return errors.New("error: impossible QoS level provided")
+	}
 
-	controlHeader := packets.ControlHeader{Type: packets.PUBLISH, Flags: 0}
-	varHeader := packets.PublishVariableHeader{}
-	varHeader.TopicFilter = topic
-	packetID := getAndIncrementPacketID()
-	varHeader.PacketIdentifier = packetID
-	payload := packets.PacketPayload{}
-	payload.RawApplicationMessage = applicationMessage
+	message := QueuedMessage{
+		PacketID: client.nextPacketID(),
+		Topic:    topic,
+		Payload:  applicationMessage,
+		Qos:      qos,
+		Retain:   retain,
+	}
+	if client.Queue != nil {
+		if queued, err := client.Queue.addIfHeld(message); queued {
+			return err
+		}
+	}
 
-	publishPacket := packets.CombinePacketSections(&controlHeader, &varHeader, &payload)
-	publishPacketArr, err := packets.EncodePublish(publishPacket)
+	taken, err := client.publish(message)
+	if !taken && client.Queue != nil {
+		message.Sent = !errors.Is(err, errConnectionClosed)
+		if err := client.Queue.requeue(message); err != nil {
+			return err
+		}
+		// The queue sends it again, rather than resendOutbound
+		client.outbound.Delete(message.PacketID)
+		return nil
+	}
+	return err
+}
+
+// publish sends a PUBLISH and waits for the broker to acknowledge it, as set by its QoS.
+// taken is false if the connection was lost before the broker took responsibility for the message.
+// Once it has been written, the message is kept in the client's outbound messages until the broker
+// has acknowledged it, so that it is sent again after reconnecting.
+func (client *Client) publish(message QueuedMessage) (taken bool, err error) {
+	flags := packets.CreatePublishFlags(message.Qos, message.Sent && message.Qos > 0, message.Retain)
+	publishPacketArr, err := packets.CreatePublish(message.Topic, message.PacketID, flags, message.Payload)
 	if err != nil {
-		return err
+		return true, err
 	}
-	if client.BrokerConnection == nil {
-		return errConnectionClosed
+	if client.connection() == nil {
+		return false, errConnectionClosed
 	}
 
-	n, err := (client.BrokerConnection).Write(publishPacketArr)
+	// The order is taken before writing, as the messages are sent again in the order they were written
+	order := client.outboundOrder.Add(1)
+	n, err := client.write(publishPacketArr)
 
 	if LogLatency {
-		SendingLatencyChannel <- &network.LatencyStruct{T: time.Now(), PacketID: packetID}
+		SendingLatencyChannel <- &network.LatencyStruct{T: time.Now(), PacketID: message.PacketID}
 	}
 
 	if err != nil {
-		return err
+		return false, err
 	}
 	if n == 0 {
-		return errors.New("error: Wrote 0 bytes to connection")
+		return false, errors.New("error: Wrote 0 bytes to connection")
 	}
+	client.track(message, order)
 
-	if controlHeader.Flags&6 == 0 {
-		return nil
+	switch message.Qos {
+	case 1:
+		err = client.waitForAck(message.PacketID, packets.PUBACK)
+		if errors.Is(err, errConnectionLost) {
+			return false, err
+		}
+		client.outbound.Delete(message.PacketID)
+		return true, err
+	case 2:
+		err = client.waitForAck(message.PacketID, packets.PUBREC)
+		if errors.Is(err, errConnectionLost) {
+			return false, err
+		}
+		if err != nil {
+			client.outbound.Delete(message.PacketID)
+			return true, err
+		}
+		// The broker has the message once it has sent a PUBREC, so from now on only the PUBREL is sent again
+		client.markReleased(message.PacketID)
+		_, err = client.release(message.PacketID)
+		return true, err
 	}
 
-	pubackArr := client.WaitingAckStruct.GetOrWait(packetID)
-	packet, _, _ := packets.DecodePacket(*pubackArr)
+	return true, nil
+}
 
-	if packet.ControlHeader.Type != packets.PUBACK {
-		return errors.New("error: Didn't receive PUBACK from server")
+// release sends the PUBREL for a QoS 2 message and waits for the PUBCOMP.
+// done is false if the connection was lost first, in which case the PUBREL is sent again after reconnecting.
+func (client *Client) release(packetID int) (done bool, err error) {
+	if err := client.SendPubrel(packetID); err != nil {
+		return false, err
+	}
+	err = client.waitForAck(packetID, packets.PUBCOMP)
+	if errors.Is(err, errConnectionLost) {
+		return false, err
 	}
+	client.outbound.Delete(packetID)
+	return true, err
+}
 
+// waitForAck waits for the broker to send an ACK with the given packet identifier,
+// and checks that it is of the type we expected.
+func (client *Client) waitForAck(packetID int, packetType byte) error {
+	ackArr := client.WaitingAckStruct.GetOrWait(packetID)
+	if ackArr == nil {
+		return errConnectionLost
+	}
+	if packets.GetPacketType(*ackArr) != packetType {
+		return fmt.Errorf("error: Didn't receive %v from server", packets.PacketTypeName(packetType))
+	}
 	return nil
 }
 
@@ -160,21 +262,28 @@ func (client *Client) SendPublish(applicationMessage []byte, topic string) error
 
 // SendSubscribe encodes a subscribe packet and sends it to the broker.
 func (client *Client) SendSubscribe(topics ...packets.TopicWithQoS) error {
+	_, err := client.sendSubscribe(topics...)
+	return err
+}
+
+// sendSubscribe sends a subscribe packet to the broker, and returns the return code the
+// broker sent in its SUBACK for each topic
+func (client *Client) sendSubscribe(topics ...packets.TopicWithQoS) ([]byte, error) {
 	controlHeader := packets.ControlHeader{Type: packets.SUBSCRIBE, Flags: 2}
 	varHeader := packets.SubscribeVariableHeader{}
-	packetID := getAndIncrementPacketID()
+	packetID := client.nextPacketID()
 	varHeader.PacketIdentifier = packetID
 	payload := packets.PacketPayload{}
 	payload.RawApplicationMessage = make([]byte, 0, 2*len(topics))
 
 	for _, topicWQos := range topics {
 		if topicWQos.QoS > 2 {
-			return errors.New("error: impossible QoS level provided")
+			return nil, errors.New("error: impossible QoS level provided")
 		}
 
 		encodedTopic, _, err := packets.EncodeUTFString(topicWQos.Topic)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		payload.RawApplicationMessage = append(payload.RawApplicationMessage, encodedTopic...)
 		payload.RawApplicationMessage = append(payload.RawApplicationMessage, topicWQos.QoS)
@@ -183,53 +292,80 @@ func (client *Client) SendSubscribe(topics ...packets.TopicWithQoS) error {
 	packet := packets.CombinePacketSections(&controlHeader, &varHeader, &payload)
 	encodedPacket, err := packets.EncodeSubscribe(packet)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if client.BrokerConnection == nil {
-		return errConnectionClosed
+	if client.connection() == nil {
+		return nil, errConnectionClosed
 	}
-	_, err = client.BrokerConnection.Write(encodedPacket)
+	_, err = client.write(encodedPacket)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	subackArr := client.WaitingAckStruct.GetOrWait(packetID)
+	if subackArr == nil {
+		return nil, errConnectionLost
+	}
 	suback, _, _ := packets.DecodePacket(*subackArr)
 
 	if suback.ControlHeader.Type != packets.SUBACK {
-		return errors.New("error: Our SUBACK got nabbed")
+		return nil, errors.New("error: Our SUBACK got nabbed")
 	}
 
-	return nil
+	returnCodes := suback.Payload.RawApplicationMessage
+	for i, topicWQos := range topics {
+		if i < len(returnCodes) && returnCodes[i] != packets.SubackFailure {
+			client.subscriptions.Put(topicWQos.Topic, topicWQos)
+		}
+	}
+	return returnCodes, nil
 }
 
-// SendUnsubscribe encodes an unsubscribe packet and sends it to the broker.
+// SendUnsubscribe encodes an unsubscribe packet and sends it to the broker, and waits for the UNSUBACK.
 func (client *Client) SendUnsubscribe(topics ...string) error {
+	waitForUnsuback, err := client.sendUnsubscribe(topics...)
+	if err != nil {
+		return err
+	}
+	return waitForUnsuback()
+}
+
+// sendUnsubscribe sends an unsubscribe packet to the broker, and returns a function that waits for
+// the UNSUBACK. The UNSUBACK is read by ListenForPackets, so it mustn't be waited for from there.
+// The topics are forgotten straight away, so that they aren't subscribed to again after reconnecting.
+func (client *Client) sendUnsubscribe(topics ...string) (func() error, error) {
 	controlHeader := packets.ControlHeader{Type: packets.UNSUBSCRIBE}
 	varHeader := packets.UnsubscribeVariableHeader{}
-	packetID := getAndIncrementPacketID()
+	packetID := client.nextPacketID()
 	varHeader.PacketIdentifier = packetID
 	payload := packets.PacketPayload{}
 	payload.TopicList = packets.ConvertStringsToTopicsWithQos(topics...)
 	packet := packets.CombinePacketSections(&controlHeader, &varHeader, &payload)
 	encodedPacket, err := packets.EncodeUnsubscribe(packet)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if client.BrokerConnection == nil {
-		return errConnectionClosed
+	for _, topic := range topics {
+		client.subscriptions.Delete(topic)
 	}
-	_, err = client.BrokerConnection.Write(encodedPacket)
-	if err != nil {
-		return err
+	if client.connection() == nil {
+		return nil, errConnectionClosed
 	}
-	unsubackArr := client.WaitingAckStruct.GetOrWait(packetID)
-	suback, _, _ := packets.DecodePacket(*unsubackArr)
-
-	if suback.ControlHeader.Type != packets.UNSUBACK {
-		return errors.New("error: Our UNSUBACK got nabbed")
+	_, err = client.write(encodedPacket)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return func() error {
+		unsubackArr := client.WaitingAckStruct.GetOrWait(packetID)
+		if unsubackArr == nil {
+			return errConnectionLost
+		}
+		unsuback, _, _ := packets.DecodePacket(*unsubackArr)
+		if unsuback.ControlHeader.Type != packets.UNSUBACK {
+			return errors.New("error: Our UNSUBACK got nabbed")
+		}
+		return nil
+	}, nil
 }
 
 // SendDisconnect encodes a disconnect packet and sends it to the broker.
@@ -240,11 +376,13 @@ func (client *Client) SendDisconnect() error {
 	controlHeader.RemainingLength = 0
 	disconnectArr := packets.EncodeFixedHeader(controlHeader)
 
-	if client.BrokerConnection == nil {
+	// The broker closes the connection once it has the DISCONNECT, which mustn't be reconnected
+	client.disconnecting.Store(true)
+	if client.connection() == nil {
 		return errConnectionClosed
 	}
 
-	n, err := client.BrokerConnection.Write(disconnectArr)
+	n, err := client.write(disconnectArr)
 	if err != nil {
 		return err
 	}
@@ -254,6 +392,16 @@ func (client *Client) SendDisconnect() error {
 	return nil
 }
 
+// Disconnect sends a DISCONNECT and closes the connection, rather than waiting for the broker to close it.
+// A client started with Connect isn't reconnected.
+func (client *Client) Disconnect() error {
+	err := client.SendDisconnect()
+	if connection := client.connection(); connection != nil {
+		connection.Close()
+	}
+	return err
+}
+
 // SendDisconnect encodes a SUBACK packet and sends it to the broker.
 func (client *Client) SendSUBACK() error {
 	controlHeader := packets.ControlHeader{}
@@ -262,12 +410,12 @@ func (client *Client) SendSUBACK() error {
 	controlHeader.RemainingLength = 0
 	subackArr := packets.EncodeFixedHeader(controlHeader)
 
-	if client.BrokerConnection == nil {
+	if client.connection() == nil {
 		return errConnectionClosed
 	}
 
 	structures.Println("Sending SubAck")
-	n, err := client.BrokerConnection.Write(subackArr)
+	n, err := client.write(subackArr)
 	if err != nil {
 		return err
 	}
@@ -277,14 +425,38 @@ func (client *Client) SendSUBACK() error {
 	return nil
 }
 
+// SendPuback sends a PUBACK to the broker, acknowledging a QoS 1 PUBLISH.
 func (client *Client) SendPuback(packetID int) error {
-	if client.BrokerConnection == nil {
+	return client.sendPacket(packets.CreatePubAck(packetID))
+}
+
+// SendPubrec sends a PUBREC to the broker, acknowledging a QoS 2 PUBLISH.
+func (client *Client) SendPubrec(packetID int) error {
+	return client.sendPacket(packets.CreatePubRec(packetID))
+}
+
+// SendPubrel sends a PUBREL to the broker, releasing a QoS 2 PUBLISH that the broker has received.
+func (client *Client) SendPubrel(packetID int) error {
+	return client.sendPacket(packets.CreatePubRel(packetID))
+}
+
+// SendPubcomp sends a PUBCOMP to the broker, completing the QoS 2 exchange for a PUBLISH.
+func (client *Client) SendPubcomp(packetID int) error {
+	return client.sendPacket(packets.CreatePubComp(packetID))
+}
+
+// SendPingreq sends a PINGREQ to the broker, which should reply with a PINGRESP.
+func (client *Client) SendPingreq() error {
+	return client.sendPacket(packets.CreatePingReq())
+}
+
+// sendPacket sends a packet that the broker doesn't reply to with an ACK we wait for
+func (client *Client) sendPacket(toSend []byte) error {
+	if client.connection() == nil {
 		return errConnectionClosed
 	}
 
-	toSend := packets.CreatePubAck(packetID)
-
-	n, err := client.BrokerConnection.Write(toSend)
+	n, err := client.write(toSend)
 	if err != nil {
 		return err
 	}
@@ -293,3 +465,17 @@ func (client *Client) SendPuback(packetID int) error {
 	}
 	return nil
 }
+
+// write sends a packet to the broker, and records when it was sent so that
+// the keep alive pinger knows how long the connection has been idle.
+func (client *Client) write(packet []byte) (int, error) {
+	connection := client.connection()
+	if connection == nil {
+		return 0, errConnectionClosed
+	}
+	n, err := connection.Write(packet)
+	if err == nil {
+		client.lastSent.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
@@ -15,35 +15,62 @@ import (
 
 // ListenForPackets continually reads packets from the broker connection, decodes them and takes appropriate action.
 // For packets that require an ACK, it adds them to the waitingAckStruct.
+// While listening, a PINGREQ is sent whenever the connection is idle. If the broker doesn't
+// answer in time, the connection is closed and we stop listening.
+// Once we stop listening, anything waiting for an ACK from the broker gives up.
 func (client *Client) ListenForPackets() {
-	reader := bufio.NewReader(client.BrokerConnection)
+	client.listen(client.connection())
+}
+
+// listen is ListenForPackets on the given connection, which returns why the connection was lost.
+// The pinger has stopped by the time it returns.
+func (client *Client) listen(connection network.Conn) error {
+	reader := bufio.NewReader(connection)
+	stopPinging := make(chan struct{})
+	stoppedPinging := make(chan struct{})
+	defer func() {
+		close(stopPinging)
+		<-stoppedPinging
+	}()
+	defer client.WaitingAckStruct.connectionLost()
+	client.lastReceived.Store(time.Now().UnixNano())
+	go func() {
+		client.keepAlive(connection, stopPinging)
+		close(stoppedPinging)
+	}()
 
 	for {
 		packet, err := packets.ReadPacketFromConnection(reader)
+		if err == nil {
+			client.lastReceived.Store(time.Now().UnixNano())
+		}
 
 		if err != nil {
 			if strings.HasSuffix(err.Error(), "use of closed network connection") {
 				structures.PrintCentrally("Connection closed")
-				return
+				return err
 			}
 			// Quic returns bye message on closing
 			if strings.HasSuffix(err.Error(), "bye") {
-				return
+				return err
 			}
 			if errors.Is(err, io.EOF) {
-				return
+				return err
 			}
 			fmt.Println("Error during reading:", err)
-			return
+			return err
 		}
 
 		packetType := packets.GetPacketType(packet)
 
-		decoded, _, _ := packets.DecodePacket(packet)
-		client.ReceivedPackets.Append(decoded)
+		decoded, _, err := packets.DecodePacket(packet)
+		if err != nil {
+			fmt.Println("Error while decoding", packets.PacketTypeName(packetType), err)
+			continue
+		}
 
 		switch packetType {
-		case packets.SUBACK, packets.CONNACK, packets.PUBACK, packets.UNSUBACK:
+		case packets.SUBACK, packets.CONNACK, packets.PUBACK, packets.UNSUBACK, packets.PUBREC, packets.PUBCOMP:
 			{
 				_, offset, _ := packets.DecodeFixedHeader(packet)
 				packetID := packets.CombineMsbLsb(packet[offset], packet[offset+1])
@@ -55,8 +82,29 @@ func (client *Client) ListenForPackets() {
 				client.WaitingAckStruct.AddItem(&toStore)
 			}
 
+		case packets.PINGRESP:
+			{
+				select {
+				case client.pingResponses <- struct{}{}:
+				default:
+				}
+			}
+
+		case packets.PUBREL:
+			{
+				// The broker has released a QoS 2 message, any new PUBLISH with this
+				// identifier is a new message
+				packetID := decoded.VariableLengthHeader.(*packets.PubackVariableHeader).PacketIdentifier
+				client.awaitingRelease.Delete(packetID)
+				err = client.SendPubcomp(packetID)
+				if err != nil {
+					fmt.Println("Error while sending PUBCOMP:", err)
+				}
+			}
+
 		case packets.PUBLISH:
 			{
+				client.handlePublish(decoded)
 
 				if LogLatency {
 					if err == nil && packetType == packets.PUBLISH {
@@ -79,3 +127,28 @@ func (client *Client) ListenForPackets() {
 		}
 	}
 }
+
+// handlePublish stores a PUBLISH from the broker and acknowledges it according to its QoS.
+// QoS 2 messages that haven't been released yet are duplicates, so they're only acknowledged.
+func (client *Client) handlePublish(publish *packets.Packet) {
+	packetID := publish.VariableLengthHeader.(*packets.PublishVariableHeader).PacketIdentifier
+	var err error
+
+	switch packets.GetQoS(publish.ControlHeader.Flags) {
+	case 0:
+		client.receive(publish)
+	case 1:
+		client.receive(publish)
+		err = client.SendPuback(packetID)
+	case 2:
+		if !client.awaitingRelease.Contains(packetID) {
+			client.awaitingRelease.Put(packetID, struct{}{})
+			client.receive(publish)
+		}
+		err = client.SendPubrec(packetID)
+	}
+
+	if err != nil {
+		fmt.Println("Error while acknowledging PUBLISH:", err)
+	}
+}
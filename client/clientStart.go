@@ -2,6 +2,7 @@ package client
 
 import (
 	"bufio"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
@@ -13,9 +14,11 @@ import (
 
 // StartClient starts the client, and listens for inputs from the command line.
 // E.g. Subscribe, publish, disconnect etc, Then communicates with the broker.
-func StartClient(ip string, port int) {
+// The TLS config is only used if the ConnectionType is TLS, and can be nil.
+func StartClient(ip string, port int, tlsConfig *tls.Config) {
 	flag.Parse()
 	client := CreateClient()
+	client.TLSConfig = tlsConfig
 	listenForExit(client)
 	fmt.Println("Connecting to", ip, ":", port)
 	err := client.SetClientConnection(ip, port)
@@ -1,19 +1,26 @@
 package client_test
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
 
 	"MQTT-GO/client"
 	"MQTT-GO/gobro"
+	"MQTT-GO/network"
 	"MQTT-GO/packets"
 	"MQTT-GO/structures"
 )
 
 var (
-	server       gobro.Server
+	server       *gobro.Server
 	serverUpLock = sync.Mutex{}
 	serverUp     = false
 )
@@ -24,19 +31,18 @@ func ServerUp() {
 	if serverUp {
 		return
 	}
-	server = gobro.NewServer()
-
-	go func() {
-		server.StartServer("localhost", 8000)
-	}()
+	server = gobro.NewServer(gobro.Options{
+		Listeners: []gobro.ListenerConfig{{Transport: network.TCP, IP: "localhost", Port: 8000}},
+	})
+	if err := server.Start(context.Background()); err != nil {
+		panic(err)
+	}
 	serverUp = true
-	time.Sleep(time.Millisecond * 100)
 }
 
 func TestMain(m *testing.M) {
 	fmt.Println("Starting server")
 	ServerUp()
-	gobro.DisableStdOutput()
 
 	time.Sleep(time.Millisecond * 500)
 	m.Run()
@@ -113,6 +119,7 @@ func TestWaitingPackets(t *testing.T) {
 func TestReceivingPublish(t *testing.T) {
 	client1, err := client.CreateAndConnectClient("localhost", 8000)
 	testErr(t, err)
+	client1.StoreReceivedPackets(true)
 	client2, err := client.CreateAndConnectClient("localhost", 8000)
 	testErr(t, err)
 
@@ -135,6 +142,7 @@ func TestReceivingPublish(t *testing.T) {
 func TestReceivingMultiplePublishes(t *testing.T) {
 	client1, err := client.CreateAndConnectClient("localhost", 8000)
 	testErr(t, err)
+	client1.StoreReceivedPackets(true)
 	err = client1.SendSubscribe(packets.TopicWithQoS{Topic: "testing"})
 	testErr(t, err)
 	publishClients := make([]*client.Client, 10)
@@ -169,3 +177,612 @@ func TestReceivingMultiplePublishes(t *testing.T) {
 	}
 	done = true
 }
+
+func TestPublishQoS1(t *testing.T) {
+	subscriber, err := client.CreateAndConnectClient("localhost", 8000)
+	testErr(t, err)
+	subscriber.StoreReceivedPackets(true)
+	publisher, err := client.CreateAndConnectClient("localhost", 8000)
+	testErr(t, err)
+	defer subscriber.SendDisconnect()
+	defer publisher.SendDisconnect()
+
+	err = subscriber.SendSubscribe(packets.TopicWithQoS{Topic: "qos1", QoS: 1})
+	testErr(t, err)
+
+	// This only returns once the broker has sent a PUBACK
+	err = publisher.SendPublishWithQoS([]byte("at least once"), "qos1", 1)
+	testErr(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	if subscriber.ReceivedPackets.Size() != 1 {
+		t.Fatal("Subscriber did not receive the QoS 1 message")
+	}
+	received := subscriber.ReceivedPackets.Head().Value()
+	if packets.GetQoS(received.ControlHeader.Flags) != 1 {
+		t.Error("Message was not delivered with QoS 1")
+	}
+}
+
+func TestPublishQoS2(t *testing.T) {
+	subscriber, err := client.CreateAndConnectClient("localhost", 8000)
+	testErr(t, err)
+	subscriber.StoreReceivedPackets(true)
+	publisher, err := client.CreateAndConnectClient("localhost", 8000)
+	testErr(t, err)
+	defer subscriber.SendDisconnect()
+	defer publisher.SendDisconnect()
+
+	err = subscriber.SendSubscribe(packets.TopicWithQoS{Topic: "qos2", QoS: 2})
+	testErr(t, err)
+
+	// This only returns once the whole PUBREC, PUBREL, PUBCOMP exchange has finished
+	for i := 0; i < 5; i++ {
+		err = publisher.SendPublishWithQoS([]byte(fmt.Sprint("exactly once ", i)), "qos2", 2)
+		testErr(t, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if subscriber.ReceivedPackets.Size() != 5 {
+		t.Fatal("Subscriber received", subscriber.ReceivedPackets.Size(), "messages instead of 5")
+	}
+	for _, received := range subscriber.ReceivedPackets.GetItems() {
+		if packets.GetQoS(received.ControlHeader.Flags) != 2 {
+			t.Error("Message was not delivered with QoS 2")
+		}
+	}
+}
+
+func TestMessageHandlersMatchTopicFilters(t *testing.T) {
+	publisher, err := client.CreateAndConnectClient("localhost", 8000)
+	testErr(t, err)
+	defer publisher.SendDisconnect()
+	retain, err := packets.CreatePublish("handlers/r/temp", 1, packets.CreatePublishFlags(1, false, true), []byte("old"))
+	testErr(t, err)
+	_, err = publisher.BrokerConnection.Write(retain)
+	testErr(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	subscriber, err := client.CreateAndConnectClient("localhost", 8000)
+	testErr(t, err)
+	defer subscriber.SendDisconnect()
+	temperatures := make(chan string, 10)
+	everything := make(chan string, 10)
+	subscriber.OnMessage("handlers/+/temp", func(topic string, payload []byte, qos byte, retained bool) {
+		temperatures <- fmt.Sprint(topic, " ", string(payload), " ", qos, " ", retained)
+	})
+	subscriber.OnMessage("handlers/#", func(topic string, _ []byte, _ byte, _ bool) {
+		everything <- topic
+	})
+	testErr(t, subscriber.SendSubscribe(packets.TopicWithQoS{Topic: "handlers/#", QoS: 1}))
+
+	testErr(t, publisher.SendPublishWithQoS([]byte("20"), "handlers/a/temp", 1))
+	testErr(t, publisher.SendPublishWithQoS([]byte("55"), "handlers/b/humidity", 1))
+	testErr(t, publisher.SendPublish([]byte("21"), "handlers/c/temp"))
+
+	expectMessages := func(received chan string, expected ...string) {
+		t.Helper()
+		for _, message := range expected {
+			select {
+			case got := <-received:
+				if got != message {
+					t.Errorf("Expected '%v' but got '%v'", message, got)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Didn't receive", message)
+			}
+		}
+	}
+	expectMessages(temperatures, "handlers/r/temp old 1 true", "handlers/a/temp 20 1 false", "handlers/c/temp 21 0 false")
+	expectMessages(everything, "handlers/r/temp", "handlers/a/temp", "handlers/b/humidity", "handlers/c/temp")
+	if subscriber.ReceivedPackets.Size() != 0 {
+		t.Error("Messages were stored without StoreReceivedPackets")
+	}
+}
+
+func TestSubscriptionsPassMessagesToChannels(t *testing.T) {
+	subscriber, err := client.CreateAndConnectClient("localhost", 8000)
+	testErr(t, err)
+	defer subscriber.SendDisconnect()
+	publisher, err := client.CreateAndConnectClient("localhost", 8000)
+	testErr(t, err)
+	defer publisher.SendDisconnect()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	blocking, err := subscriber.Subscribe(ctx, "channels/+/temp", 1)
+	testErr(t, err)
+	dropNewest, err := subscriber.SubscribeWithOptions(ctx, "channels/newest", 1,
+		client.SubscriptionOptions{BufferSize: 2, Overflow: client.DropNewest})
+	testErr(t, err)
+	dropOldest, err := subscriber.SubscribeWithOptions(ctx, "channels/oldest", 1,
+		client.SubscriptionOptions{BufferSize: 2, Overflow: client.DropOldest})
+	testErr(t, err)
+
+	for i := 0; i < 4; i++ {
+		testErr(t, publisher.SendPublishWithQoS([]byte(fmt.Sprint(i)), fmt.Sprint("channels/", i, "/temp"), 1))
+		testErr(t, publisher.SendPublishWithQoS([]byte(fmt.Sprint(i)), "channels/newest", 1))
+		testErr(t, publisher.SendPublishWithQoS([]byte(fmt.Sprint(i)), "channels/oldest", 1))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	expectMessages := func(subscription *client.Subscription, expected ...string) {
+		t.Helper()
+		for _, payload := range expected {
+			select {
+			case message := <-subscription.Messages():
+				if string(message.Payload) != payload || message.Qos != 1 {
+					t.Errorf("Expected '%v' at QoS 1 on '%v' but got %+v", payload, subscription.TopicFilter, message)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Didn't receive", payload, "on", subscription.TopicFilter)
+			}
+		}
+		select {
+		case message := <-subscription.Messages():
+			t.Errorf("Unexpected message on '%v': %+v", subscription.TopicFilter, message)
+		default:
+		}
+	}
+	expectMessages(blocking, "0", "1", "2", "3")
+	expectMessages(dropNewest, "0", "1")
+	expectMessages(dropOldest, "2", "3")
+
+	// Closing a subscription closes its channel, and cancelling its context closes it too
+	testErr(t, blocking.Close())
+	if _, open := <-blocking.Messages(); open {
+		t.Error("Closed subscription's channel is still open")
+	}
+	cancel()
+	for _, subscription := range []*client.Subscription{dropNewest, dropOldest} {
+		select {
+		case _, open := <-subscription.Messages():
+			if open {
+				t.Error("Subscription got a message after its context was cancelled")
+			}
+		case <-time.After(time.Second):
+			t.Error("Cancelling the context didn't close the subscription")
+		}
+	}
+}
+
+func TestSubscriptionCanBeClosedFromHandler(t *testing.T) {
+	subscriber, err := client.CreateAndConnectClient("localhost", 8000)
+	testErr(t, err)
+	defer subscriber.SendDisconnect()
+	publisher, err := client.CreateAndConnectClient("localhost", 8000)
+	testErr(t, err)
+	defer publisher.SendDisconnect()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscription, err := subscriber.Subscribe(ctx, "close/handler", 0)
+	testErr(t, err)
+	if err != nil {
+		return
+	}
+	closed := make(chan error, 1)
+	// The handler runs on the goroutine that reads the UNSUBACK. Its filter is different,
+	// so that closing the subscription unsubscribes from the broker.
+	subscriber.OnMessage("close/#", func(topic string, payload []byte, qos byte, retained bool) {
+		closed <- subscription.Close()
+	})
+	testErr(t, publisher.SendPublish([]byte("close"), "close/handler"))
+
+	select {
+	case err := <-closed:
+		testErr(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Closing the subscription from a handler deadlocked")
+	}
+	// The client still reads from the broker
+	testErr(t, subscriber.SendSubscribe(packets.TopicWithQoS{Topic: "close/after", QoS: 1}))
+}
+
+func TestKeepAliveKeepsIdleConnectionOpen(t *testing.T) {
+	subscriber := client.CreateClient()
+	subscriber.KeepAlive = time.Second
+	testErr(t, subscriber.SetClientConnection("localhost", 8000))
+	testErr(t, subscriber.SendConnect("localhost", 8000))
+	go subscriber.ListenForPackets()
+	defer subscriber.SendDisconnect()
+
+	// The broker disconnects clients after one and a half times their keep alive
+	time.Sleep(2500 * time.Millisecond)
+	testErr(t, subscriber.SendSubscribe(packets.TopicWithQoS{Topic: "keepalive", QoS: 0}))
+}
+
+// startDeadBroker starts a broker that accepts a connection, but never answers a PINGREQ
+func startDeadBroker(t *testing.T, port int) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%v", port))
+	testErr(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		connection, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		buffer := make([]byte, 1024)
+		_, _ = connection.Read(buffer)
+		_, _ = connection.Write(packets.CreateConnACK(false, 0))
+		for {
+			if _, err := connection.Read(buffer); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestSubSecondKeepAliveIsRoundedUp(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8047})
+	testErr(t, err)
+	defer listener.Close()
+
+	keepAlives := make(chan int, 1)
+	go func() {
+		connection, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		connect, err := packets.ReadPacketFromConnection(bufio.NewReader(connection))
+		if err != nil {
+			return
+		}
+		decoded, err := packets.DecodeConnect(connect)
+		if err != nil {
+			return
+		}
+		keepAlives <- decoded.VariableLengthHeader.(*packets.ConnectVariableHeader).KeepAlive
+		_, _ = connection.Write(packets.CreateConnACK(false, 0))
+	}()
+
+	pinger := client.CreateClient()
+	pinger.KeepAlive = 200 * time.Millisecond
+	testErr(t, pinger.SetClientConnection("localhost", 8047))
+	defer pinger.BrokerConnection.Close()
+	testErr(t, pinger.SendConnect("localhost", 8047))
+	select {
+	case keepAlive := <-keepAlives:
+		if keepAlive != 1 {
+			t.Error("Expected a keep alive of one second, but the CONNECT had", keepAlive)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("The CONNECT wasn't received")
+	}
+}
+
+func TestDeadBrokerIsDetected(t *testing.T) {
+	startDeadBroker(t, 8009)
+
+	deadBrokerClient := client.CreateClient()
+	deadBrokerClient.KeepAlive = 200 * time.Millisecond
+	deadBrokerClient.PingTimeout = 200 * time.Millisecond
+	testErr(t, deadBrokerClient.SetClientConnection("localhost", 8009))
+	testErr(t, deadBrokerClient.SendConnect("localhost", 8009))
+
+	stoppedListening := make(chan struct{})
+	go func() {
+		deadBrokerClient.ListenForPackets()
+		close(stoppedListening)
+	}()
+
+	select {
+	case <-stoppedListening:
+	case <-time.After(2 * time.Second):
+		t.Error("Client didn't notice that the broker stopped responding")
+	}
+}
+
+func TestDeadBrokerIsDetectedWhilePublishing(t *testing.T) {
+	startDeadBroker(t, 8038)
+
+	publisher := client.CreateClient()
+	publisher.KeepAlive = 200 * time.Millisecond
+	publisher.PingTimeout = 200 * time.Millisecond
+	testErr(t, publisher.SetClientConnection("localhost", 8038))
+	testErr(t, publisher.SendConnect("localhost", 8038))
+
+	stoppedListening := make(chan struct{})
+	go func() {
+		publisher.ListenForPackets()
+		close(stoppedListening)
+	}()
+
+	// The client is never idle, but doesn't hear anything from the broker
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case <-stoppedListening:
+			return
+		case <-ticker.C:
+			_ = publisher.SendPublish([]byte("reading"), "sensor")
+		case <-timeout:
+			t.Fatal("Client didn't notice that the broker stopped responding while it was publishing")
+		}
+	}
+}
+
+func TestClientReconnectsAfterBrokerRestarts(t *testing.T) {
+	options := gobro.Options{
+		Listeners: []gobro.ListenerConfig{{Transport: network.TCP, IP: "localhost", Port: 8035}},
+	}
+	broker := gobro.NewServer(options)
+	testErr(t, broker.Start(context.Background()))
+
+	subscriber := client.CreateClient()
+	subscriber.AutoReconnect = true
+	subscriber.ReconnectDelay = 50 * time.Millisecond
+	subscriber.MaxReconnectDelay = 200 * time.Millisecond
+	lost := make(chan error, 1)
+	reconnected := make(chan struct{}, 1)
+	subscriber.OnConnectionLost = func(err error) { lost <- err }
+	subscriber.OnReconnect = func() { reconnected <- struct{}{} }
+	testErr(t, subscriber.Connect("localhost", 8035))
+	defer subscriber.SendDisconnect()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscription, err := subscriber.Subscribe(ctx, "reconnect/test", 0)
+	testErr(t, err)
+	if err != nil {
+		return
+	}
+
+	testErr(t, broker.Shutdown(context.Background()))
+	select {
+	case <-lost:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connection loss wasn't reported")
+	}
+	if err := subscriber.SendPublishWithQoS([]byte("lost"), "reconnect/test", 1); err == nil {
+		t.Error("Publishing while disconnected succeeded")
+	}
+
+	// Some reconnection attempts fail before the broker is back
+	time.Sleep(300 * time.Millisecond)
+	broker = gobro.NewServer(options)
+	testErr(t, broker.Start(context.Background()))
+	// The subscriber has to disconnect first, or it keeps reconnecting
+	t.Cleanup(func() { broker.Shutdown(context.Background()) })
+	select {
+	case <-reconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Client didn't reconnect")
+	}
+
+	publisher, err := client.CreateAndConnectClient("localhost", 8035)
+	testErr(t, err)
+	if err != nil {
+		return
+	}
+	defer publisher.SendDisconnect()
+	testErr(t, publisher.SendPublishWithQoS([]byte("back"), "reconnect/test", 1))
+
+	select {
+	case message := <-subscription.Messages():
+		if string(message.Payload) != "back" {
+			t.Error("Received", string(message.Payload), "instead of back")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Subscription wasn't replayed after reconnecting")
+	}
+}
+
+func TestQueuedPublishesAreSentAfterReconnecting(t *testing.T) {
+	options := gobro.Options{
+		Listeners: []gobro.ListenerConfig{{Transport: network.TCP, IP: "localhost", Port: 8036}},
+	}
+	broker := gobro.NewServer(options)
+	testErr(t, broker.Start(context.Background()))
+
+	publisher := client.CreateClient()
+	publisher.AutoReconnect = true
+	publisher.ReconnectDelay = 500 * time.Millisecond
+	publisher.ReconnectJitter = 0
+	queue, err := client.CreateOutboundQueue(3, 1000, nil)
+	testErr(t, err)
+	publisher.Queue = queue
+	lost := make(chan error, 1)
+	reconnected := make(chan struct{}, 1)
+	publisher.OnConnectionLost = func(err error) { lost <- err }
+	publisher.OnReconnect = func() { reconnected <- struct{}{} }
+	testErr(t, publisher.Connect("localhost", 8036))
+
+	testErr(t, broker.Shutdown(context.Background()))
+	select {
+	case <-lost:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connection loss wasn't reported")
+	}
+	for i := byte(0); i < 3; i++ {
+		testErr(t, publisher.SendPublishWithQoS([]byte{'0' + i}, "queue/test", i))
+	}
+	if err := publisher.SendPublish([]byte("3"), "queue/test"); !errors.Is(err, client.ErrQueueFull) {
+		t.Error("Publishing to a full queue returned", err)
+	}
+
+	// The subscriber has to be subscribed before the publisher reconnects
+	broker = gobro.NewServer(options)
+	testErr(t, broker.Start(context.Background()))
+	t.Cleanup(func() { broker.Shutdown(context.Background()) })
+	defer publisher.SendDisconnect()
+	subscriber, err := client.CreateAndConnectClient("localhost", 8036)
+	testErr(t, err)
+	if err != nil {
+		return
+	}
+	defer subscriber.SendDisconnect()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscription, err := subscriber.Subscribe(ctx, "queue/test", 2)
+	testErr(t, err)
+	if err != nil {
+		return
+	}
+
+	select {
+	case <-reconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Publisher didn't reconnect")
+	}
+	if queue.Len() != 0 {
+		t.Error(queue.Len(), "messages were left in the queue")
+	}
+	for i := byte(0); i < 3; i++ {
+		select {
+		case message := <-subscription.Messages():
+			if message.Payload[0] != '0'+i || message.Qos != i {
+				t.Errorf("Received %s with QoS %v, expected %c with QoS %v", message.Payload, message.Qos, '0'+i, i)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Queued message", i, "wasn't sent")
+		}
+	}
+}
+
+func TestQueueStoreKeepsMessagesAndPacketIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue", "outbound.log")
+	store, err := client.OpenFileQueueStore(path)
+	testErr(t, err)
+	queue, err := client.CreateOutboundQueue(0, 0, store)
+	testErr(t, err)
+	offline := client.CreateClient()
+	offline.Queue = queue
+	testErr(t, offline.SendPublishWithQoS([]byte("first"), "stored/test", 1))
+	testErr(t, offline.SendPublishWithQoS([]byte("second"), "stored/test", 2))
+	testErr(t, offline.SendPublish([]byte("third"), "stored/test"))
+	saved, err := store.Load()
+	testErr(t, err)
+	testErr(t, store.Close())
+
+	// The process restarted
+	store, err = client.OpenFileQueueStore(path)
+	testErr(t, err)
+	defer store.Close()
+	loaded, err := store.Load()
+	testErr(t, err)
+	if !reflect.DeepEqual(saved, loaded) || len(loaded) != 3 {
+		t.Errorf("Saved %+v, but loaded %+v", saved, loaded)
+	}
+	queue, err = client.CreateOutboundQueue(0, 0, store)
+	testErr(t, err)
+	if queue.Len() != 3 {
+		t.Error("Queue held", queue.Len(), "messages after restarting")
+	}
+
+	subscriber, err := client.CreateAndConnectClient("localhost", 8000)
+	testErr(t, err)
+	defer subscriber.SendDisconnect()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscription, err := subscriber.Subscribe(ctx, "stored/test", 2)
+	testErr(t, err)
+	if err != nil {
+		return
+	}
+
+	restarted := client.CreateClient()
+	restarted.Queue = queue
+	testErr(t, restarted.Connect("localhost", 8000))
+	defer restarted.SendDisconnect()
+	for _, expected := range []string{"first", "second", "third"} {
+		select {
+		case message := <-subscription.Messages():
+			if string(message.Payload) != expected {
+				t.Error("Received", string(message.Payload), "instead of", expected)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Stored message", expected, "wasn't sent")
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if loaded, _ := store.Load(); len(loaded) != 0 {
+		t.Error("Sent messages were left in the store:", loaded)
+	}
+}
+
+// acceptFakeClient accepts a client on the listener and answers its CONNECT
+func acceptFakeClient(t *testing.T, listener *net.TCPListener) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	testErr(t, listener.SetDeadline(time.Now().Add(2*time.Second)))
+	connection, err := listener.Accept()
+	testErr(t, err)
+	testErr(t, connection.SetReadDeadline(time.Now().Add(2*time.Second)))
+	reader := bufio.NewReader(connection)
+	expectPacket(t, reader, packets.CONNECT)
+	_, err = connection.Write(packets.CreateConnACK(false, 0))
+	testErr(t, err)
+	return connection, reader
+}
+
+// expectPacket reads the next packet from the client, which should be of the given type,
+// and returns it with its packet identifier
+func expectPacket(t *testing.T, reader *bufio.Reader, packetType byte) ([]byte, int) {
+	t.Helper()
+	packetArr, err := packets.ReadPacketFromConnection(reader)
+	testErr(t, err)
+	packet, receivedType, err := packets.DecodePacket(packetArr)
+	testErr(t, err)
+	if receivedType != packetType {
+		t.Fatalf("Expected a %v, but received a %v", packets.PacketTypeName(packetType),
+			packets.PacketTypeName(receivedType))
+	}
+	switch header := packet.VariableLengthHeader.(type) {
+	case *packets.PublishVariableHeader:
+		return packetArr, header.PacketIdentifier
+	case *packets.PubackVariableHeader:
+		return packetArr, header.PacketIdentifier
+	}
+	return packetArr, 0
+}
+
+func TestUnacknowledgedPublishesAreFinishedAfterReconnecting(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8039})
+	testErr(t, err)
+	defer listener.Close()
+
+	publisher := client.CreateClient()
+	publisher.AutoReconnect = true
+	publisher.ReconnectDelay = 50 * time.Millisecond
+	connected := make(chan error, 1)
+	go func() { connected <- publisher.Connect("localhost", 8039) }()
+	connection, reader := acceptFakeClient(t, listener)
+	testErr(t, <-connected)
+	defer func() { _ = publisher.SendDisconnect() }()
+
+	// The broker doesn't acknowledge the QoS 1 message, and drops the connection
+	// after receiving the PUBREL of the QoS 2 message
+	published := make(chan error, 2)
+	go func() { published <- publisher.SendPublishWithQoS([]byte("once"), "unacknowledged", 1) }()
+	_, unacknowledgedID := expectPacket(t, reader, packets.PUBLISH)
+	go func() { published <- publisher.SendPublishWithQoS([]byte("exactly once"), "released", 2) }()
+	_, releasedID := expectPacket(t, reader, packets.PUBLISH)
+	_, err = connection.Write(packets.CreatePubRec(releasedID))
+	testErr(t, err)
+	expectPacket(t, reader, packets.PUBREL)
+	connection.Close()
+	for i := 0; i < 2; i++ {
+		if err := <-published; err == nil {
+			t.Error("Publish didn't return an error when the connection was lost before it was acknowledged")
+		}
+	}
+
+	connection, reader = acceptFakeClient(t, listener)
+	defer connection.Close()
+	resent, packetID := expectPacket(t, reader, packets.PUBLISH)
+	if packetID != unacknowledgedID || resent[0]&packets.DupFlag == 0 {
+		t.Errorf("Expected the unacknowledged message %v to be sent again as a duplicate, but received %v",
+			unacknowledgedID, resent)
+	}
+	_, err = connection.Write(packets.CreatePubAck(packetID))
+	testErr(t, err)
+	if _, packetID := expectPacket(t, reader, packets.PUBREL); packetID != releasedID {
+		t.Errorf("Expected the PUBREL of %v to be sent again, but it was for %v", releasedID, packetID)
+	}
+	_, err = connection.Write(packets.CreatePubComp(releasedID))
+	testErr(t, err)
+}
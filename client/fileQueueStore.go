@@ -0,0 +1,215 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// These are the operations written to a FileQueueStore's file
+const (
+	opSaveMessage   = "save"
+	opDeleteMessage = "delete"
+)
+
+// FileQueueStore is a QueueStore that keeps the queued messages in a file. Every change is appended
+// to the file, which is rewritten with only the queued messages when it is opened, and emptied
+// whenever the queue is.
+//
+// Changes are written to the file straight away, so they survive the process crashing,
+// but the file is only synced to disk when it is rewritten.
+type FileQueueStore struct {
+	path string
+	lock sync.Mutex
+	// file is nil once the store has been closed
+	file     *os.File
+	writer   *bufio.Writer
+	messages map[int64]QueuedMessage
+}
+
+// queueRecord is a single change written to a FileQueueStore's file
+type queueRecord struct {
+	Op      string        `json:"op"`
+	Message QueuedMessage `json:"message"`
+}
+
+// OpenFileQueueStore opens the FileQueueStore in a file, creating the file and its directory if they
+// don't exist. A change that was only partly written to the end of the file, because the process
+// stopped while writing it, is discarded.
+func OpenFileQueueStore(path string) (*FileQueueStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	store := &FileQueueStore{
+		path:     path,
+		messages: make(map[int64]QueuedMessage),
+	}
+	if err := store.replay(); err != nil {
+		return nil, err
+	}
+	if err := store.rewrite(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// replay applies every change in the file
+func (store *FileQueueStore) replay() error {
+	file, err := os.Open(store.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("Discarding a partly written change at the end of %v\n", store.path)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		record := queueRecord{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("error: the queue in %v is corrupt: %w", store.path, err)
+		}
+		switch record.Op {
+		case opSaveMessage:
+			store.messages[record.Message.Sequence] = record.Message
+		case opDeleteMessage:
+			delete(store.messages, record.Message.Sequence)
+		}
+	}
+}
+
+// rewrite replaces the file with one that only saves the queued messages, in a single rename,
+// so there is always a whole file on disk
+func (store *FileQueueStore) rewrite() error {
+	tempFile, err := os.CreateTemp(filepath.Dir(store.path), filepath.Base(store.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	writer := bufio.NewWriter(tempFile)
+	for _, message := range store.sorted() {
+		if err := writeRecord(writer, queueRecord{Op: opSaveMessage, Message: message}); err != nil {
+			tempFile.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile.Name(), store.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(store.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	store.file = file
+	store.writer = bufio.NewWriter(file)
+	return nil
+}
+
+// sorted returns the queued messages in order. The lock must be held when calling this.
+func (store *FileQueueStore) sorted() []QueuedMessage {
+	messages := make([]QueuedMessage, 0, len(store.messages))
+	for _, message := range store.messages {
+		messages = append(messages, message)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Sequence < messages[j].Sequence
+	})
+	return messages
+}
+
+func writeRecord(writer *bufio.Writer, record queueRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(line, '\n'))
+	return err
+}
+
+// write applies a change and appends it to the file. The file is emptied once the queue is.
+func (store *FileQueueStore) write(record queueRecord) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.file == nil {
+		return errors.New("error: the queue store has been closed")
+	}
+
+	switch record.Op {
+	case opSaveMessage:
+		store.messages[record.Message.Sequence] = record.Message
+	case opDeleteMessage:
+		delete(store.messages, record.Message.Sequence)
+	}
+	if len(store.messages) == 0 {
+		store.writer.Reset(store.file)
+		return store.file.Truncate(0)
+	}
+
+	if err := writeRecord(store.writer, record); err != nil {
+		return err
+	}
+	return store.writer.Flush()
+}
+
+// Load implements the QueueStore interface
+func (store *FileQueueStore) Load() ([]QueuedMessage, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.sorted(), nil
+}
+
+// Save implements the QueueStore interface
+func (store *FileQueueStore) Save(message QueuedMessage) error {
+	return store.write(queueRecord{Op: opSaveMessage, Message: message})
+}
+
+// Delete implements the QueueStore interface
+func (store *FileQueueStore) Delete(sequence int64) error {
+	return store.write(queueRecord{Op: opDeleteMessage, Message: QueuedMessage{Sequence: sequence}})
+}
+
+// Close implements the QueueStore interface. Closing a FileQueueStore more than once does nothing.
+func (store *FileQueueStore) Close() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.file == nil {
+		return nil
+	}
+	err := store.writer.Flush()
+	if closeErr := store.file.Close(); err == nil {
+		err = closeErr
+	}
+	store.file = nil
+	return err
+}
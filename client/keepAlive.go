@@ -0,0 +1,65 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"MQTT-GO/network"
+	"MQTT-GO/structures"
+)
+
+// keepAliveSeconds is the KeepAlive sent in the CONNECT. The broker only takes whole seconds, so it is
+// rounded up, as a KeepAlive under a second would otherwise turn keep alive off on the broker while we still ping.
+func (client *Client) keepAliveSeconds() int {
+	if client.KeepAlive <= 0 {
+		return 0
+	}
+	return int((client.KeepAlive + time.Second - 1) / time.Second)
+}
+
+// keepAlive sends a PINGREQ whenever the client hasn't sent anything to the broker, or received anything
+// from it, for its KeepAlive. A client that only publishes QoS 0 messages still hears from the broker
+// this way. If the broker doesn't reply with a PINGRESP within the PingTimeout, we assume the broker
+// is dead and close the connection, which stops ListenForPackets.
+// It runs until stop is closed.
+func (client *Client) keepAlive(connection network.Conn, stop <-chan struct{}) {
+	if client.KeepAlive <= 0 {
+		return
+	}
+
+	for {
+		idleFor := structures.Max(time.Since(time.Unix(0, client.lastSent.Load())),
+			time.Since(time.Unix(0, client.lastReceived.Load())))
+		if idleFor < client.KeepAlive {
+			select {
+			case <-stop:
+				return
+			case <-time.After(client.KeepAlive - idleFor):
+			}
+			continue
+		}
+
+		// Throw away any PINGRESP that arrived after we gave up waiting for it
+		select {
+		case <-client.pingResponses:
+		default:
+		}
+
+		err := client.SendPingreq()
+		if err != nil {
+			fmt.Println("Error while sending PINGREQ:", err)
+			return
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-client.pingResponses:
+		case <-time.After(client.PingTimeout):
+			log.Printf("Broker didn't respond to PINGREQ within %v, closing connection\n", client.PingTimeout)
+			connection.Close()
+			return
+		}
+	}
+}
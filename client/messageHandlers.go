@@ -0,0 +1,79 @@
+package client
+
+import (
+	"MQTT-GO/packets"
+)
+
+// MessageHandler handles a message the broker sent us. retained is true if the message
+// was retained by the broker, and sent because we subscribed to its topic.
+type MessageHandler func(topic string, payload []byte, qos byte, retained bool)
+
+// messageRoute is a MessageHandler and the topic filter it handles messages for
+type messageRoute struct {
+	topicFilter string
+	handler     MessageHandler
+}
+
+// OnMessage registers a handler for every message from the broker with a topic matching the
+// topic filter, which can contain the + and # wildcards. A message matching several filters is
+// passed to each of their handlers, in the order they were registered.
+// Handlers are called from ListenForPackets, one message at a time and in the order the messages
+// arrive, so a handler that blocks stops the client from reading from the broker.
+func (client *Client) OnMessage(topicFilter string, handler MessageHandler) {
+	client.addHandler(topicFilter, handler)
+}
+
+// addHandler registers a handler, and returns its route so that it can be removed
+func (client *Client) addHandler(topicFilter string, handler MessageHandler) *messageRoute {
+	client.handlersLock.Lock()
+	defer client.handlersLock.Unlock()
+	route := &messageRoute{topicFilter: topicFilter, handler: handler}
+	client.handlers = append(client.handlers, route)
+	return route
+}
+
+// removeHandler removes a handler, and returns true if no other handler has the same topic filter
+func (client *Client) removeHandler(route *messageRoute) bool {
+	client.handlersLock.Lock()
+	defer client.handlersLock.Unlock()
+	lastOfFilter := true
+	for i := len(client.handlers) - 1; i >= 0; i-- {
+		switch {
+		case client.handlers[i] == route:
+			client.handlers = append(client.handlers[:i], client.handlers[i+1:]...)
+		case client.handlers[i].topicFilter == route.topicFilter:
+			lastOfFilter = false
+		}
+	}
+	return lastOfFilter
+}
+
+// StoreReceivedPackets turns storing every PUBLISH from the broker in ReceivedPackets on or off.
+// It is off by default, as nothing is ever removed from ReceivedPackets.
+func (client *Client) StoreReceivedPackets(store bool) {
+	client.storeReceived.Store(store)
+}
+
+// receive passes a new PUBLISH to every handler with a matching topic filter,
+// and stores it in ReceivedPackets if that has been turned on
+func (client *Client) receive(publish *packets.Packet) {
+	if client.storeReceived.Load() {
+		client.ReceivedPackets.Append(publish)
+	}
+
+	topic := publish.VariableLengthHeader.(*packets.PublishVariableHeader).TopicFilter
+	client.handlersLock.RLock()
+	matching := make([]MessageHandler, 0, 1)
+	for _, route := range client.handlers {
+		if packets.TopicMatchesFilter(route.topicFilter, topic) {
+			matching = append(matching, route.handler)
+		}
+	}
+	client.handlersLock.RUnlock()
+
+	qos := packets.GetQoS(publish.ControlHeader.Flags)
+	retained := publish.ControlHeader.Flags&packets.RetainFlag != 0
+	for _, handler := range matching {
+		handler(topic, publish.Payload.RawApplicationMessage, qos, retained)
+	}
+}
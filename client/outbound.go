@@ -0,0 +1,86 @@
+package client
+
+import (
+	"log"
+	"sort"
+)
+
+// outboundMessage is a QoS 1 or 2 message that has been sent to the broker, but not acknowledged.
+// A QoS 2 message is released once the broker has sent a PUBREC, after which only its PUBREL is sent again.
+type outboundMessage struct {
+	message  QueuedMessage
+	order    int64
+	released bool
+}
+
+// nextPacketID returns a packet identifier that isn't being used by one of our unacknowledged or queued messages
+func (client *Client) nextPacketID() int {
+	for {
+		packetID := getAndIncrementPacketID()
+		if client.outbound.Contains(packetID) {
+			continue
+		}
+		if client.Queue != nil && client.Queue.hasPacketID(packetID) {
+			continue
+		}
+		return packetID
+	}
+}
+
+// track records that a message has been sent, until the broker has acknowledged it
+func (client *Client) track(message QueuedMessage, order int64) {
+	if message.Qos == 0 {
+		return
+	}
+	client.outbound.Put(message.PacketID, outboundMessage{message: message, order: order})
+}
+
+// markReleased records that the broker has sent a PUBREC for a QoS 2 message
+func (client *Client) markReleased(packetID int) {
+	outbound := client.outbound.Get(packetID)
+	outbound.released = true
+	client.outbound.Put(packetID, outbound)
+}
+
+// sendPending finishes the messages the broker hadn't acknowledged before the connection was lost,
+// and then sends the Queue. pending must be taken before the new connection is opened, so that
+// messages being sent on it aren't sent twice.
+func (client *Client) sendPending(pending []outboundMessage) {
+	if client.resendOutbound(pending) {
+		client.flushQueue()
+	}
+}
+
+// resendOutbound sends the PUBREL of every released message again, and every other unacknowledged
+// message as a duplicate, in the order they were first sent. It returns false if the connection is lost.
+func (client *Client) resendOutbound(pending []outboundMessage) bool {
+	client.resendLock.Lock()
+	defer client.resendLock.Unlock()
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].order < pending[j].order
+	})
+	for _, outbound := range pending {
+		packetID := outbound.message.PacketID
+		if !client.outbound.Contains(packetID) {
+			continue
+		}
+		// The message may have been released since pending was taken
+		outbound = client.outbound.Get(packetID)
+		var done bool
+		var err error
+		if outbound.released {
+			done, err = client.release(packetID)
+		} else {
+			outbound.message.Sent = true
+			done, err = client.publish(outbound.message)
+		}
+		if !done {
+			return false
+		}
+		if err != nil {
+			log.Printf("Error while sending an unacknowledged message to '%v' again: %v\n", outbound.message.Topic, err)
+		}
+	}
+	return true
+}
@@ -15,8 +15,22 @@ var packetIdentifier = packetIDStore{
 	packetIdentifier: atomic.Int64{},
 }
 
+// Packet identifiers are sent as two bytes, so they wrap around after 65535.
+// Zero isn't a valid packet identifier so we skip it.
+const maxPacketID = 65535
+
 func getAndIncrementPacketID() int {
-	return int(packetIdentifier.packetIdentifier.Add(1))
+	return int((packetIdentifier.packetIdentifier.Add(1)-1)%maxPacketID) + 1
+}
+
+// skipPacketIDsTo stops packet identifiers up to the given one being given out, unless they wrap around
+func skipPacketIDsTo(packetID int) {
+	for {
+		current := packetIdentifier.packetIdentifier.Load()
+		if current >= int64(packetID) || packetIdentifier.packetIdentifier.CompareAndSwap(current, int64(packetID)) {
+			return
+		}
+	}
 }
 
 // WaitingAcks is a struct that stores a list of packets that are waiting for an ACK.
@@ -25,6 +39,9 @@ func getAndIncrementPacketID() int {
 type WaitingAcks struct {
 	PacketList    *structures.LinkedList[*StoredPacket]
 	waitCondition *sync.Cond
+	// connection counts the connections that have been lost, so that threads waiting
+	// for an ACK on a lost connection stop waiting
+	connection int
 }
 
 // StoredPacket is a struct that stores a packet, and the packet identifier.
@@ -52,27 +69,47 @@ func (wp *WaitingAcks) AddItem(storedPacket *StoredPacket) {
 	wp.waitCondition.L.Unlock()
 }
 
+// getItem finds the ACK with the given packet identifier and removes it from the list,
+// so the identifier can be safely reused once it wraps around.
 func (wp *WaitingAcks) getItem(packetIdentifier int) *[]byte {
 	packetFinder := func(s *StoredPacket) bool { return s.PacketID == packetIdentifier }
 	packetStore := wp.PacketList.FilterSingleItem(packetFinder)
 	if packetStore != nil {
-		return &(*packetStore).Packet
+		storedPacket := *packetStore
+		err := wp.PacketList.Delete(storedPacket)
+		if err != nil {
+			structures.Println("Error while removing ACK from waiting list:", err)
+		}
+		return &storedPacket.Packet
 	}
 	return nil
 }
 
 // GetOrWait gets a packet from the list of packets that are waiting for an ACK.
 // If the packet is not in the list, it waits for a broadcast from the AddItem function.
+// Once a packet has been returned it is removed from the list.
+// If the connection is lost while waiting, nil is returned.
 func (wp *WaitingAcks) GetOrWait(packetIdentifier int) *[]byte {
 	wp.waitCondition.L.Lock()
 	defer wp.waitCondition.L.Unlock()
+	connection := wp.connection
 	for {
 		storedPacket := wp.getItem(packetIdentifier)
-		if storedPacket == nil {
-			structures.Println()
-			wp.waitCondition.Wait()
-		} else {
+		if storedPacket != nil {
 			return storedPacket
 		}
+		if wp.connection != connection {
+			return nil
+		}
+		structures.Println()
+		wp.waitCondition.Wait()
 	}
 }
+
+// connectionLost wakes every thread waiting for an ACK, which then stops waiting
+func (wp *WaitingAcks) connectionLost() {
+	wp.waitCondition.L.Lock()
+	wp.connection++
+	wp.waitCondition.Broadcast()
+	wp.waitCondition.L.Unlock()
+}
@@ -0,0 +1,242 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// ErrQueueFull is returned when publishing while disconnected, if the Queue can't hold the message
+var ErrQueueFull = errors.New("error: the outbound queue is full")
+
+// QueuedMessage is a message published while the client was disconnected, waiting to be sent
+type QueuedMessage struct {
+	// Sequence is the order the message is sent in
+	Sequence int64
+	// PacketID is the identifier the message is sent with, which doesn't change however many times it is sent
+	PacketID int
+	Topic    string
+	Payload  []byte
+	Qos      byte
+	Retain   bool
+	// Sent is set if the message was sent before the connection was lost, so that it is sent again as a duplicate
+	Sent bool
+}
+
+// size is how much of the queue's MaxBytes the message takes up
+func (message QueuedMessage) size() int {
+	return len(message.Topic) + len(message.Payload)
+}
+
+// QueueStore saves the messages in an OutboundQueue, so that they survive the process restarting
+type QueueStore interface {
+	// Load returns every saved message, in the order they were queued
+	Load() ([]QueuedMessage, error)
+	// Save saves a message, replacing the saved message with the same Sequence
+	Save(message QueuedMessage) error
+	// Delete deletes a message once it has been sent
+	Delete(sequence int64) error
+	Close() error
+}
+
+// OutboundQueue holds the messages published while a client is disconnected or reconnecting,
+// and sends them in the order they were published once the client has connected.
+// Publishes made while the queue is being sent are queued behind it, so the order is kept.
+type OutboundQueue struct {
+	// MaxMessages and MaxBytes limit the messages the queue holds. Bytes are counted from
+	// the topics and payloads of the messages. A limit of zero or less is no limit.
+	MaxMessages int
+	MaxBytes    int
+
+	lock     sync.Mutex
+	messages []QueuedMessage
+	bytes    int
+	// packetIDs counts the queued messages with each packet identifier, which mustn't be given to new packets
+	packetIDs map[int]int
+	// held is set while the client can't send messages, and until the queue has been sent
+	held         bool
+	lastSequence int64
+	store        QueueStore
+	// flushLock stops the queue being sent by more than one goroutine
+	flushLock sync.Mutex
+}
+
+// CreateOutboundQueue creates a queue with the given limits. If the store isn't nil, the messages
+// saved in it are loaded into the queue, and every message queued is saved to it.
+// The queue starts off held, so messages published before the client connects are queued.
+func CreateOutboundQueue(maxMessages int, maxBytes int, store QueueStore) (*OutboundQueue, error) {
+	queue := &OutboundQueue{
+		MaxMessages: maxMessages,
+		MaxBytes:    maxBytes,
+		held:        true,
+		store:       store,
+		packetIDs:   make(map[int]int),
+	}
+	if store == nil {
+		return queue, nil
+	}
+
+	messages, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("error: couldn't load the outbound queue: %w", err)
+	}
+	for _, message := range messages {
+		queue.messages = append(queue.messages, message)
+		queue.bytes += message.size()
+		queue.packetIDs[message.PacketID]++
+		if message.Sequence > queue.lastSequence {
+			queue.lastSequence = message.Sequence
+		}
+		// The loaded messages keep their packet identifiers, which mustn't be given to new packets
+		skipPacketIDsTo(message.PacketID)
+	}
+	return queue, nil
+}
+
+// Len returns the number of messages in the queue
+func (queue *OutboundQueue) Len() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return len(queue.messages)
+}
+
+// hasPacketID returns true if a queued message has the given packet identifier
+func (queue *OutboundQueue) hasPacketID(packetID int) bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return queue.packetIDs[packetID] > 0
+}
+
+// addIfHeld queues the message if the queue is held, and returns false if it wasn't queued
+func (queue *OutboundQueue) addIfHeld(message QueuedMessage) (bool, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if !queue.held {
+		return false, nil
+	}
+	return true, queue.add(message, false)
+}
+
+// requeue holds the queue and puts a message that couldn't be sent at its front,
+// as it was published before anything that is queued
+func (queue *OutboundQueue) requeue(message QueuedMessage) error {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.held = true
+	return queue.add(message, true)
+}
+
+// add must be called with the lock held
+func (queue *OutboundQueue) add(message QueuedMessage, atFront bool) error {
+	if queue.MaxMessages > 0 && len(queue.messages) >= queue.MaxMessages {
+		return ErrQueueFull
+	}
+	if queue.MaxBytes > 0 && queue.bytes+message.size() > queue.MaxBytes {
+		return ErrQueueFull
+	}
+
+	if atFront && len(queue.messages) > 0 {
+		message.Sequence = queue.messages[0].Sequence - 1
+	} else {
+		queue.lastSequence++
+		message.Sequence = queue.lastSequence
+	}
+	if queue.store != nil {
+		if err := queue.store.Save(message); err != nil {
+			return err
+		}
+	}
+	if atFront {
+		queue.messages = append([]QueuedMessage{message}, queue.messages...)
+	} else {
+		queue.messages = append(queue.messages, message)
+	}
+	queue.bytes += message.size()
+	queue.packetIDs[message.PacketID]++
+	return nil
+}
+
+// hold queues every message published until the queue has been sent
+func (queue *OutboundQueue) hold() {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.held = true
+}
+
+// next returns the message at the front of the queue. If the queue is empty it stops holding messages.
+func (queue *OutboundQueue) next() (QueuedMessage, bool) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if len(queue.messages) == 0 {
+		queue.held = false
+		return QueuedMessage{}, false
+	}
+	return queue.messages[0], true
+}
+
+// markSent records that a message was sent, but may not have reached the broker
+func (queue *OutboundQueue) markSent(message QueuedMessage) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if len(queue.messages) == 0 || queue.messages[0].Sequence != message.Sequence || message.Sent {
+		return
+	}
+	queue.messages[0].Sent = true
+	if queue.store != nil {
+		if err := queue.store.Save(queue.messages[0]); err != nil {
+			log.Println("Error while saving to the queue store:", err)
+		}
+	}
+}
+
+// remove removes a message that has been sent from the queue
+func (queue *OutboundQueue) remove(message QueuedMessage) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for i, queued := range queue.messages {
+		if queued.Sequence == message.Sequence {
+			queue.messages = append(queue.messages[:i], queue.messages[i+1:]...)
+			queue.bytes -= message.size()
+			queue.packetIDs[message.PacketID]--
+			if queue.packetIDs[message.PacketID] == 0 {
+				delete(queue.packetIDs, message.PacketID)
+			}
+			break
+		}
+	}
+	if queue.store != nil {
+		if err := queue.store.Delete(message.Sequence); err != nil {
+			log.Println("Error while deleting a sent message from the queue store:", err)
+		}
+	}
+}
+
+// flushQueue sends the queued messages in order, until the queue is empty or the connection is lost.
+// Messages the broker has refused are dropped, so that they don't hold up the rest of the queue.
+func (client *Client) flushQueue() {
+	queue := client.Queue
+	if queue == nil {
+		return
+	}
+	queue.flushLock.Lock()
+	defer queue.flushLock.Unlock()
+
+	for {
+		message, ok := queue.next()
+		if !ok {
+			return
+		}
+		taken, err := client.publish(message)
+		if !taken {
+			// It is sent again from the queue once the client has reconnected
+			queue.markSent(message)
+			client.outbound.Delete(message.PacketID)
+			return
+		}
+		if err != nil {
+			log.Printf("Error while sending a queued message to '%v': %v\n", message.Topic, err)
+		}
+		queue.remove(message)
+	}
+}
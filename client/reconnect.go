@@ -0,0 +1,110 @@
+package client
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"MQTT-GO/structures"
+)
+
+// Connect connects to the broker and listens for packets in the background. It finishes sending the messages
+// the broker hadn't acknowledged before the connection was lost, and then sends anything in the Queue.
+// If the connection is lost, OnConnectionLost is called, and the client reconnects if AutoReconnect is set.
+func (client *Client) Connect(ip string, port int) error {
+	client.disconnecting.Store(false)
+	pending := client.outbound.Values()
+	if err := client.connect(ip, port); err != nil {
+		return err
+	}
+	go client.run(ip, port)
+	go client.sendPending(pending)
+	return nil
+}
+
+// connect opens a connection to the broker and sends the CONNECT
+func (client *Client) connect(ip string, port int) error {
+	if err := client.SetClientConnection(ip, port); err != nil {
+		return err
+	}
+	if err := client.SendConnect(ip, port); err != nil {
+		client.connection().Close()
+		return err
+	}
+	return nil
+}
+
+// run listens for packets until the connection is lost, and then reconnects if AutoReconnect is set.
+// It returns once the client has been disconnected, or the connection is lost without AutoReconnect.
+// The listener and pinger of the old connection have stopped before a new connection is opened.
+func (client *Client) run(ip string, port int) {
+	for {
+		connection := client.connection()
+		err := client.listen(connection)
+		connection.Close()
+		if client.Queue != nil {
+			client.Queue.hold()
+		}
+		if client.disconnecting.Load() {
+			return
+		}
+		if client.OnConnectionLost != nil {
+			client.OnConnectionLost(err)
+		}
+		pending := client.outbound.Values()
+		if !client.AutoReconnect || !client.reconnect(ip, port) {
+			return
+		}
+
+		go func() {
+			client.resubscribe()
+			client.sendPending(pending)
+			if client.OnReconnect != nil {
+				client.OnReconnect()
+			}
+		}()
+	}
+}
+
+// reconnect tries to connect to the broker again with an exponential backoff, until it succeeds
+// or the client is disconnected, in which case it returns false
+func (client *Client) reconnect(ip string, port int) bool {
+	delay := client.ReconnectDelay
+	for attempt := 1; ; attempt++ {
+		time.Sleep(client.jitter(delay))
+		if client.disconnecting.Load() {
+			return false
+		}
+		err := client.connect(ip, port)
+		if err == nil {
+			log.Printf("Client %v reconnected after %v attempts\n", client.ClientID, attempt)
+			return true
+		}
+		log.Printf("Client %v couldn't reconnect: %v\n", client.ClientID, err)
+		delay = structures.Min(delay*2, client.MaxReconnectDelay)
+	}
+}
+
+// jitter randomises the ReconnectJitter fraction of the delay
+func (client *Client) jitter(delay time.Duration) time.Duration {
+	jitter := structures.Max(structures.Min(client.ReconnectJitter, 1), 0)
+	randomised := time.Duration(float64(delay) * jitter)
+	if randomised <= 0 {
+		return delay
+	}
+	return delay - randomised + time.Duration(rand.Int63n(int64(randomised)+1))
+}
+
+// resubscribe subscribes to the client's topics again, if the broker didn't keep its session
+func (client *Client) resubscribe() {
+	if client.SessionPresent {
+		return
+	}
+	topics := client.subscriptions.Values()
+	if len(topics) == 0 {
+		return
+	}
+	if err := client.SendSubscribe(topics...); err != nil {
+		log.Printf("Client %v couldn't subscribe again after reconnecting: %v\n", client.ClientID, err)
+	}
+}
@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"MQTT-GO/packets"
+)
+
+// DefaultSubscriptionBufferSize is the BufferSize used if the SubscriptionOptions don't set one
+const DefaultSubscriptionBufferSize = 100
+
+// OverflowPolicy decides what happens to a message that arrives when a Subscription's buffer is full
+type OverflowPolicy byte
+
+const (
+	// Block waits for there to be space in the buffer. The client doesn't read anything
+	// else from the broker while it waits, including the ACKs other calls are waiting for
+	// and the PINGRESP, so a Subscription that isn't read for longer than the PingTimeout
+	// makes the client think the broker is dead and close the connection.
+	Block OverflowPolicy = iota
+	// DropOldest throws away the oldest message in the buffer to make space for the new one
+	DropOldest
+	// DropNewest throws away the new message
+	DropNewest
+)
+
+// Message is a message from the broker, received by a Subscription
+type Message struct {
+	Topic   string
+	Payload []byte
+	Qos     byte
+	// Retained is true if the message was retained by the broker, and sent because we subscribed to its topic
+	Retained bool
+}
+
+// SubscriptionOptions configure the buffer of a Subscription
+type SubscriptionOptions struct {
+	// BufferSize is the most messages the Subscription holds that haven't been read from Messages
+	BufferSize int
+	// Overflow is what happens to messages that arrive when the buffer is full
+	Overflow OverflowPolicy
+}
+
+// withDefaults returns the options with defaults for the settings that weren't set
+func (options SubscriptionOptions) withDefaults() SubscriptionOptions {
+	if options.BufferSize <= 0 {
+		options.BufferSize = DefaultSubscriptionBufferSize
+	}
+	return options
+}
+
+// Subscription is a subscription to a topic filter, which passes the messages matching it to a channel.
+// It lasts until it is closed, or until the context it was created with is done.
+type Subscription struct {
+	TopicFilter string
+	Qos         byte
+
+	client   *Client
+	route    *messageRoute
+	overflow OverflowPolicy
+	messages chan Message
+	// done is closed when the Subscription starts closing, and then messages is closed
+	// once nothing is passing messages to it
+	done      chan struct{}
+	closeOnce sync.Once
+	sendLock  sync.Mutex
+	closeErr  error
+}
+
+// Subscribe subscribes to a topic filter, and returns a Subscription that passes the messages
+// matching it to its Messages channel. Messages are buffered and blocked on a full buffer, as set
+// by the DefaultSubscriptionBufferSize and the Block policy.
+// The Subscription is closed when the context is done.
+func (client *Client) Subscribe(ctx context.Context, topicFilter string, qos byte) (*Subscription, error) {
+	return client.SubscribeWithOptions(ctx, topicFilter, qos, SubscriptionOptions{})
+}
+
+// SubscribeWithOptions is the same as Subscribe, with options for the Subscription's buffer.
+// If the context is done before the broker has acknowledged the subscription, the context's error is returned.
+func (client *Client) SubscribeWithOptions(ctx context.Context, topicFilter string, qos byte,
+	options SubscriptionOptions) (*Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	options = options.withDefaults()
+	subscription := &Subscription{
+		TopicFilter: topicFilter,
+		Qos:         qos,
+		client:      client,
+		overflow:    options.Overflow,
+		messages:    make(chan Message, options.BufferSize),
+		done:        make(chan struct{}),
+	}
+	// The handler is added first, so that retained messages sent straight after the SUBACK are kept
+	subscription.route = client.addHandler(topicFilter, subscription.deliver)
+
+	subscribed := make(chan error, 1)
+	go func() {
+		returnCodes, err := client.sendSubscribe(packets.TopicWithQoS{Topic: topicFilter, QoS: qos})
+		if err == nil && (len(returnCodes) == 0 || returnCodes[0] == packets.SubackFailure) {
+			err = errors.New("error: the broker refused the subscription")
+		}
+		subscribed <- err
+	}()
+
+	select {
+	case err := <-subscribed:
+		if err != nil {
+			client.removeHandler(subscription.route)
+			return nil, err
+		}
+	case <-ctx.Done():
+		// The broker may still accept the subscription, which is then removed
+		lastOfFilter := client.removeHandler(subscription.route)
+		go func() {
+			if err := <-subscribed; err == nil && lastOfFilter {
+				client.SendUnsubscribe(topicFilter)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			subscription.Close()
+		case <-subscription.done:
+		}
+	}()
+	return subscription, nil
+}
+
+// Messages returns the channel the Subscription's messages are passed to.
+// It is closed once the Subscription is closed.
+func (subscription *Subscription) Messages() <-chan Message {
+	return subscription.messages
+}
+
+// Close stops passing messages to the Subscription, and closes its Messages channel. The client
+// unsubscribes from the topic filter, unless one of its other handlers or Subscriptions uses it.
+// Close doesn't wait for the broker to acknowledge the UNSUBSCRIBE, so it can be called from a
+// MessageHandler. It only returns an error if the UNSUBSCRIBE couldn't be sent.
+// Closing a Subscription more than once returns the error from the first time.
+func (subscription *Subscription) Close() error {
+	subscription.closeOnce.Do(func() {
+		close(subscription.done)
+		lastOfFilter := subscription.client.removeHandler(subscription.route)
+		subscription.sendLock.Lock()
+		close(subscription.messages)
+		subscription.sendLock.Unlock()
+		if !lastOfFilter {
+			return
+		}
+
+		waitForUnsuback, err := subscription.client.sendUnsubscribe(subscription.TopicFilter)
+		subscription.closeErr = err
+		if err == nil {
+			go func() {
+				if err := waitForUnsuback(); err != nil {
+					log.Printf("Error while unsubscribing from '%v': %v\n", subscription.TopicFilter, err)
+				}
+			}()
+		}
+	})
+	return subscription.closeErr
+}
+
+// deliver is the Subscription's MessageHandler, which passes messages to the Messages channel
+// according to the Subscription's OverflowPolicy
+func (subscription *Subscription) deliver(topic string, payload []byte, qos byte, retained bool) {
+	subscription.sendLock.Lock()
+	defer subscription.sendLock.Unlock()
+	select {
+	case <-subscription.done:
+		return
+	default:
+	}
+
+	message := Message{Topic: topic, Payload: payload, Qos: qos, Retained: retained}
+	switch subscription.overflow {
+	case Block:
+		select {
+		case subscription.messages <- message:
+		case <-subscription.done:
+		}
+	case DropOldest:
+		for {
+			select {
+			case subscription.messages <- message:
+				return
+			default:
+			}
+			select {
+			case <-subscription.messages:
+			default:
+			}
+		}
+	case DropNewest:
+		select {
+		case subscription.messages <- message:
+		default:
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package gobro
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"MQTT-GO/gobro/clients"
+	"MQTT-GO/packets"
+)
+
+// Authorizer decides which topics a client can publish and subscribe to.
+type Authorizer interface {
+	CanPublish(clientID string, username string, topicName string) bool
+	CanSubscribe(clientID string, username string, topicFilter string) bool
+}
+
+// canPublish checks whether the client is allowed to publish to the topic.
+// Topics starting with $, such as $SYS, are reserved for the broker, so clients can never publish to them.
+func (server *Server) canPublish(client *clients.Client, topicName string) bool {
+	if strings.HasPrefix(topicName, "$") {
+		log.Printf("- Client '%v' can't publish to the reserved topic '%v'\n", client.ClientIdentifier, topicName)
+		return false
+	}
+	if server.options.Authorizer == nil {
+		return true
+	}
+	if server.options.Authorizer.CanPublish(string(client.ClientIdentifier), client.Settings().Username, topicName) {
+		return true
+	}
+	log.Printf("- Client '%v' isn't authorized to publish to '%v'\n", client.ClientIdentifier, topicName)
+	return false
+}
+
+// canReceive checks whether a subscriber is still allowed to receive messages published to the topic.
+// The rules may have changed since it subscribed, so this is checked for every message delivered.
+func (server *Server) canReceive(client *clients.Client, topicName string) bool {
+	if server.options.Authorizer == nil {
+		return true
+	}
+	return server.options.Authorizer.CanSubscribe(string(client.ClientIdentifier), client.Settings().Username, topicName)
+}
+
+// Access is the type of access an ACLRule applies to
+type Access byte
+
+// These are the types of access an ACLRule can allow or deny
+const (
+	AccessPublish   Access = 1
+	AccessSubscribe Access = 2
+	AccessAll              = AccessPublish | AccessSubscribe
+)
+
+// ACLRule allows or denies publishing and/or subscribing to topics matching a topic filter.
+// The topic filter can contain %u and %c, which are replaced with the client's username and
+// ClientID. If Username or ClientID are set, the rule only applies to that user or client.
+type ACLRule struct {
+	Allow       bool
+	Access      Access
+	TopicFilter string
+	Username    string
+	ClientID    string
+}
+
+// ACL is an Authorizer made up of a list of rules. The first rule that applies to a
+// publish or subscribe decides whether it is allowed, and anything that no rule applies
+// to is denied. Rules can be loaded from a file and reloaded while the server is running.
+//
+// Allow rules only allow a subscription if the rule's filter covers every topic the subscription
+// could match, while deny rules deny a subscription if it could match any topic the rule covers.
+// Existing subscriptions are kept when the rules change, but a subscriber is only sent the messages
+// whose topic the rules still allow it to subscribe to.
+type ACL struct {
+	filename string
+	lock     sync.RWMutex
+	rules    []ACLRule
+	modTime  time.Time
+}
+
+// NewACL creates an ACL from a list of rules
+func NewACL(rules []ACLRule) *ACL {
+	return &ACL{rules: rules}
+}
+
+// LoadACLFile creates an ACL from a file. Every line of the file is a rule of the form
+//
+//	<allow|deny> <publish|subscribe|all> <topic filter> [user <username>|client <ClientID>]
+//
+// Blank lines and lines starting with # are ignored.
+func LoadACLFile(filename string) (*ACL, error) {
+	acl := &ACL{filename: filename}
+	err := acl.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Reload reads the ACL's file again. If the file is malformed the current rules are kept.
+func (acl *ACL) Reload() error {
+	if acl.filename == "" {
+		return nil
+	}
+	fileInfo, err := os.Stat(acl.filename)
+	if err != nil {
+		return err
+	}
+	rules, err := readACLFile(acl.filename)
+	if err != nil {
+		return err
+	}
+
+	acl.lock.Lock()
+	acl.rules = rules
+	acl.modTime = fileInfo.ModTime()
+	acl.lock.Unlock()
+	return nil
+}
+
+// Watch checks the ACL's file for changes every interval and reloads it when it changes.
+// It runs until stop is closed.
+func (acl *ACL) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		fileInfo, err := os.Stat(acl.filename)
+		if err != nil {
+			log.Println("- Error while checking the ACL file for changes:", err)
+			continue
+		}
+		acl.lock.RLock()
+		changed := !fileInfo.ModTime().Equal(acl.modTime)
+		acl.lock.RUnlock()
+		if !changed {
+			continue
+		}
+
+		err = acl.Reload()
+		if err != nil {
+			log.Println("- Error while reloading the ACL file, keeping the old rules:", err)
+			continue
+		}
+		log.Println("+ Reloaded the ACL file")
+	}
+}
+
+// CanPublish implements the Authorizer interface
+func (acl *ACL) CanPublish(clientID string, username string, topicName string) bool {
+	return acl.check(AccessPublish, clientID, username, func(rule *ACLRule, filter string) bool {
+		return packets.TopicMatchesFilter(filter, topicName)
+	})
+}
+
+// CanSubscribe implements the Authorizer interface
+func (acl *ACL) CanSubscribe(clientID string, username string, topicFilter string) bool {
+	return acl.check(AccessSubscribe, clientID, username, func(rule *ACLRule, filter string) bool {
+		if rule.Allow {
+			return filterCovers(filter, topicFilter)
+		}
+		return filtersOverlap(filter, topicFilter)
+	})
+}
+
+// check finds the first rule for this type of access and client that matches, and returns
+// whether it allows access
+func (acl *ACL) check(access Access, clientID string, username string,
+	matches func(rule *ACLRule, filter string) bool) bool {
+	acl.lock.RLock()
+	defer acl.lock.RUnlock()
+
+	for i := range acl.rules {
+		rule := &acl.rules[i]
+		if rule.Access&access == 0 ||
+			(rule.Username != "" && rule.Username != username) ||
+			(rule.ClientID != "" && rule.ClientID != clientID) {
+			continue
+		}
+		// A rule about the client's username can't apply to a client without one. As in Mosquitto,
+		// rules aren't applied with usernames or client IDs that would change the rule's levels,
+		// so that a client called + can't widen a rule to other clients' topics.
+		if strings.Contains(rule.TopicFilter, "%u") && (username == "" || !isSubstitutable(username)) {
+			continue
+		}
+		if strings.Contains(rule.TopicFilter, "%c") && !isSubstitutable(clientID) {
+			continue
+		}
+		filter := strings.NewReplacer("%u", username, "%c", clientID).Replace(rule.TopicFilter)
+		if matches(rule, filter) {
+			return rule.Allow
+		}
+	}
+	return false
+}
+
+// isSubstitutable checks that a username or client ID can be put into a rule's topic filter as a single level
+func isSubstitutable(value string) bool {
+	return !strings.ContainsAny(value, "+#/")
+}
+
+// filterCovers checks whether every topic matched by the topic filter is also matched by the rule's filter
+func filterCovers(ruleFilter string, topicFilter string) bool {
+	ruleLevels := strings.Split(ruleFilter, "/")
+	topicLevels := strings.Split(topicFilter, "/")
+
+	for i, level := range ruleLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || topicLevels[i] == "#" {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(ruleLevels) == len(topicLevels)
+}
+
+// filtersOverlap checks whether any topic could be matched by both topic filters
+func filtersOverlap(filterA string, filterB string) bool {
+	levelsA := strings.Split(filterA, "/")
+	levelsB := strings.Split(filterB, "/")
+
+	for i := 0; i < len(levelsA) && i < len(levelsB); i++ {
+		if levelsA[i] == "#" || levelsB[i] == "#" {
+			return true
+		}
+		if levelsA[i] != "+" && levelsB[i] != "+" && levelsA[i] != levelsB[i] {
+			return false
+		}
+	}
+	if len(levelsA) == len(levelsB) {
+		return true
+	}
+	// "a/#" also matches "a"
+	longer := levelsA
+	if len(levelsB) > len(levelsA) {
+		longer = levelsB
+	}
+	shorterLength := len(levelsA) + len(levelsB) - len(longer)
+	return len(longer) == shorterLength+1 && longer[shorterLength] == "#"
+}
+
+func readACLFile(filename string) ([]ACLRule, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rules := make([]ACLRule, 0)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseACLRule(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("error: line %v of %v: %w", lineNumber, filename, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func parseACLRule(fields []string) (ACLRule, error) {
+	rule := ACLRule{}
+	if len(fields) != 3 && len(fields) != 5 {
+		return rule, fmt.Errorf("expected 3 or 5 fields but got %v", len(fields))
+	}
+
+	switch fields[0] {
+	case "allow":
+		rule.Allow = true
+	case "deny":
+		rule.Allow = false
+	default:
+		return rule, fmt.Errorf("expected allow or deny but got '%v'", fields[0])
+	}
+
+	switch fields[1] {
+	case "publish":
+		rule.Access = AccessPublish
+	case "subscribe":
+		rule.Access = AccessSubscribe
+	case "all":
+		rule.Access = AccessAll
+	default:
+		return rule, fmt.Errorf("expected publish, subscribe or all but got '%v'", fields[1])
+	}
+	rule.TopicFilter = fields[2]
+
+	if len(fields) == 5 {
+		switch fields[3] {
+		case "user":
+			rule.Username = fields[4]
+		case "client":
+			rule.ClientID = fields[4]
+		default:
+			return rule, fmt.Errorf("expected user or client but got '%v'", fields[3])
+		}
+	}
+	return rule, nil
+}
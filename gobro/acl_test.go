@@ -0,0 +1,177 @@
+package gobro_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"MQTT-GO/gobro"
+	"MQTT-GO/packets"
+)
+
+func TestACLRules(t *testing.T) {
+	acl := gobro.NewACL([]gobro.ACLRule{
+		{Allow: false, Access: gobro.AccessAll, TopicFilter: "users/admin/#"},
+		{Allow: true, Access: gobro.AccessAll, TopicFilter: "users/%u/#"},
+		{Allow: true, Access: gobro.AccessSubscribe, TopicFilter: "devices/%c/+"},
+		{Allow: true, Access: gobro.AccessPublish, TopicFilter: "#", ClientID: "root"},
+	})
+
+	tests := []struct {
+		name      string
+		publish   bool
+		clientID  string
+		username  string
+		topic     string
+		isAllowed bool
+	}{
+		{"own user topic", true, "c1", "alice", "users/alice/status", true},
+		{"other user topic", true, "c1", "alice", "users/bob/status", false},
+		{"no username", true, "c1", "", "users//status", false},
+		{"subscribe covered by rule", false, "c1", "alice", "users/alice/+", true},
+		{"subscribe wider than rule", false, "c1", "alice", "users/+/status", false},
+		{"deny rule overlaps wildcard", false, "c1", "admin", "users/admin/#", false},
+		{"client substitution", false, "lamp", "", "devices/lamp/state", true},
+		{"client substitution mismatch", false, "lamp", "", "devices/fan/state", false},
+		{"publish only rule", false, "root", "", "anything", false},
+		{"rule for one client", true, "root", "", "anything", true},
+		{"rule for another client", true, "c1", "", "anything", false},
+		{"client ID wildcard subscribe", false, "+", "", "devices/+/+", false},
+		{"client ID wildcard publish", true, "+", "", "devices/lamp/state", false},
+		{"client ID multi-level wildcard", false, "#", "", "devices/#", false},
+		{"client ID with levels", false, "lamp/state", "", "devices/lamp/state/x", false},
+		{"username wildcard", true, "c1", "+", "users/bob/status", false},
+		{"username multi-level wildcard", false, "c1", "#", "users/#", false},
+		{"username with levels", true, "c1", "bob/status", "users/bob/status/x", false},
+	}
+	for _, test := range tests {
+		var allowed bool
+		if test.publish {
+			allowed = acl.CanPublish(test.clientID, test.username, test.topic)
+		} else {
+			allowed = acl.CanSubscribe(test.clientID, test.username, test.topic)
+		}
+		if allowed != test.isAllowed {
+			t.Errorf("%v: expected %v, got %v", test.name, test.isAllowed, allowed)
+		}
+	}
+}
+
+func TestACLFileReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "acl")
+	testErr(t, os.WriteFile(filename, []byte("# sensors\nallow all sensors/# user bob\n"), 0600))
+
+	acl, err := gobro.LoadACLFile(filename)
+	testErr(t, err)
+	if !acl.CanPublish("id", "bob", "sensors/temp") || acl.CanPublish("id", "eve", "sensors/temp") {
+		t.Error("Rules from the file weren't applied")
+	}
+
+	testErr(t, os.WriteFile(filename, []byte("allow everything\n"), 0600))
+	if err := acl.Reload(); err == nil {
+		t.Error("Malformed file was accepted")
+	}
+	// The rules from the last good read are kept
+	if !acl.CanPublish("id", "bob", "sensors/temp") {
+		t.Error("Rules were lost after a failed reload")
+	}
+
+	testErr(t, os.WriteFile(filename, []byte("allow publish sensors/# user eve\n"), 0600))
+	testErr(t, acl.Reload())
+	if acl.CanPublish("id", "bob", "sensors/temp") || !acl.CanPublish("id", "eve", "sensors/temp") {
+		t.Error("Reloaded rules weren't applied")
+	}
+}
+
+func TestACLIsEnforced(t *testing.T) {
+	opts := tcpOptions(8012)
+	opts.Authorizer = gobro.NewACL([]gobro.ACLRule{
+		{Allow: true, Access: gobro.AccessAll, TopicFilter: "public/#"},
+		{Allow: true, Access: gobro.AccessSubscribe, TopicFilter: "#", ClientID: "admin"},
+	})
+	startServer(t, opts)
+
+	admin, adminReader := connectRawClient(t, "admin", 8012)
+	defer admin.Close()
+	subscribe, _ := packets.EncodeSubscribe(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.SUBSCRIBE, Flags: 2},
+		&packets.SubscribeVariableHeader{PacketIdentifier: 1},
+		&packets.PacketPayload{RawApplicationMessage: []byte{
+			0, 9, 'p', 'r', 'i', 'v', 'a', 't', 'e', '/', 'x', 0,
+			0, 8, 'p', 'u', 'b', 'l', 'i', 'c', '/', 'x', 0,
+		}},
+	))
+	_, err := admin.Write(subscribe)
+	testErr(t, err)
+	readPacketOfType(t, adminReader, packets.SUBACK)
+
+	sensor, sensorReader := connectRawClient(t, "sensor", 8012)
+	defer sensor.Close()
+	subscribe, _ = packets.EncodeSubscribe(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.SUBSCRIBE, Flags: 2},
+		&packets.SubscribeVariableHeader{PacketIdentifier: 1},
+		&packets.PacketPayload{RawApplicationMessage: []byte{
+			0, 8, 'p', 'u', 'b', 'l', 'i', 'c', '/', 'y', 1,
+			0, 1, '#', 0,
+		}},
+	))
+	_, err = sensor.Write(subscribe)
+	testErr(t, err)
+	suback := readPacketOfType(t, sensorReader, packets.SUBACK)
+	if !bytes.Equal(suback.Payload.RawApplicationMessage, []byte{1, packets.SubackFailure}) {
+		t.Error("Expected return codes [1 128], got", suback.Payload.RawApplicationMessage)
+	}
+
+	// The unauthorized publish is acknowledged but not delivered
+	for i, topic := range []string{"private/x", "public/x"} {
+		publish, err := packets.CreatePublish(topic, i+1, packets.CreatePublishFlags(1, false, false), []byte("hello"))
+		testErr(t, err)
+		_, err = sensor.Write(publish)
+		testErr(t, err)
+		readPacketOfType(t, sensorReader, packets.PUBACK)
+	}
+	publish := readPacketOfType(t, adminReader, packets.PUBLISH)
+	if topic := publish.VariableLengthHeader.(*packets.PublishVariableHeader).TopicFilter; topic != "public/x" {
+		t.Error("Expected the publish to public/x, got", topic)
+	}
+}
+
+func TestRevokedAccessStopsDelivery(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "acl")
+	testErr(t, os.WriteFile(filename, []byte("allow all tenant/#\n"), 0600))
+	acl, err := gobro.LoadACLFile(filename)
+	testErr(t, err)
+	opts := tcpOptions(8040)
+	opts.Authorizer = acl
+	startServer(t, opts)
+
+	reader, readerReader := connectRawClient(t, "reader", 8040)
+	defer reader.Close()
+	subscribe, _ := packets.EncodeSubscribe(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.SUBSCRIBE, Flags: 2},
+		&packets.SubscribeVariableHeader{PacketIdentifier: 1},
+		&packets.PacketPayload{RawApplicationMessage: []byte{0, 8, 't', 'e', 'n', 'a', 'n', 't', '/', '#', 0}},
+	))
+	_, err = reader.Write(subscribe)
+	testErr(t, err)
+	readPacketOfType(t, readerReader, packets.SUBACK)
+
+	// The reader keeps its subscription, but can only read the public topic after the reload
+	testErr(t, os.WriteFile(filename, []byte("allow publish tenant/#\nallow subscribe tenant/public\n"), 0600))
+	testErr(t, acl.Reload())
+
+	writer, writerReader := connectRawClient(t, "writer", 8040)
+	defer writer.Close()
+	for i, topic := range []string{"tenant/private", "tenant/public"} {
+		publish, err := packets.CreatePublish(topic, i+1, packets.CreatePublishFlags(1, false, false), []byte("hello"))
+		testErr(t, err)
+		_, err = writer.Write(publish)
+		testErr(t, err)
+		readPacketOfType(t, writerReader, packets.PUBACK)
+	}
+	publish := readPacketOfType(t, readerReader, packets.PUBLISH)
+	if topic := publish.VariableLengthHeader.(*packets.PublishVariableHeader).TopicFilter; topic != "tenant/public" {
+		t.Error("Expected the publish to tenant/public, got", topic)
+	}
+}
@@ -0,0 +1,108 @@
+package gobro
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"sync"
+
+	"MQTT-GO/packets"
+)
+
+var (
+	// ErrBadUsernameOrPassword is returned by an Authenticator when the credentials are wrong.
+	// The client is sent a CONNACK with return code 4.
+	ErrBadUsernameOrPassword = errors.New("error: bad username or password")
+	// ErrNotAuthorized is returned by an Authenticator when the client isn't allowed to connect,
+	// for example because it didn't send any credentials. The client is sent a CONNACK with return code 5.
+	ErrNotAuthorized = errors.New("error: not authorized")
+)
+
+// Authenticator decides whether a client is allowed to connect with the credentials in its CONNECT.
+// It returns nil to accept the client. Returning ErrBadUsernameOrPassword refuses the client with
+// CONNACK return code 4, and any other error refuses the client with return code 5.
+// The password is nil if the client didn't send one.
+type Authenticator interface {
+	Authenticate(clientID string, username string, password []byte) error
+}
+
+// authenticate checks a CONNECT with the server's Authenticator and returns the CONNACK return code
+func (server *Server) authenticate(connect *packets.Packet) byte {
+	varHeader := connect.VariableLengthHeader.(*packets.ConnectVariableHeader)
+	payload := connect.Payload
+
+	var password []byte
+	if payload.Password != nil {
+		password = *payload.Password
+	}
+	// A password can't be sent without a username
+	if varHeader.ConnectFlags&packets.UsernameFlag == 0 && varHeader.ConnectFlags&packets.PasswordFlag != 0 {
+		return packets.ConnackBadUsernameOrPassword
+	}
+
+	err := server.options.Authenticator.Authenticate(payload.ClientID, payload.Username, password)
+	switch {
+	case err == nil:
+		return packets.ConnackAccepted
+	case errors.Is(err, ErrBadUsernameOrPassword):
+		log.Printf("- Client '%v' sent a bad username or password for user '%v'\n", payload.ClientID, payload.Username)
+		return packets.ConnackBadUsernameOrPassword
+	default:
+		log.Printf("- Client '%v' isn't authorized to connect as '%v': %v\n", payload.ClientID, payload.Username, err)
+		return packets.ConnackNotAuthorized
+	}
+}
+
+// authenticateHook returns the hook that checks clients' credentials,
+// or nil if the server doesn't have an Authenticator
+func (server *Server) authenticateHook() func(connect *packets.Packet) byte {
+	if server.options.Authenticator == nil {
+		return nil
+	}
+	return server.authenticate
+}
+
+// MemoryAuthenticator is an Authenticator that checks credentials against a map of
+// usernames to passwords held in memory. Users can be added and removed while the server is running.
+type MemoryAuthenticator struct {
+	lock  sync.RWMutex
+	users map[string][]byte
+}
+
+// NewMemoryAuthenticator creates a MemoryAuthenticator from a map of usernames to passwords
+func NewMemoryAuthenticator(users map[string]string) *MemoryAuthenticator {
+	authenticator := &MemoryAuthenticator{users: make(map[string][]byte, len(users))}
+	for username, password := range users {
+		authenticator.users[username] = []byte(password)
+	}
+	return authenticator
+}
+
+// AddUser adds a user, replacing their password if they already exist
+func (authenticator *MemoryAuthenticator) AddUser(username string, password string) {
+	authenticator.lock.Lock()
+	defer authenticator.lock.Unlock()
+	authenticator.users[username] = []byte(password)
+}
+
+// RemoveUser removes a user, so they can no longer connect
+func (authenticator *MemoryAuthenticator) RemoveUser(username string) {
+	authenticator.lock.Lock()
+	defer authenticator.lock.Unlock()
+	delete(authenticator.users, username)
+}
+
+// Authenticate implements the Authenticator interface
+func (authenticator *MemoryAuthenticator) Authenticate(_ string, username string, password []byte) error {
+	if username == "" {
+		return ErrNotAuthorized
+	}
+	authenticator.lock.RLock()
+	expected, found := authenticator.users[username]
+	authenticator.lock.RUnlock()
+
+	if !found || subtle.ConstantTimeCompare(expected, password) != 1 {
+		return ErrBadUsernameOrPassword
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package gobro_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"MQTT-GO/client"
+	"MQTT-GO/gobro"
+)
+
+func TestMemoryAuthenticator(t *testing.T) {
+	authenticator := gobro.NewMemoryAuthenticator(map[string]string{"alice": "secret"})
+
+	if err := authenticator.Authenticate("id", "alice", []byte("secret")); err != nil {
+		t.Error("Correct credentials were refused:", err)
+	}
+	if err := authenticator.Authenticate("id", "alice", []byte("wrong")); !errors.Is(err, gobro.ErrBadUsernameOrPassword) {
+		t.Error("Wrong password wasn't refused:", err)
+	}
+	if err := authenticator.Authenticate("id", "", nil); !errors.Is(err, gobro.ErrNotAuthorized) {
+		t.Error("Anonymous client wasn't refused:", err)
+	}
+
+	authenticator.RemoveUser("alice")
+	if err := authenticator.Authenticate("id", "alice", []byte("secret")); err == nil {
+		t.Error("Removed user was accepted")
+	}
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	testErr(t, err)
+	filename := filepath.Join(t.TempDir(), "passwords")
+	testErr(t, os.WriteFile(filename, []byte("# sensors\nbob:"+string(hash)+"\n"), 0600))
+
+	authenticator, err := gobro.NewHtpasswdAuthenticator(filename)
+	testErr(t, err)
+	if err := authenticator.Authenticate("id", "bob", []byte("hunter2")); err != nil {
+		t.Error("Correct credentials were refused:", err)
+	}
+	if err := authenticator.Authenticate("id", "bob", []byte("hunter3")); !errors.Is(err, gobro.ErrBadUsernameOrPassword) {
+		t.Error("Wrong password wasn't refused:", err)
+	}
+
+	testErr(t, os.WriteFile(filename, []byte("bob:not-a-hash\n"), 0600))
+	if err := authenticator.Reload(); err == nil {
+		t.Error("Malformed file was accepted")
+	}
+	// The users from the last good read are kept
+	if err := authenticator.Authenticate("id", "bob", []byte("hunter2")); err != nil {
+		t.Error("Users were lost after a failed reload:", err)
+	}
+}
+
+func TestConnectionsAreAuthenticated(t *testing.T) {
+	opts := tcpOptions(8011)
+	opts.Authenticator = gobro.NewMemoryAuthenticator(map[string]string{"alice": "secret"})
+	startServer(t, opts)
+
+	connect := func(username string, password []byte) error {
+		newClient := client.CreateClient()
+		newClient.Username = username
+		newClient.Password = password
+		testErr(t, newClient.SetClientConnection("localhost", 8011))
+		return newClient.SendConnect("localhost", 8011)
+	}
+
+	if err := connect("alice", []byte("secret")); err != nil {
+		t.Error("Correct credentials were refused:", err)
+	}
+	if err := connect("alice", []byte("wrong")); err == nil || err.Error() != "error: broker refused the connection with return code 4" {
+		t.Error("Expected return code 4, got", err)
+	}
+	if err := connect("", nil); err == nil || err.Error() != "error: broker refused the connection with return code 5" {
+		t.Error("Expected return code 5, got", err)
+	}
+}
@@ -0,0 +1,309 @@
+package gobro
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"MQTT-GO/client"
+	"MQTT-GO/gobro/clients"
+	"MQTT-GO/packets"
+	"MQTT-GO/structures"
+)
+
+const (
+	// DefaultBridgeReconnectDelay is the ReconnectDelay used if a BridgeConfig doesn't set one
+	DefaultBridgeReconnectDelay = time.Second
+	// DefaultBridgeMaxReconnectDelay is the MaxReconnectDelay used if a BridgeConfig doesn't set one
+	DefaultBridgeMaxReconnectDelay = time.Minute
+	// bridgeQueueLength is how many messages can wait for a bridge to send them before publishing
+	// to one of its topics blocks
+	bridgeQueueLength = 1000
+)
+
+// BridgeDirection is which way a bridge forwards the messages of a topic
+type BridgeDirection byte
+
+const (
+	// BridgeOut forwards messages published to the local broker to the remote broker
+	BridgeOut BridgeDirection = iota + 1
+	// BridgeIn forwards messages published to the remote broker to the local broker
+	BridgeIn
+	// BridgeBoth forwards messages in both directions
+	BridgeBoth
+)
+
+// BridgeTopic is a topic a bridge forwards, in the same form as Mosquitto's bridge topics.
+// The local topic filter is LocalPrefix + Pattern, and the remote one is RemotePrefix + Pattern.
+// For example, the Pattern "#" with the LocalPrefix "site1/" and RemotePrefix "fleet/site1/"
+// forwards site1/temperature to fleet/site1/temperature.
+type BridgeTopic struct {
+	Pattern      string
+	Direction    BridgeDirection
+	LocalPrefix  string
+	RemotePrefix string
+	// Qos is the highest QoS messages are forwarded with
+	Qos byte
+}
+
+// BridgeConfig configures a bridge from the server to a remote broker. The bridge connects to
+// the remote broker as a client with a persistent session, and reconnects with an exponential
+// backoff whenever the connection is lost. Messages for the remote broker are queued while the
+// bridge is disconnected, and messages it hadn't acknowledged are sent again after reconnecting.
+type BridgeConfig struct {
+	// Name is the client ID the bridge connects to the remote broker with
+	Name string
+	// Transport is the transport protocol the bridge connects with, e.g. network.TCP or network.QUIC
+	Transport byte
+	IP        string
+	Port      int
+	Username  string
+	Password  []byte
+	// TLSConfig is used if the Transport is TLS
+	TLSConfig *tls.Config
+	Topics    []BridgeTopic
+	// ReconnectDelay is how long the bridge waits before reconnecting the first time.
+	// The delay doubles every time reconnecting fails, up to the MaxReconnectDelay.
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+	// MaxQueuedMessages limits the messages queued for the remote broker while the bridge is disconnected.
+	// Zero or less is no limit.
+	MaxQueuedMessages int
+	// QueueStore saves the queued messages, so that they survive the server restarting. It is closed
+	// when the server shuts down.
+	QueueStore client.QueueStore
+}
+
+// withDefaults returns the config with defaults for the settings that weren't set
+func (config BridgeConfig) withDefaults() BridgeConfig {
+	if config.ReconnectDelay <= 0 {
+		config.ReconnectDelay = DefaultBridgeReconnectDelay
+	}
+	if config.MaxReconnectDelay < config.ReconnectDelay {
+		config.MaxReconnectDelay = structures.Max(DefaultBridgeMaxReconnectDelay, config.ReconnectDelay)
+	}
+	return config
+}
+
+// bridgeMessage is a message waiting to be forwarded to the remote broker
+type bridgeMessage struct {
+	topicName          string
+	qos                byte
+	retain             bool
+	applicationMessage []byte
+}
+
+// bridge forwards messages between the server and a remote broker
+type bridge struct {
+	config BridgeConfig
+	server *Server
+	// localID is the client the bridge publishes to the local broker as
+	localID clients.ClientID
+	// remote is the client connected to the remote broker, which reconnects by itself once it
+	// has connected, and queues the messages for the remote broker while it is disconnected
+	remote *client.Client
+	// outgoing holds the messages for the remote broker until they are passed to the remote client
+	outgoing chan bridgeMessage
+}
+
+// newBridge creates a bridge, loading any messages that were queued in its QueueStore
+func newBridge(server *Server, config BridgeConfig) (*bridge, error) {
+	config = config.withDefaults()
+	bridge := &bridge{
+		config:   config,
+		server:   server,
+		localID:  clients.ClientID("$bridge/" + config.Name),
+		outgoing: make(chan bridgeMessage, bridgeQueueLength),
+	}
+
+	queue, err := client.CreateOutboundQueue(config.MaxQueuedMessages, 0, config.QueueStore)
+	if err != nil {
+		return nil, fmt.Errorf("error: bridge '%v' couldn't load its queue: %w", config.Name, err)
+	}
+	remote := client.CreateClient()
+	remote.ClientID = config.Name
+	remote.Transport = config.Transport
+	remote.Username = config.Username
+	remote.Password = config.Password
+	remote.TLSConfig = config.TLSConfig
+	remote.Bridge = true
+	// The remote broker keeps our subscriptions and the messages we haven't acknowledged while we reconnect
+	remote.CleanSession = false
+	remote.Queue = queue
+	remote.AutoReconnect = true
+	remote.ReconnectDelay = config.ReconnectDelay
+	remote.MaxReconnectDelay = config.MaxReconnectDelay
+	remote.OnConnectionLost = func(err error) {
+		log.Printf("- Bridge '%v' lost its connection, reconnecting: %v\n", config.Name, err)
+	}
+	remote.OnReconnect = func() {
+		log.Printf("+ Bridge '%v' reconnected to %v:%v\n", config.Name, config.IP, config.Port)
+	}
+	for _, topic := range config.Topics {
+		if topic.Direction == BridgeIn || topic.Direction == BridgeBoth {
+			remote.OnMessage(topic.RemotePrefix+topic.Pattern, bridge.publishLocally(topic))
+		}
+	}
+	bridge.remote = remote
+	return bridge, nil
+}
+
+// run connects the bridge to the remote broker, and sends it the outgoing messages until the server has halted
+func (bridge *bridge) run() {
+	stoppedSending := make(chan struct{})
+	go bridge.send(stoppedSending)
+	defer func() {
+		<-stoppedSending
+		if bridge.config.QueueStore != nil {
+			if err := bridge.config.QueueStore.Close(); err != nil {
+				log.Printf("- Error while closing the queue store of bridge '%v': %v\n", bridge.config.Name, err)
+			}
+		}
+	}()
+
+	delay := bridge.config.ReconnectDelay
+	for {
+		err := bridge.connect()
+		if err == nil {
+			break
+		}
+		log.Printf("- Bridge '%v' couldn't connect, retrying in %v: %v\n", bridge.config.Name, delay, err)
+		select {
+		case <-bridge.server.halted:
+			return
+		case <-time.After(delay):
+		}
+		delay = structures.Min(delay*2, bridge.config.MaxReconnectDelay)
+	}
+	log.Printf("+ Bridge '%v' connected to %v:%v\n", bridge.config.Name, bridge.config.IP, bridge.config.Port)
+
+	<-bridge.server.halted
+	if err := bridge.remote.Disconnect(); err != nil {
+		log.Printf("- Error while disconnecting bridge '%v': %v\n", bridge.config.Name, err)
+	}
+}
+
+// connect connects to the remote broker and subscribes to the topics forwarded from it.
+// Once it has connected, the remote client reconnects and subscribes again by itself.
+func (bridge *bridge) connect() error {
+	if err := bridge.remote.Connect(bridge.config.IP, bridge.config.Port); err != nil {
+		return err
+	}
+	subscriptions := make([]packets.TopicWithQoS, 0, len(bridge.config.Topics))
+	for _, topic := range bridge.config.Topics {
+		if topic.Direction == BridgeIn || topic.Direction == BridgeBoth {
+			subscriptions = append(subscriptions, packets.TopicWithQoS{Topic: topic.RemotePrefix + topic.Pattern, QoS: topic.Qos})
+		}
+	}
+	if len(subscriptions) > 0 {
+		if err := bridge.remote.SendSubscribe(subscriptions...); err != nil {
+			_ = bridge.remote.Disconnect()
+			return fmt.Errorf("error: couldn't subscribe to the remote broker: %w", err)
+		}
+	}
+	return nil
+}
+
+// send passes the outgoing messages to the remote client until the server has halted. The remote
+// client queues them while it is disconnected, so a message is only lost if its queue is full.
+func (bridge *bridge) send(stopped chan<- struct{}) {
+	defer close(stopped)
+	for {
+		select {
+		case <-bridge.server.halted:
+			return
+		case message := <-bridge.outgoing:
+			var err error
+			if message.retain {
+				err = bridge.remote.SendRetainedPublish(message.applicationMessage, message.topicName, message.qos)
+			} else {
+				err = bridge.remote.SendPublishWithQoS(message.applicationMessage, message.topicName, message.qos)
+			}
+			if err != nil {
+				log.Printf("- Bridge '%v' couldn't forward a message to '%v': %v\n",
+					bridge.config.Name, message.topicName, err)
+			}
+		}
+	}
+}
+
+// forward queues a message published to the local broker for the remote broker, if it
+// matches one of the bridge's outgoing topics. Messages the bridge published itself aren't
+// forwarded, so that they don't loop back to the remote broker. If the bridge is behind,
+// forward waits for it rather than dropping the message.
+func (bridge *bridge) forward(publisher clients.ClientID, topicName string, qos byte, retain bool,
+	applicationMessage []byte) {
+	if publisher == bridge.localID {
+		return
+	}
+	for _, topic := range bridge.config.Topics {
+		if topic.Direction != BridgeOut && topic.Direction != BridgeBoth {
+			continue
+		}
+		if !packets.TopicMatchesFilter(topic.LocalPrefix+topic.Pattern, topicName) {
+			continue
+		}
+		message := bridgeMessage{
+			topicName:          topic.RemotePrefix + strings.TrimPrefix(topicName, topic.LocalPrefix),
+			qos:                structures.Min(qos, topic.Qos),
+			retain:             retain,
+			applicationMessage: applicationMessage,
+		}
+		select {
+		case bridge.outgoing <- message:
+		case <-bridge.server.halted:
+			log.Printf("- Bridge '%v' dropped a message to '%v', the server has stopped\n", bridge.config.Name, topicName)
+		}
+		return
+	}
+}
+
+// publishLocally returns a handler that publishes the messages from the remote broker
+// matching one of the bridge's incoming topics to the local broker
+func (bridge *bridge) publishLocally(topic BridgeTopic) client.MessageHandler {
+	return func(topicName string, payload []byte, qos byte, retained bool) {
+		localTopic := topic.LocalPrefix + strings.TrimPrefix(topicName, topic.RemotePrefix)
+		qos = structures.Min(qos, topic.Qos)
+		if retained {
+			bridge.server.storeRetained(localTopic, qos, payload)
+		}
+		bridge.server.publishAs(bridge.localID, localTopic, qos, retained, payload)
+	}
+}
+
+// forwardToBridges passes a message published to the server to every bridge
+func (server *Server) forwardToBridges(publisher clients.ClientID, topicName string, qos byte, retain bool,
+	applicationMessage []byte) {
+	for _, remoteBridge := range server.bridges {
+		remoteBridge.forward(publisher, topicName, qos, retain, applicationMessage)
+	}
+}
+
+// startBridges starts connecting every bridge to its remote broker
+func (server *Server) startBridges() {
+	for _, remoteBridge := range server.bridges {
+		server.bridging.Add(1)
+		go func(remoteBridge *bridge) {
+			defer server.bridging.Done()
+			remoteBridge.run()
+		}(remoteBridge)
+	}
+}
+
+// validateBridges checks that the bridges' configs can be used
+func validateBridges(configs []BridgeConfig) error {
+	for _, config := range configs {
+		if config.Name == "" {
+			return errors.New("error: bridges need a name")
+		}
+		for _, topic := range config.Topics {
+			if topic.Direction < BridgeOut || topic.Direction > BridgeBoth {
+				return fmt.Errorf("error: bridge '%v' has a topic with an invalid direction", config.Name)
+			}
+		}
+	}
+	return nil
+}
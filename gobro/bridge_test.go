@@ -0,0 +1,182 @@
+package gobro_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"MQTT-GO/gobro"
+	"MQTT-GO/network"
+	"MQTT-GO/packets"
+)
+
+func TestBridgeForwardsBetweenBrokers(t *testing.T) {
+	central := gobro.NewServer(tcpOptions(8034))
+	testErr(t, central.Start(context.Background()))
+
+	siteOpts := tcpOptions(8033)
+	siteOpts.Bridges = []gobro.BridgeConfig{{
+		Name: "site1",
+		IP:   "localhost",
+		Port: 8034,
+		Topics: []gobro.BridgeTopic{
+			{Pattern: "#", Direction: gobro.BridgeOut, LocalPrefix: "site1/", RemotePrefix: "fleet/site1/", Qos: 1},
+			{Pattern: "#", Direction: gobro.BridgeIn, LocalPrefix: "commands/", RemotePrefix: "fleet/commands/site1/"},
+			{Pattern: "shared/#", Direction: gobro.BridgeBoth},
+		},
+		ReconnectDelay: 50 * time.Millisecond,
+	}}
+	startServer(t, siteOpts)
+
+	fleet, fleetReader := connectRawClient(t, "fleet", 8034)
+	subscribeTo(t, fleet, fleetReader, "fleet/#")
+	subscribeTo(t, fleet, fleetReader, "shared/#")
+	siteSubscriber, siteReader := connectRawClient(t, "site-subscriber", 8033)
+	defer siteSubscriber.Close()
+	subscribeTo(t, siteSubscriber, siteReader, "commands/#")
+	subscribeTo(t, siteSubscriber, siteReader, "shared/#")
+	sitePublisher, _ := connectRawClient(t, "site-publisher", 8033)
+	defer sitePublisher.Close()
+
+	// Local topics are remapped onto the remote broker, once the bridge has connected
+	publish := publishUntilReceived(t, sitePublisher, "site1/temperature", fleet, fleetReader)
+	if topic := publish.VariableLengthHeader.(*packets.PublishVariableHeader).TopicFilter; topic != "fleet/site1/temperature" {
+		t.Error("Message was forwarded to", topic)
+	}
+
+	// Remote topics are remapped onto the local broker
+	command, err := packets.CreatePublish("fleet/commands/site1/reboot", 0, 0, []byte("now"))
+	testErr(t, err)
+	_, err = fleet.Write(command)
+	testErr(t, err)
+	publish = readPacketOfType(t, siteReader, packets.PUBLISH)
+	if topic := publish.VariableLengthHeader.(*packets.PublishVariableHeader).TopicFilter; topic != "commands/reboot" {
+		t.Error("Message was forwarded to", topic)
+	}
+
+	// Topics bridged in both directions don't loop back to where they were published
+	shared, err := packets.CreatePublish("shared/status", 0, 0, []byte("up"))
+	testErr(t, err)
+	_, err = sitePublisher.Write(shared)
+	testErr(t, err)
+	readPacketOfType(t, siteReader, packets.PUBLISH)
+	readPacketOfType(t, fleetReader, packets.PUBLISH)
+	_, err = fleet.Write(shared)
+	testErr(t, err)
+	readPacketOfType(t, siteReader, packets.PUBLISH)
+	readPacketOfType(t, fleetReader, packets.PUBLISH)
+	for _, connection := range []network.Conn{siteSubscriber, fleet} {
+		testErr(t, connection.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	}
+	for _, reader := range []*bufio.Reader{siteReader, fleetReader} {
+		if _, err := packets.ReadPacketFromConnection(reader); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Error("A bridged message looped back", err)
+		}
+	}
+
+	// The bridge reconnects once the remote broker is back
+	fleet.Close()
+	testErr(t, central.Shutdown(context.Background()))
+	central = gobro.NewServer(tcpOptions(8034))
+	testErr(t, central.Start(context.Background()))
+	defer central.Shutdown(context.Background())
+	fleet, fleetReader = connectRawClient(t, "fleet", 8034)
+	defer fleet.Close()
+	subscribeTo(t, fleet, fleetReader, "fleet/#")
+	publishUntilReceived(t, sitePublisher, "site1/humidity", fleet, fleetReader)
+}
+
+func TestBridgeKeepsMessagesWhileTheRemoteBrokerIsDown(t *testing.T) {
+	central := gobro.NewServer(tcpOptions(8041))
+	testErr(t, central.Start(context.Background()))
+
+	siteOpts := tcpOptions(8042)
+	siteOpts.Bridges = []gobro.BridgeConfig{{
+		Name: "site2",
+		IP:   "localhost",
+		Port: 8041,
+		Topics: []gobro.BridgeTopic{
+			{Pattern: "#", Direction: gobro.BridgeOut, LocalPrefix: "site2/", RemotePrefix: "fleet/site2/", Qos: 1},
+		},
+		ReconnectDelay: 50 * time.Millisecond,
+	}}
+	startServer(t, siteOpts)
+
+	fleet, fleetReader := connectRawClient(t, "fleet", 8041)
+	subscribeTo(t, fleet, fleetReader, "fleet/#")
+	sitePublisher, sitePublisherReader := connectRawClient(t, "site-publisher", 8042)
+	defer sitePublisher.Close()
+	publishUntilReceived(t, sitePublisher, "site2/ready", fleet, fleetReader)
+	fleet.Close()
+	testErr(t, central.Shutdown(context.Background()))
+
+	// Messages published while the remote broker is down are forwarded once it is back, still retained
+	readings := map[string]bool{"fleet/site2/a": true, "fleet/site2/b": true, "fleet/site2/c": true}
+	for i, topic := range []string{"site2/a", "site2/b", "site2/c"} {
+		publish, err := packets.CreatePublish(topic, i+1, packets.CreatePublishFlags(1, false, true), []byte("reading"))
+		testErr(t, err)
+		_, err = sitePublisher.Write(publish)
+		testErr(t, err)
+		readPacketOfType(t, sitePublisherReader, packets.PUBACK)
+	}
+	central = gobro.NewServer(tcpOptions(8041))
+	testErr(t, central.Start(context.Background()))
+	defer central.Shutdown(context.Background())
+
+	for attempt := 0; attempt < 50; attempt++ {
+		received := map[string]bool{}
+		subscriber, reader := connectRawClient(t, "late-subscriber", 8041)
+		subscribeTo(t, subscriber, reader, "fleet/site2/+")
+		testErr(t, subscriber.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		for {
+			packetArr, err := packets.ReadPacketFromConnection(reader)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			testErr(t, err)
+			packet, _, err := packets.DecodePacket(packetArr)
+			testErr(t, err)
+			if packet.ControlHeader.Flags&packets.RetainFlag != 0 {
+				received[packet.VariableLengthHeader.(*packets.PublishVariableHeader).TopicFilter] = true
+			}
+		}
+		subscriber.Close()
+		if len(received) == len(readings) {
+			for topic := range readings {
+				if !received[topic] {
+					t.Error("Retained message wasn't forwarded to", topic)
+				}
+			}
+			return
+		}
+	}
+	t.Fatal("The bridge didn't forward the retained messages")
+}
+
+// publishUntilReceived publishes to a topic until the subscriber receives a message,
+// which lets the bridge connect first
+func publishUntilReceived(t *testing.T, publisher network.Conn, topicName string, subscriber network.Conn,
+	subscriberReader *bufio.Reader) *packets.Packet {
+	t.Helper()
+	publish, err := packets.CreatePublish(topicName, 0, 0, []byte("bridged"))
+	testErr(t, err)
+	for attempt := 0; attempt < 50; attempt++ {
+		_, err = publisher.Write(publish)
+		testErr(t, err)
+		testErr(t, subscriber.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		packetArr, err := packets.ReadPacketFromConnection(subscriberReader)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		testErr(t, err)
+		testErr(t, subscriber.SetReadDeadline(time.Time{}))
+		packet, _, err := packets.DecodePacket(packetArr)
+		testErr(t, err)
+		return packet
+	}
+	t.Fatal("The bridge didn't forward the message to", topicName)
+	return nil
+}
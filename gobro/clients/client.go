@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"MQTT-GO/network"
 	"MQTT-GO/structures"
@@ -17,23 +18,101 @@ type ClientID string
 
 // Client is a struct that stores a client's ID, a list of topics they are subscribed to,
 // a connection to the client, and a ticket stand for sending messages in order.
+// It also stores the messages sent to the client that are waiting to be acknowledged,
+// and the identifiers of QoS 2 messages received from the client that haven't been released.
+// The client's will is stored until it is either published or discarded.
 type Client struct {
-	ClientIdentifier  ClientID
-	Topics            *structures.LinkedList[Topic]
-	NetworkConnection network.Conn
-	Tickets           *structures.TicketStand
+	ClientIdentifier ClientID
+	Topics           *structures.LinkedList[Topic]
+	Inflight         *structures.SafeMap[int, *InflightMessage]
+	AwaitingRelease  *structures.SafeMap[int, struct{}]
+
+	packetIDLock sync.Mutex
+	lastPacketID int
+	// lastSequence orders the client's inflight messages
+	lastSequence uint64
+
+	// sessionLock guards everything that changes when the client connects again,
+	// which is read through Connection, Settings and SessionPresent
+	sessionLock sync.Mutex
+	connected   bool
+	connection  network.Conn
+	tickets     *structures.TicketStand
+	settings    ConnectSettings
+	// sessionPresent is true if the client's current connection resumed an existing session
+	sessionPresent bool
+
+	willLock sync.Mutex
+	will     *Will
+	// willConnection is the connection whose CONNECT contained the will
+	willConnection network.Conn
+}
+
+// ConnectSettings are what a client asked for in its latest CONNECT
+type ConnectSettings struct {
+	// Username is the username the client connected with, if any
+	Username string
+	// KeepAlive is the longest time the client has said it will go without sending a packet.
+	// A KeepAlive of zero means the client will never be disconnected for being idle.
+	KeepAlive time.Duration
+	// CleanSession is false if the client's session should be kept after it disconnects
+	CleanSession bool
+	// Bridge is true if the client is a bridge from another broker. It isn't sent the messages it publishes.
+	Bridge bool
 }
 
 // CreateClient creates a new client with the given ID and connection
 func CreateClient(clientID ClientID, conn network.Conn) *Client {
 	client := Client{}
 	client.ClientIdentifier = clientID
-	client.NetworkConnection = conn
-	client.Tickets = structures.CreateTicketStand()
+	client.connection = conn
+	client.tickets = structures.CreateTicketStand()
+	client.Inflight = structures.CreateSafeMap[int, *InflightMessage]()
+	client.AwaitingRelease = structures.CreateSafeMap[int, struct{}]()
+	client.connected = conn != nil
 
 	return &client
 }
 
+const maxPacketID = 65535
+
+// NextPacketID returns a packet identifier that isn't being used by any of the
+// client's inflight messages. Identifiers go from 1 to 65535 and then wrap around.
+func (client *Client) NextPacketID() int {
+	client.packetIDLock.Lock()
+	defer client.packetIDLock.Unlock()
+
+	for i := 0; i < maxPacketID; i++ {
+		client.lastPacketID = client.lastPacketID%maxPacketID + 1
+		if !client.Inflight.Contains(client.lastPacketID) {
+			break
+		}
+	}
+	return client.lastPacketID
+}
+
+// SetWill stores the will the client sent in the CONNECT on the given connection
+func (client *Client) SetWill(connection network.Conn, will *Will) {
+	client.willLock.Lock()
+	defer client.willLock.Unlock()
+	client.will = will
+	client.willConnection = connection
+}
+
+// TakeWill removes and returns the will sent on the given connection, so that it can only be
+// published once. It returns nil if there is no will, it has already been taken, or the client
+// has since connected with a new connection.
+func (client *Client) TakeWill(connection network.Conn) *Will {
+	client.willLock.Lock()
+	defer client.willLock.Unlock()
+	if client.willConnection != connection {
+		return nil
+	}
+	will := client.will
+	client.will = nil
+	return will
+}
+
 // AddTopic adds a topic to the client's list of subscribed topics
 // If the client has not initialized a topic list, it will be initialized
 // If the client is already subscribed to the topic, it will not be added
@@ -43,9 +122,17 @@ func (client *Client) AddTopic(newTopic Topic) {
 		client.Topics = newLL
 	}
 
-	if !client.Topics.Contains(newTopic) {
-		client.Topics.Append(newTopic)
+	// Resubscribing to a topic replaces the previous subscription and its QoS
+	existing := client.Topics.FilterSingleItem(func(topic Topic) bool {
+		return topic.TopicFilter == newTopic.TopicFilter
+	})
+	if existing != nil {
+		if *existing == newTopic {
+			return
+		}
+		_ = client.Topics.Delete(*existing)
 	}
+	client.Topics.Append(newTopic)
 }
 
 // RemoveTopic removes a topic from the client's list of subscribed topics
@@ -55,23 +142,48 @@ func (client *Client) RemoveTopic(newTopic Topic) error {
 	if client.Topics == nil {
 		return errors.New("error: Client has not initialized a topic list")
 	}
-	return client.Topics.Delete(newTopic)
+	existing := client.Topics.FilterSingleItem(func(topic Topic) bool {
+		return topic.TopicFilter == newTopic.TopicFilter
+	})
+	if existing == nil {
+		return errors.New("error: Client is not subscribed to the topic")
+	}
+	return client.Topics.Delete(*existing)
 }
 
-// Disconnect removes the client from the client table and removes the client from
-// the topic to client map for each topic the client is subscribed to.
+// Disconnect disconnects the client from whichever connection it is currently using.
+// Clients with a clean session are removed from the client table and the topic trie,
+// otherwise their session is kept until they reconnect.
 func (client *Client) Disconnect(topicTrie *TopicTrie, clientTable *structures.SafeMap[ClientID, *Client]) {
 	if client == nil {
 		return
 	}
-	client.Tickets.CloseTicketStand()
-
-	// If the client has subscribed to something we need to remove that client
-	// from the topic to client lists for each topic
-	topicTrie.DeleteClientSubscriptions(client)
-	clientTable.Delete(client.ClientIdentifier)
-	client.Topics.DeleteLinkedList()
-	client.NetworkConnection.Close()
+	connection, _ := client.Connection()
+	client.DisconnectConnection(connection, topicTrie, clientTable)
+}
+
+// DisconnectConnection disconnects the client, but only if the given connection is still the
+// client's current connection. This stops an old connection from disconnecting a client
+// that has since reconnected.
+func (client *Client) DisconnectConnection(connection network.Conn, topicTrie *TopicTrie,
+	clientTable *structures.SafeMap[ClientID, *Client]) {
+	if client == nil {
+		return
+	}
+	client.sessionLock.Lock()
+	if !client.connected || client.connection != connection {
+		client.sessionLock.Unlock()
+		return
+	}
+	client.connected = false
+	client.tickets.CloseTicketStand()
+	cleanSession := client.settings.CleanSession
+	client.sessionLock.Unlock()
+
+	if cleanSession {
+		client.EndSession(topicTrie, clientTable)
+	}
+	connection.Close()
 }
 
 var (
@@ -87,25 +199,3 @@ func generateClientID() ClientID {
 
 	return ClientID(username)
 }
-
-var (
-	// VerboseOutput is a boolean that determines whether or not the server will print
-	// verbose output to the console
-	VerboseOutput = true
-)
-
-// ServerPrintln prints the given arguments to the console if VerboseOutput is true
-func ServerPrintln(args ...any) {
-	if VerboseOutput {
-		for _, arg := range args {
-			fmt.Println(arg, " ")
-		}
-	}
-}
-
-// ServerPrintf prints the given arguments to the console if VerboseOutput is true
-func ServerPrintf(format string, args ...any) {
-	if VerboseOutput {
-		fmt.Printf(format, args...)
-	}
-}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -16,12 +17,6 @@ import (
 	"MQTT-GO/structures"
 )
 
-var (
-	LogLatency              = false
-	ReceivingLatencyChannel = make(chan *network.LatencyStruct, 1000000)
-	SendingLatencyChannel   = make(chan *network.LatencyStruct, 1000000)
-)
-
 // ClientMessage is a struct that stores a client's ID, a connection to the client,
 // and the packet to handle.
 // This is used to pass information from the server to the message handler.
@@ -46,31 +41,23 @@ func CreateClientMessage(clientID ClientID, clientConnection network.Conn, packe
 // ClientHandler is a function that handles a client's connection.
 // It handles the initial connect, and then listens for all packets from that client,
 // and passes them to the message handler.
+// If the connection closes without the client sending a DISCONNECT, the client's will is published.
+// takeoverLock is held while a connection takes over a session in the client table, and is shared
+// by every handler of the same table.
 func ClientHandler(connection network.Conn, packetHandleChan chan<- ClientMessage,
-	clientTable *structures.SafeMap[ClientID, *Client], topicToClient *TopicTrie,
-	connectedClient *string, connectedClientMutex *sync.Mutex) {
-	newClient, err := handleInitialConnect(connection, clientTable, packetHandleChan)
+	clientTable *structures.SafeMap[ClientID, *Client], takeoverLock *sync.Mutex, topicToClient *TopicTrie,
+	connectedClient *string, connectedClientMutex *sync.Mutex, hooks Hooks) {
+	// The CONNECT is read with the same reader as the packets after it, which the client may have sent straight after it
+	reader := bufio.NewReader(connection)
+	newClient, err := handleInitialConnect(connection, reader, clientTable, takeoverLock, topicToClient, packetHandleChan, hooks)
 	if err != nil {
-		if newClient.NetworkConnection == nil {
+		if newConnection, _ := newClient.Connection(); newConnection == nil {
 			fmt.Println("Connection Closed before finishing connection")
 			newClient.Disconnect(topicToClient, clientTable)
 			return
 		}
-		log.Printf("- Error handling connect from %v: %v\n", newClient.NetworkConnection.RemoteAddr(), err)
-		structures.Printf("Error handling connect from %v: %v\n", newClient.NetworkConnection.RemoteAddr(), err)
-		if err.Error() == "error: Client already exists" {
-			connack := packets.CreateConnACK(false, 2)
-			_, err = connection.Write(connack)
-			if err != nil {
-				connection.Close()
-				fmt.Println("Error while writing", err)
-			} else {
-				// Sleep for 50 millisconds while they digest this news that they're
-				// being disconnected before closing the connection
-				time.Sleep(time.Millisecond * 50)
-				connection.Close()
-			}
-		}
+		log.Printf("- Error handling connect from %v: %v\n", connection.RemoteAddr(), err)
+		structures.Printf("Error handling connect from %v: %v\n", connection.RemoteAddr(), err)
 		connectedClientMutex.Lock()
 		*connectedClient = ""
 		connectedClientMutex.Unlock()
@@ -78,10 +65,14 @@ func ClientHandler(connection network.Conn, packetHandleChan chan<- ClientMessag
 	}
 
 	log.Printf("+ Client '%v' joined from  and global addr '%v'\n", newClient.ClientIdentifier, connection.RemoteAddr())
+	// The will is published after the client has been removed, as it has
+	// either been discarded by a DISCONNECT, or the client disconnected ungracefully
+	defer publishWill(newClient, connection, hooks)
 	// We wait 1 seconds to wait for everything else to catch up
-	defer handleDisconnect(*newClient, clientTable, topicToClient, connectedClient)
+	defer handleDisconnect(newClient, connection, clientTable, topicToClient, connectedClient)
 
 	clientID := newClient.ClientIdentifier
+	keepAlive := newClient.Settings().KeepAlive
 	connectedClientMutex.Lock()
 	(*connectedClient) = string(clientID)
 	connectedClientMutex.Unlock()
@@ -93,21 +84,32 @@ func ClientHandler(connection network.Conn, packetHandleChan chan<- ClientMessag
 		connectedClientMutex.Unlock()
 	}()
 
-	reader := bufio.NewReader(connection)
 	for {
+		if keepAlive > 0 {
+			// We give the client one and a half times its keep alive to send something
+			err := connection.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+			if err != nil {
+				log.Printf("- Error setting the read deadline of client '%v': %v\n", clientID, err)
+			}
+		}
 		packet, err := packets.ReadPacketFromConnection(reader)
 
-		if LogLatency {
+		if hooks.ReceivingLatencies != nil {
 			decodedPacket, packetType, err := packets.DecodePacket(packet)
 			if err == nil && packetType == packets.PUBLISH {
 				packetID := decodedPacket.VariableLengthHeader.(*packets.PublishVariableHeader).PacketIdentifier
-				ReceivingLatencyChannel <- &network.LatencyStruct{T: time.Now(), PacketID: packetID}
+				hooks.ReceivingLatencies <- &network.LatencyStruct{T: time.Now(), PacketID: packetID}
 			}
 		}
 
 		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 			break
 		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Printf("- Client '%v' exceeded its keep alive, disconnecting\n", clientID)
+			structures.Printf("Client '%v' exceeded its keep alive, disconnecting\n", clientID)
+			break
+		}
 		if err != nil {
 			if !strings.HasSuffix(err.Error(), "reset_stream") {
 				fmt.Println("Error while reading", err)
@@ -116,6 +118,11 @@ func ClientHandler(connection network.Conn, packetHandleChan chan<- ClientMessag
 			}
 			break
 		}
+		// This is checked here rather than in the message handler, so that
+		// we know about it before the connection closes
+		if packets.GetPacketType(packet) == packets.DISCONNECT {
+			newClient.TakeWill(connection)
+		}
 		toSend := ClientMessage{ClientID: &clientID, Packet: packet, ClientConnection: connection}
 		packetHandleChan <- toSend
 	}
@@ -123,20 +130,20 @@ func ClientHandler(connection network.Conn, packetHandleChan chan<- ClientMessag
 }
 
 // handleInitialConnect decodes the packet to find a ClientID - if none exists
-// we create one and then push the connect to be handled by message Handler
-func handleInitialConnect(connection network.Conn, clientTable *structures.SafeMap[ClientID, *Client],
-	packetPool chan<- ClientMessage) (*Client, error) {
-	firstPacket := make([]byte, 300)
-	packetLen, err := connection.Read(firstPacket)
-	firstPacket = firstPacket[:packetLen]
-
+// we create one and then push the connect to be handled by message Handler.
+// If the client has a session from a previous connection it is either resumed, or
+// discarded if the client asked for a clean session. If the client is already connected,
+// the new connection takes over from the old one.
+func handleInitialConnect(connection network.Conn, reader *bufio.Reader, clientTable *structures.SafeMap[ClientID, *Client],
+	takeoverLock *sync.Mutex, topicTrie *TopicTrie, packetPool chan<- ClientMessage, hooks Hooks) (*Client, error) {
+	firstPacket, err := packets.ReadPacketFromConnection(reader)
 	if err != nil {
 		return &Client{}, err
 	}
 
 	connectPacket, err := packets.DecodeConnect(firstPacket)
 	if err != nil {
-		ServerPrintln("Error during initial connect", err)
+		log.Println("- Error during initial connect:", err)
 		return &Client{}, err
 	}
 
@@ -145,11 +152,66 @@ func handleInitialConnect(connection network.Conn, clientTable *structures.SafeM
 	if connectPacket.Payload.ClientID == "" {
 		clientID = generateClientID()
 	}
+	varHeader := connectPacket.VariableLengthHeader.(*packets.ConnectVariableHeader)
+	cleanSession := varHeader.ConnectFlags&packets.CleanSessionFlag != 0
+
+	// A client with a verified certificate is authenticated by it, and is known by its Common Name
+	commonName, hasCertificate := network.VerifiedCommonName(connection)
+	if hasCertificate {
+		connectPacket.Payload.Username = commonName
+	}
 
-	newClient := CreateClient(clientID, connection)
-	if clientTable.Contains(clientID) {
-		return clientTable.Get(clientID), errors.New("error: Client already exists")
+	// Clients are authenticated before they can take over an existing session
+	if hooks.Authenticate != nil && !hasCertificate {
+		returnCode := hooks.Authenticate(connectPacket)
+		if returnCode != packets.ConnackAccepted {
+			_, err = connection.Write(packets.CreateConnACK(false, returnCode))
+			if err != nil {
+				fmt.Println("Error while writing", err)
+			}
+			connection.Close()
+			return &Client{connection: connection},
+				fmt.Errorf("error: client '%v' was refused with return code %v", clientID, returnCode)
+		}
+	}
+
+	// Only one connection can take over a client's session at a time
+	takeoverLock.Lock()
+	defer takeoverLock.Unlock()
+
+	newClient := clientTable.Get(clientID)
+	if newClient != nil && newClient.IsConnected() {
+		// The new connection takes over from the old one. The old connection's will is discarded
+		// as the client is still around, and its handler is left to exit once it sees the
+		// connection has closed.
+		log.Printf("+ Client '%v' connected again, disconnecting its old connection\n", clientID)
+		structures.Printf("Client '%v' connected again, disconnecting its old connection\n", clientID)
+		newClient.SetWill(nil, nil)
+		newClient.Disconnect(topicTrie, clientTable)
+		// Clean sessions are ended by the disconnect
+		newClient = clientTable.Get(clientID)
+	}
+
+	settings := ConnectSettings{
+		Username:     connectPacket.Payload.Username,
+		KeepAlive:    time.Duration(varHeader.KeepAlive) * time.Second,
+		CleanSession: cleanSession,
+		Bridge:       varHeader.ProtocolLevel&packets.BridgeFlag != 0,
+	}
+	switch {
+	case newClient == nil:
+		newClient = CreateClient(clientID, connection)
+		newClient.SetSettings(settings)
+	case cleanSession:
+		log.Printf("+ Discarding the session of client '%v'\n", clientID)
+		newClient.EndSession(topicTrie, clientTable)
+		newClient = CreateClient(clientID, connection)
+		newClient.SetSettings(settings)
+	default:
+		log.Printf("+ Resuming the session of client '%v'\n", clientID)
+		newClient.Resume(connection, settings)
 	}
+	newClient.SetWill(connection, willFromConnect(connectPacket))
 	clientTable.Put(clientID, newClient)
 
 	clientMsg := CreateClientMessage(clientID, connection, firstPacket)
@@ -158,15 +220,34 @@ func handleInitialConnect(connection network.Conn, clientTable *structures.SafeM
 	return newClient, nil
 }
 
-func handleDisconnect(client Client, clientTable *structures.SafeMap[ClientID, *Client],
-	topicToClient *TopicTrie, connectedClient *string) {
-	*connectedClient = ""
+// willFromConnect returns the will stored in a CONNECT packet, or nil if the will flag isn't set
+func willFromConnect(connectPacket *packets.Packet) *Will {
+	connectFlags := connectPacket.VariableLengthHeader.(*packets.ConnectVariableHeader).ConnectFlags
+	if connectFlags&packets.WillFlag == 0 {
+		return nil
+	}
+	return &Will{
+		Topic:   connectPacket.Payload.WillTopic,
+		Message: connectPacket.Payload.WillMessage,
+		Qos:     packets.GetWillQoS(connectFlags),
+		Retain:  connectFlags&packets.WillRetainFlag != 0,
+	}
+}
 
-	// If the client has already been disconnected elsewhere
-	// by a call to client.Disconnect
-	if !clientTable.Contains(client.ClientIdentifier) || client.NetworkConnection == nil {
+func publishWill(client *Client, connection network.Conn, hooks Hooks) {
+	will := client.TakeWill(connection)
+	if will == nil || hooks.PublishWill == nil {
 		return
 	}
+	log.Printf("+ Publishing will of client '%v' to '%v'\n", client.ClientIdentifier, will.Topic)
+	hooks.PublishWill(client, will)
+}
+
+func handleDisconnect(client *Client, connection network.Conn, clientTable *structures.SafeMap[ClientID, *Client],
+	topicToClient *TopicTrie, connectedClient *string) {
+	*connectedClient = ""
 
-	client.Disconnect(topicToClient, clientTable)
+	// If the client has already been disconnected elsewhere, or has
+	// reconnected with a new connection, this does nothing
+	client.DisconnectConnection(connection, topicToClient, clientTable)
 }
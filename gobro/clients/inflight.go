@@ -0,0 +1,142 @@
+package clients
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"MQTT-GO/packets"
+)
+
+// InflightMessage is a PUBLISH packet that has been sent to a client with a QoS
+// above 0, but that the client hasn't finished acknowledging yet.
+// We hold onto it so that it can be redelivered with the DUP flag set.
+// For QoS 2 messages, once the client has sent a PUBREC the message is released
+// and we redeliver the PUBREL instead until we get a PUBCOMP.
+// Messages for clients with a persistent session that are offline are queued as
+// inflight messages that haven't been sent yet.
+type InflightMessage struct {
+	PacketID int
+	Packet   []byte
+
+	lock     sync.Mutex
+	sequence uint64
+	lastSent time.Time
+	sent     bool
+	released bool
+}
+
+// CreateInflightMessage stores an encoded PUBLISH packet as inflight for the client,
+// so that it will be redelivered until it is acknowledged.
+func (client *Client) CreateInflightMessage(packetID int, packet []byte) *InflightMessage {
+	return client.putInflightMessage(&InflightMessage{
+		PacketID: packetID,
+		Packet:   packet,
+		sent:     true,
+		lastSent: time.Now(),
+	})
+}
+
+// QueueMessage stores an encoded PUBLISH packet as inflight for a client without it being sent.
+// It will be sent when the client resumes its session.
+func (client *Client) QueueMessage(packetID int, packet []byte) *InflightMessage {
+	return client.putInflightMessage(&InflightMessage{PacketID: packetID, Packet: packet})
+}
+
+// RestoreMessage stores a message that was inflight before the broker restarted. It is resent
+// as a duplicate, or as a PUBREL if it was released, when the client resumes its session.
+func (client *Client) RestoreMessage(packetID int, packet []byte, released bool) {
+	client.putInflightMessage(&InflightMessage{
+		PacketID: packetID,
+		Packet:   packet,
+		sent:     true,
+		released: released,
+	})
+}
+
+// putInflightMessage gives a message its place in the order and adds it to the client's inflight
+// messages. The message must be complete, as the redelivery goroutine can read it once it is added.
+func (client *Client) putInflightMessage(inflightMessage *InflightMessage) *InflightMessage {
+	client.packetIDLock.Lock()
+	client.lastSequence++
+	inflightMessage.sequence = client.lastSequence
+	client.packetIDLock.Unlock()
+
+	client.Inflight.Put(inflightMessage.PacketID, inflightMessage)
+	return inflightMessage
+}
+
+// PendingMessages returns the packets to send a client that has resumed its session, in the order
+// they were first created. Messages that were sent before the client disconnected are resent as
+// duplicates, and released messages are resent as a PUBREL.
+func (client *Client) PendingMessages() [][]byte {
+	inflightMessages := client.Inflight.Values()
+	sort.Slice(inflightMessages, func(i, j int) bool {
+		return inflightMessages[i].sequence < inflightMessages[j].sequence
+	})
+
+	pending := make([][]byte, 0, len(inflightMessages))
+	for _, inflightMessage := range inflightMessages {
+		pending = append(pending, inflightMessage.resend())
+	}
+	return pending
+}
+
+// AcknowledgeMessage removes a message from the client's inflight messages once
+// the client has sent a PUBACK (QoS 1) or PUBCOMP (QoS 2) for it.
+func (client *Client) AcknowledgeMessage(packetID int) {
+	client.Inflight.Delete(packetID)
+}
+
+// ReleaseMessage marks a QoS 2 message as released once the client has sent a PUBREC.
+// It returns the PUBREL that should be sent in reply, or nil if the message isn't inflight.
+func (client *Client) ReleaseMessage(packetID int) []byte {
+	inflightMessage := client.Inflight.Get(packetID)
+	if inflightMessage == nil {
+		return nil
+	}
+
+	inflightMessage.lock.Lock()
+	defer inflightMessage.lock.Unlock()
+	inflightMessage.released = true
+	inflightMessage.lastSent = time.Now()
+	return packets.CreatePubRel(packetID)
+}
+
+// Redeliver returns the packet that should be resent if the message has been waiting
+// longer than the given interval. This is the PUBLISH with the DUP flag set, or a PUBREL
+// if the message has already been released. It returns nil if nothing should be resent.
+func (inflightMessage *InflightMessage) Redeliver(interval time.Duration) []byte {
+	inflightMessage.lock.Lock()
+	defer inflightMessage.lock.Unlock()
+
+	// Queued messages are sent when the client resumes its session instead
+	if !inflightMessage.sent || time.Since(inflightMessage.lastSent) < interval {
+		return nil
+	}
+	inflightMessage.lastSent = time.Now()
+	return inflightMessage.packetToResend()
+}
+
+func (inflightMessage *InflightMessage) resend() []byte {
+	inflightMessage.lock.Lock()
+	defer inflightMessage.lock.Unlock()
+
+	inflightMessage.lastSent = time.Now()
+	if !inflightMessage.sent {
+		inflightMessage.sent = true
+		return inflightMessage.Packet
+	}
+	return inflightMessage.packetToResend()
+}
+
+// The lock must be held when calling this
+func (inflightMessage *InflightMessage) packetToResend() []byte {
+	if inflightMessage.released {
+		return packets.CreatePubRel(inflightMessage.PacketID)
+	}
+	duplicate := make([]byte, len(inflightMessage.Packet))
+	copy(duplicate, inflightMessage.Packet)
+	duplicate[0] |= packets.DupFlag
+	return duplicate
+}
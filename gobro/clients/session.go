@@ -0,0 +1,67 @@
+package clients
+
+import (
+	"MQTT-GO/network"
+	"MQTT-GO/structures"
+)
+
+// IsConnected returns false if the client has disconnected, but its session has been kept
+func (client *Client) IsConnected() bool {
+	client.sessionLock.Lock()
+	defer client.sessionLock.Unlock()
+	return client.connected
+}
+
+// Connection returns the client's current connection, and the ticket stand that orders the packets
+// sent on it. Both are replaced when the client connects again, so they must be taken together.
+func (client *Client) Connection() (network.Conn, *structures.TicketStand) {
+	client.sessionLock.Lock()
+	defer client.sessionLock.Unlock()
+	return client.connection, client.tickets
+}
+
+// Settings returns what the client asked for in its latest CONNECT
+func (client *Client) Settings() ConnectSettings {
+	client.sessionLock.Lock()
+	defer client.sessionLock.Unlock()
+	return client.settings
+}
+
+// SetSettings stores what the client asked for in its latest CONNECT
+func (client *Client) SetSettings(settings ConnectSettings) {
+	client.sessionLock.Lock()
+	defer client.sessionLock.Unlock()
+	client.settings = settings
+}
+
+// SessionPresent returns true if the client's current connection resumed an existing session
+func (client *Client) SessionPresent() bool {
+	client.sessionLock.Lock()
+	defer client.sessionLock.Unlock()
+	return client.sessionPresent
+}
+
+// Resume attaches a new connection to a client whose session was kept after it disconnected.
+// Its subscriptions, inflight messages and queued messages are all kept.
+func (client *Client) Resume(connection network.Conn, settings ConnectSettings) {
+	client.sessionLock.Lock()
+	defer client.sessionLock.Unlock()
+	client.connection = connection
+	client.tickets = structures.CreateTicketStand()
+	client.settings = settings
+	client.sessionPresent = true
+	client.connected = true
+}
+
+// EndSession removes the client from the client table and removes the client from
+// the topic to client map for each topic the client is subscribed to.
+func (client *Client) EndSession(topicTrie *TopicTrie, clientTable *structures.SafeMap[ClientID, *Client]) {
+	// If the client has subscribed to something we need to remove that client
+	// from the topic to client lists for each topic
+	topicTrie.DeleteClientSubscriptions(client)
+	// A new client with the same ID may have already replaced us
+	if clientTable.Get(client.ClientIdentifier) == client {
+		clientTable.Delete(client.ClientIdentifier)
+	}
+	client.Topics.DeleteLinkedList()
+}
@@ -0,0 +1,94 @@
+package clients
+
+import (
+	"strings"
+	"sync"
+)
+
+// sharedPrefix starts the filter of a shared subscription, $share/<group>/<filter>
+const sharedPrefix = "$share/"
+
+// SplitSharedFilter splits a shared subscription's topic filter into the name of its group and the
+// filter its members are subscribed to. ok is false if the topic filter isn't a valid shared subscription.
+func SplitSharedFilter(topicFilter string) (group string, filter string, ok bool) {
+	if !strings.HasPrefix(topicFilter, sharedPrefix) {
+		return "", "", false
+	}
+	group, filter, found := strings.Cut(strings.TrimPrefix(topicFilter, sharedPrefix), "/")
+	if !found || group == "" || filter == "" || strings.ContainsAny(group, "+#") {
+		return "", "", false
+	}
+	return group, filter, true
+}
+
+// IsSharedFilter returns true if the topic filter starts with $share/, whether or not it is valid
+func IsSharedFilter(topicFilter string) bool {
+	return strings.HasPrefix(topicFilter, sharedPrefix)
+}
+
+// sharedGroup is the members of a shared subscription to a single topic filter.
+// Every message published to the filter goes to one member, taking turns.
+type sharedGroup struct {
+	lock    sync.Mutex
+	members []Subscription
+	next    int
+}
+
+// put adds a member to the group, or replaces their QoS if they are already a member
+func (group *sharedGroup) put(clientID ClientID, qos byte) {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	for i, member := range group.members {
+		if member.ClientID == clientID {
+			group.members[i].Qos = qos
+			return
+		}
+	}
+	group.members = append(group.members, Subscription{ClientID: clientID, Qos: qos})
+}
+
+// remove removes a member from the group, and returns false if they weren't a member
+func (group *sharedGroup) remove(clientID ClientID) bool {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	for i, member := range group.members {
+		if member.ClientID == clientID {
+			group.members = append(group.members[:i], group.members[i+1:]...)
+			if group.next > i {
+				group.next--
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// pick returns the connected member whose turn it is to receive a message. If no member is
+// connected, the member whose turn it is gets it anyway, to be queued in their session.
+// A nil isConnected treats every member as connected.
+func (group *sharedGroup) pick(isConnected func(ClientID) bool) (Subscription, bool) {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	if len(group.members) == 0 {
+		return Subscription{}, false
+	}
+	group.next %= len(group.members)
+	chosen := group.next
+	if isConnected != nil {
+		for i := 0; i < len(group.members); i++ {
+			candidate := (group.next + i) % len(group.members)
+			if isConnected(group.members[candidate].ClientID) {
+				chosen = candidate
+				break
+			}
+		}
+	}
+	group.next = chosen + 1
+	return group.members[chosen], true
+}
+
+func (group *sharedGroup) size() int {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	return len(group.members)
+}
@@ -2,7 +2,6 @@ package clients
 
 import (
 	"errors"
-	"fmt"
 	"log"
 	"strings"
 
@@ -12,11 +11,13 @@ import (
 // Rename to TopicToSubscriberStore
 type TopicTrie struct {
 	topLevelMap *structures.SafeMap[string, *topicNode]
+	// isConnected tells shared subscriptions which of their members are online, see SetConnectedCheck
+	isConnected func(ClientID) bool
 }
 
 func (topicTrie TopicTrie) DeleteAll() {
 	for _, topic := range topicTrie.topLevelMap.Values() {
-		fmt.Println("DELETING TOPIC", topic.name)
+		structures.Println("DELETING TOPIC", topic.name)
 		topic.deleteSelf()
 	}
 }
@@ -28,11 +29,40 @@ func CreateTopicTrie() *TopicTrie {
 	return &topicTrie
 }
 
-func (topicTrie *TopicTrie) PrintTopics() {
+// SetConnectedCheck sets how shared subscriptions find out whether a member is connected,
+// so that messages go to members that are online before any that are offline.
+// Without it every member is treated as connected. It must be set before the trie is used.
+func (topicTrie *TopicTrie) SetConnectedCheck(isConnected func(ClientID) bool) {
+	topicTrie.isConnected = isConnected
+}
+
+// PrintTopics prints every topic in the trie with its subscribers, using the given printf,
+// such as the server's, which only prints if it is verbose
+func (topicTrie *TopicTrie) PrintTopics(printf func(format string, args ...any)) {
+	for _, topic := range topicTrie.topLevelMap.Values() {
+		topic.PrintTopics(printf)
+		printf("\n")
+	}
+}
+
+// NodeCount returns the number of topic levels stored in the trie
+func (topicTrie *TopicTrie) NodeCount() int {
+	nodes := 0
+	for _, topic := range topicTrie.topLevelMap.Values() {
+		topicNodes, _ := topic.count()
+		nodes += topicNodes
+	}
+	return nodes
+}
+
+// SubscriptionCount returns the number of subscriptions stored in the trie
+func (topicTrie *TopicTrie) SubscriptionCount() int {
+	subscriptions := 0
 	for _, topic := range topicTrie.topLevelMap.Values() {
-		topic.PrintTopics()
-		structures.Println()
+		_, topicSubscriptions := topic.count()
+		subscriptions += topicSubscriptions
 	}
+	return subscriptions
 }
 
 func (topicTrie *TopicTrie) DeleteClientSubscriptions(client *Client) {
@@ -42,20 +72,20 @@ func (topicTrie *TopicTrie) DeleteClientSubscriptions(client *Client) {
 	}
 	node := clientTopics.Head()
 	for node != nil {
-		topic := node.Value().TopicFilter
-		clientLL, err := topicTrie.get(topic)
+		group, topic := splitTopicFilter(node.Value().TopicFilter)
+		topicNode, err := topicTrie.getNode(topic)
 		// Race condition
 		if err != nil {
-			ServerPrintln("Tried to remove topic that had already been deleted")
+			log.Println("- Tried to remove topic that had already been deleted")
 			node = node.Next()
 			continue
 		}
 
-		err = clientLL.Delete(client.ClientIdentifier)
+		err = topicNode.removeSubscription(group, client.ClientIdentifier)
 		if err != nil {
-			ServerPrintln("Tried to delete client and got:", err)
+			log.Println("- Tried to delete client and got:", err)
 		}
-		if clientLL.Size() == 0 {
+		if topicNode.isEmpty() {
 			err := topicTrie.Delete(topic)
 			if err != nil {
 				panic(err)
@@ -66,20 +96,36 @@ func (topicTrie *TopicTrie) DeleteClientSubscriptions(client *Client) {
 	}
 }
 
+// Put subscribes a client to a topic with a QoS of 0
 func (topicTrie *TopicTrie) Put(topicName string, clientID ClientID) error {
-	clientLL, err := topicTrie.get(topicName)
+	return topicTrie.PutWithQoS(topicName, clientID, 0)
+}
+
+// PutWithQoS subscribes a client to a topic with the given QoS, creating the topic if it
+// doesn't exist. If the client is already subscribed then their QoS is replaced.
+// A $share/<group>/<filter> topic makes the client a member of the group's shared subscription.
+func (topicTrie *TopicTrie) PutWithQoS(topicName string, clientID ClientID, qos byte) error {
+	group, topicName := splitTopicFilter(topicName)
+	node, err := topicTrie.getNode(topicName)
 	if err != nil {
 		if errors.Is(err, ErrTopicDoesntExist) {
 			err = topicTrie.AddTopic(topicName)
 			if err != nil {
 				return err
 			}
-			clientLL, _ = topicTrie.get(topicName)
+			node, _ = topicTrie.getNode(topicName)
 		} else {
 			return err
 		}
 	}
-	clientLL.Append(clientID)
+	if group != "" {
+		node.sharedGroups.PutIfAbsent(group, &sharedGroup{}).put(clientID, qos)
+		return nil
+	}
+	node.subscriptionQos.Put(clientID, qos)
+	if !node.subscribedClients.Contains(clientID) {
+		node.subscribedClients.Append(clientID)
+	}
 	return nil
 }
 
@@ -95,29 +141,30 @@ func (topicTrie *TopicTrie) PutClients(topicName string, clientIDs []ClientID) e
 }
 
 func (topicTrie *TopicTrie) Contains(topicName string) bool {
+	_, topicName = splitTopicFilter(topicName)
 	_, err := topicTrie.get(topicName)
 	return err == nil
 }
 
 func (topicTrie *TopicTrie) Unsubscribe(clientID ClientID, topicNames ...string) {
 	for _, topic := range topicNames {
-		subscribedClients, err := topicTrie.get(topic)
+		group, topic := splitTopicFilter(topic)
+		topicNode, err := topicTrie.getNode(topic)
 		if err != nil {
-			ServerPrintln("Error while unsubscribing:", err)
+			log.Println("- Error while unsubscribing:", err)
 			continue
 		}
-		err = subscribedClients.Delete(clientID)
+		err = topicNode.removeSubscription(group, clientID)
 		if err != nil {
-			ServerPrintln("Error while deleting client:", err)
+			log.Println("- Error while deleting client:", err)
 			continue
 		}
 		// If no one is left subscribed to the topic, remove it.
 		// This is to avoid memory leaks
-		if subscribedClients.Size() == 0 {
+		if topicNode.isEmpty() {
 			err := topicTrie.Delete(topic)
 			if err != nil {
 				log.Println("- error while removing topic from topicTrie", err)
-				ServerPrintln("error while removing topic from topicTrie", err)
 			}
 		}
 	}
@@ -144,6 +191,7 @@ func (topicTrie *TopicTrie) Delete(topicName string) error {
 var ErrTopicAlreadyExists = errors.New("error: Trying to add client that already exists")
 
 func (topicTrie *TopicTrie) AddTopic(topicName string) error {
+	_, topicName = splitTopicFilter(topicName)
 	topicSections := strings.Split(topicName, "/")
 	// If this is just a top level topic like sensors/ as opposed to sensors/c02sensors/...
 	if len(topicSections) == 1 {
@@ -163,7 +211,10 @@ func (topicTrie *TopicTrie) AddTopic(topicName string) error {
 	return baseTopic.AddTopic(topicSections[1:])
 }
 
-func (topicTrie *TopicTrie) GetMatchingClients(topicName string) (*structures.LinkedList[ClientID], error) {
+// GetMatchingClients returns the subscriptions of every client subscribed to a filter
+// matching the topic name, along with the QoS they subscribed with.
+// If a client has multiple matching subscriptions they only appear once, with the highest QoS.
+func (topicTrie *TopicTrie) GetMatchingClients(topicName string) (*structures.LinkedList[Subscription], error) {
 	if topicName == "" {
 		return nil, errors.New("error: Cannot search for empty topic")
 	}
@@ -182,35 +233,79 @@ func (topicTrie *TopicTrie) GetMatchingClients(topicName string) (*structures.Li
 	}
 
 	if topicSections[0] == "+" {
-		result := structures.CreateLinkedList[ClientID]()
+		result := structures.CreateLinkedList[Subscription]()
 		for _, topLevelTopic := range topicTrie.topLevelMap.Values() {
-			result = structures.Concatenate(result, topLevelTopic.getMatchingClients(topicSections[1:]))
+			result = structures.Concatenate(result, topLevelTopic.getMatchingClients(topicSections[1:], topicTrie.isConnected))
 		}
-		result.RemoveDuplicates()
-		return result, nil
+		return removeDuplicateSubscriptions(result), nil
 	}
 
 	topLevelMap := topicTrie.topLevelMap
+	result := structures.CreateLinkedList[Subscription]()
 	topLevelTopic := topLevelMap.Get(topicSections[0])
-	if topLevelTopic == nil {
-		return nil, ErrTopicDoesntExist
+	if topLevelTopic != nil {
+		if len(topicSections) == 1 {
+			result = topLevelTopic.matchedSubscriptions(topicTrie.isConnected)
+		} else {
+			result = topLevelTopic.getMatchingClients(topicSections[1:], topicTrie.isConnected)
+		}
 	}
 
-	if len(topicSections) == 1 {
-		return topLevelTopic.subscribedClients.DeepCopy(), nil
+	// Topics starting with $ are reserved for the server, so wildcards at the first level don't match them
+	if !strings.HasPrefix(topicSections[0], "$") {
+		if plusTopic := topLevelMap.Get("+"); plusTopic != nil && topicSections[0] != "+" {
+			if len(topicSections) == 1 {
+				result = structures.Concatenate(result, plusTopic.matchedSubscriptions(topicTrie.isConnected))
+			} else {
+				result = structures.Concatenate(result, plusTopic.getMatchingClients(topicSections[1:], topicTrie.isConnected))
+			}
+		}
+		if hashTopic := topLevelMap.Get("#"); hashTopic != nil && topicSections[0] != "#" {
+			result = structures.Concatenate(result, hashTopic.getAllLowerLevelClients(topicTrie.isConnected))
+		}
 	}
-	result := topLevelTopic.getMatchingClients(topicSections[1:])
-	if result.Size() == 0 {
+
+	if result.Size() == 0 && (topLevelTopic == nil || len(topicSections) > 1) {
 		return nil, ErrTopicDoesntExist
 	}
 	// We don't want to send a client the same message twice
-	result.RemoveDuplicates()
+	return removeDuplicateSubscriptions(result), nil
+}
 
-	return result, nil
+// removeDuplicateSubscriptions keeps a single subscription for every client, using
+// the highest QoS out of all of their subscriptions.
+func removeDuplicateSubscriptions(subscriptions *structures.LinkedList[Subscription]) *structures.LinkedList[Subscription] {
+	highestQos := make(map[ClientID]byte, subscriptions.Size())
+	order := make([]ClientID, 0, subscriptions.Size())
+
+	for _, subscription := range subscriptions.GetItems() {
+		qos, found := highestQos[subscription.ClientID]
+		if !found {
+			order = append(order, subscription.ClientID)
+		}
+		if !found || subscription.Qos > qos {
+			highestQos[subscription.ClientID] = subscription.Qos
+		}
+	}
+
+	result := structures.CreateLinkedList[Subscription]()
+	for _, clientID := range order {
+		result.Append(Subscription{ClientID: clientID, Qos: highestQos[clientID]})
+	}
+	return result
 }
 
 // err can be ErrTopicDoesntExist or nil
 func (topicTrie *TopicTrie) get(topicName string) (*structures.LinkedList[ClientID], error) {
+	node, err := topicTrie.getNode(topicName)
+	if err != nil {
+		return nil, err
+	}
+	return node.subscribedClients, nil
+}
+
+// err can be ErrTopicDoesntExist or nil
+func (topicTrie *TopicTrie) getNode(topicName string) (*topicNode, error) {
 	topicSections := strings.Split(topicName, "/")
 
 	topLevelTopic := topicTrie.topLevelMap.Get(topicSections[0])
@@ -219,7 +314,7 @@ func (topicTrie *TopicTrie) get(topicName string) (*structures.LinkedList[Client
 	}
 
 	if len(topicSections) == 1 {
-		return topLevelTopic.subscribedClients, nil
+		return topLevelTopic, nil
 	}
 
 	result := topLevelTopic.get(topicSections[1:])
@@ -229,15 +324,15 @@ func (topicTrie *TopicTrie) get(topicName string) (*structures.LinkedList[Client
 	return result, nil
 }
 
-func (t *topicNode) PrintTopics() {
-	ServerPrintf("%v (%v):  ", t.name, t.subscribedClients.GetItems())
+func (t *topicNode) PrintTopics(printf func(format string, args ...any)) {
+	printf("%v (%v):  ", t.name, t.subscribedClients.GetItems())
 	for _, child := range t.children {
-		ServerPrintf("%v ", child.name)
+		printf("%v ", child.name)
 	}
-	structures.Println()
+	printf("\n")
 
 	for _, child := range t.children {
-		child.PrintTopics()
+		child.PrintTopics(printf)
 	}
 }
 
@@ -245,6 +340,9 @@ type topicNode struct {
 	name              string
 	children          []*topicNode
 	subscribedClients *structures.LinkedList[ClientID]
+	subscriptionQos   *structures.SafeMap[ClientID, byte]
+	// sharedGroups are the shared subscriptions to this topic, by the name of their group
+	sharedGroups *structures.SafeMap[string, *sharedGroup]
 }
 
 func makeBaseTopic(topicName string) *topicNode {
@@ -253,10 +351,71 @@ func makeBaseTopic(topicName string) *topicNode {
 		name:              topicName,
 		children:          make([]*topicNode, 0, 5),
 		subscribedClients: connectedClients,
+		subscriptionQos:   structures.CreateSafeMap[ClientID, byte](),
+		sharedGroups:      structures.CreateSafeMap[string, *sharedGroup](),
 	}
 	return &newTopic
 }
 
+// subscriptions returns a snapshot of the clients subscribed to this exact topic
+// along with the QoS they subscribed with. Each shared subscription adds the one
+// member whose turn it is to receive the next message, skipping members that aren't connected.
+func (t *topicNode) subscriptions(isConnected func(ClientID) bool) *structures.LinkedList[Subscription] {
+	result := structures.CreateLinkedList[Subscription]()
+	for _, clientID := range t.subscribedClients.GetItems() {
+		result.Append(Subscription{ClientID: clientID, Qos: t.subscriptionQos.Get(clientID)})
+	}
+	for _, group := range t.sharedGroups.Values() {
+		if member, ok := group.pick(isConnected); ok {
+			result.Append(member)
+		}
+	}
+	return result
+}
+
+// matchedSubscriptions returns the subscriptions of a topic that a topic name has been matched
+// all the way down to. A # matches its parent level too, so a/# matches a.
+func (t *topicNode) matchedSubscriptions(isConnected func(ClientID) bool) *structures.LinkedList[Subscription] {
+	result := t.subscriptions(isConnected)
+	for _, child := range t.children {
+		if child.name == "#" {
+			result = structures.Concatenate(result, child.subscriptions(isConnected))
+		}
+	}
+	return result
+}
+
+// removeSubscription unsubscribes a client from this topic, or from one of its shared
+// subscriptions if the group isn't empty. Empty shared subscriptions are removed.
+func (t *topicNode) removeSubscription(group string, clientID ClientID) error {
+	if group == "" {
+		t.subscriptionQos.Delete(clientID)
+		return t.subscribedClients.Delete(clientID)
+	}
+	sharedGroup := t.sharedGroups.Get(group)
+	if sharedGroup == nil || !sharedGroup.remove(clientID) {
+		return errors.New("error: client isn't a member of the shared subscription")
+	}
+	if sharedGroup.size() == 0 {
+		t.sharedGroups.Delete(group)
+	}
+	return nil
+}
+
+// isEmpty returns true if nobody is subscribed to this exact topic
+func (t *topicNode) isEmpty() bool {
+	return t.subscribedClients.Size() == 0 && t.sharedGroups.Size() == 0
+}
+
+// splitTopicFilter returns the group of a shared subscription's topic filter, or an empty
+// group if it isn't shared, along with the filter of the topic it is stored at.
+func splitTopicFilter(topicFilter string) (string, string) {
+	if group, filter, ok := SplitSharedFilter(topicFilter); ok {
+		return group, filter
+	}
+	return "", topicFilter
+}
+
 var ErrTopicDoesntExist = errors.New("error: Topic doesn't exist")
 
 func (t *topicNode) DeleteTopic(topicSections []string) error {
@@ -281,6 +440,23 @@ func (t *topicNode) DeleteTopic(topicSections []string) error {
 	return ErrTopicDoesntExist
 }
 
+// count returns the number of nodes below and including this one, and the number of subscriptions to them
+func (t *topicNode) count() (int, int) {
+	nodes, subscriptions := 1, 0
+	if t.subscribedClients != nil {
+		subscriptions = t.subscribedClients.Size()
+	}
+	for _, group := range t.sharedGroups.Values() {
+		subscriptions += group.size()
+	}
+	for _, child := range t.children {
+		childNodes, childSubscriptions := child.count()
+		nodes += childNodes
+		subscriptions += childSubscriptions
+	}
+	return nodes, subscriptions
+}
+
 func (t *topicNode) deleteSelf() {
 	if t == nil {
 		return
@@ -288,7 +464,7 @@ func (t *topicNode) deleteSelf() {
 	for _, child := range t.children {
 		child.deleteSelf()
 	}
-	fmt.Println("DELETING LINKED LIST")
+	structures.Println("DELETING LINKED LIST")
 	t.subscribedClients.DeleteLinkedList()
 	t.subscribedClients = nil
 }
@@ -322,34 +498,30 @@ func (t *topicNode) AddTopic(topicSections []string) error {
 	return nil
 }
 
-func (t *topicNode) getAllLowerLevelClients() *structures.LinkedList[ClientID] {
-	result := t.subscribedClients
+func (t *topicNode) getAllLowerLevelClients(isConnected func(ClientID) bool) *structures.LinkedList[Subscription] {
+	result := t.subscriptions(isConnected)
 	for _, child := range t.children {
-		result = structures.Concatenate(result, child.getAllLowerLevelClients())
+		result = structures.Concatenate(result, child.getAllLowerLevelClients(isConnected))
 	}
 	return result
 }
 
-func (t *topicNode) getMatchingClients(topicSections []string) *structures.LinkedList[ClientID] {
+func (t *topicNode) getMatchingClients(topicSections []string, isConnected func(ClientID) bool) *structures.LinkedList[Subscription] {
 	// If we've gotten to the end of the topic list
 	if len(topicSections) == 0 {
-		return t.subscribedClients
+		return t.matchedSubscriptions(isConnected)
 	}
 
+	// These two if statements allow for publishing to a wildcard!
 	if topicSections[0] == "#" {
-		return t.getAllLowerLevelClients()
+		return t.getAllLowerLevelClients(isConnected)
 	}
 
-	result := structures.CreateLinkedList[ClientID]()
-
-	// These two if statements allow for publishing to a wildcard!
-	if len(topicSections) == 1 && t.name == topicSections[0] {
-		return t.subscribedClients
-	}
+	result := structures.CreateLinkedList[Subscription]()
 
 	if topicSections[0] == "+" {
 		for _, child := range t.children {
-			result = structures.Concatenate(result, child.getMatchingClients(topicSections[1:]))
+			result = structures.Concatenate(result, child.getMatchingClients(topicSections[1:], isConnected))
 		}
 		return result
 	}
@@ -357,18 +529,18 @@ func (t *topicNode) getMatchingClients(topicSections []string) *structures.Linke
 	for _, child := range t.children {
 		// If we're not at the bottom level topic
 		if child.name == topicSections[0] || child.name == "+" {
-			result = structures.Concatenate(result, child.getMatchingClients(topicSections[1:]))
+			result = structures.Concatenate(result, child.getMatchingClients(topicSections[1:], isConnected))
 		} else if child.name == "#" {
-			result = structures.Concatenate(result, child.getAllLowerLevelClients())
+			result = structures.Concatenate(result, child.getAllLowerLevelClients(isConnected))
 		}
 	}
 	return result
 }
 
-// Can return a client list of nil (if the topic doesn't exist)
-func (t *topicNode) get(topicSections []string) *structures.LinkedList[ClientID] {
+// Can return a nil node (if the topic doesn't exist)
+func (t *topicNode) get(topicSections []string) *topicNode {
 	if len(topicSections) == 0 {
-		return t.subscribedClients
+		return t
 	}
 	for _, child := range t.children {
 		if child.name == topicSections[0] {
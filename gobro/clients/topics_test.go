@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"testing"
 
+	"MQTT-GO/packets"
+
 	"golang.org/x/exp/slices"
 )
 
@@ -17,7 +19,7 @@ func testErr(t *testing.T, err error) {
 func TestInitialization(t *testing.T) {
 	topicStore := CreateTopicTrie()
 	testErr(t, topicStore.AddTopic("x"))
-	topicStore.PrintTopics()
+	topicStore.PrintTopics(t.Logf)
 }
 
 func TestPuttingLowerLevel(t *testing.T) {
@@ -33,7 +35,7 @@ func TestPuttingLowerLevel(t *testing.T) {
 			t.Error(err)
 		}
 	}
-	topicStore.PrintTopics()
+	topicStore.PrintTopics(t.Logf)
 }
 
 // Testing adding an already created top level topic works
@@ -44,7 +46,7 @@ func TestDuplicating(t *testing.T) {
 	if err != ErrTopicAlreadyExists {
 		t.Error("Able to add topic that already exists")
 	}
-	topicStore.PrintTopics()
+	topicStore.PrintTopics(t.Logf)
 }
 
 func TestDuplicatingLowerLevel(t *testing.T) {
@@ -56,7 +58,7 @@ func TestDuplicatingLowerLevel(t *testing.T) {
 		t.Error("Able to add topic that already exists")
 	}
 
-	topicStore.PrintTopics()
+	topicStore.PrintTopics(t.Logf)
 }
 
 func TestAddingMultipleChildren(t *testing.T) {
@@ -75,7 +77,7 @@ func TestAddingMultipleChildren(t *testing.T) {
 		}
 	}
 
-	topicStore.PrintTopics()
+	topicStore.PrintTopics(t.Logf)
 }
 
 func TestDeletingHigherLevel(t *testing.T) {
@@ -93,7 +95,7 @@ func TestDeletingLowerLevel(t *testing.T) {
 	topicStore := CreateTopicTrie()
 	testErr(t, topicStore.AddTopic("x/y/z"))
 	testErr(t, topicStore.Delete("x/y"))
-	topicStore.PrintTopics()
+	topicStore.PrintTopics(t.Logf)
 
 	if _, err := topicStore.GetMatchingClients("x"); err == ErrTopicDoesntExist {
 		t.Error("Unable to access base element after child is deleted")
@@ -118,10 +120,10 @@ func TestDeletingOneChild(t *testing.T) {
 	if err1 != ErrTopicDoesntExist || a != nil {
 		t.Error("Could access deleted element")
 	}
-	if err2 != nil || !b.Contains("test1") {
+	if err2 != nil || !b.Contains(Subscription{ClientID: "test1"}) {
 		t.Error(err2)
 	}
-	if err3 != nil || !c.Contains("test2") {
+	if err3 != nil || !c.Contains(Subscription{ClientID: "test2"}) {
 		t.Error(err2)
 	}
 
@@ -135,10 +137,10 @@ func TestAddingClientIDs(t *testing.T) {
 	testErr(t, topicStore.Put("x/y/z", "abc"))
 	testErr(t, topicStore.Put("x/y/z", "def"))
 	testErr(t, topicStore.Put("x/y/1", "def"))
-	topicStore.PrintTopics()
+	topicStore.PrintTopics(t.Logf)
 	res, err := topicStore.GetMatchingClients("x/y/z")
 
-	if res.Head().Value() != "abc" || err != nil {
+	if res.Head().Value().ClientID != "abc" || err != nil {
 		t.Error("Value not being added correctly")
 	}
 }
@@ -150,7 +152,7 @@ func TestDuplicatesAreRemoved(t *testing.T) {
 	testErr(t, topicStore.Put("x/y/3", "abc"))
 
 	result, _ := topicStore.GetMatchingClients("x/y/#")
-	if result.Size() != 1 || result.Head().Value() != "abc" {
+	if result.Size() != 1 || result.Head().Value().ClientID != "abc" {
 		t.Error("Duplicates are not being removed correctly")
 	}
 }
@@ -162,8 +164,8 @@ func TestHashWildcard(t *testing.T) {
 
 	cLL, _ := topicStore.GetMatchingClients("x/y/z")
 	clientArr := cLL.GetItems()
-	ServerPrintln(clientArr)
-	if !slices.Contains(clientArr, "abc") || !slices.Contains(clientArr, "xyz") ||
+	t.Log(clientArr)
+	if !slices.Contains(clientArr, Subscription{ClientID: "abc"}) || !slices.Contains(clientArr, Subscription{ClientID: "xyz"}) ||
 		len(clientArr) != 2 {
 		t.Error("Didn't find correct clients")
 	}
@@ -175,7 +177,7 @@ func TestPlusWildcard(t *testing.T) {
 	testErr(t, topicStore.Put("x/+/m", "2"))
 	testErr(t, topicStore.Put("x/y/c", "3"))
 
-	topicStore.PrintTopics()
+	topicStore.PrintTopics(t.Logf)
 
 	cLL, err := topicStore.GetMatchingClients("x/a/m")
 
@@ -183,7 +185,7 @@ func TestPlusWildcard(t *testing.T) {
 		fmt.Println(err)
 	}
 
-	if cLL.Size() != 1 || cLL.Head().Value() != "2" {
+	if cLL.Size() != 1 || cLL.Head().Value().ClientID != "2" {
 		t.Error("+ didn't work correctly.")
 	}
 }
@@ -203,3 +205,161 @@ func TestPlusWildcardFurther(t *testing.T) {
 		t.Error("+ didn't work correctly.")
 	}
 }
+
+func TestHighestQoSIsUsedForOverlappingSubscriptions(t *testing.T) {
+	topicStore := CreateTopicTrie()
+	testErr(t, topicStore.PutWithQoS("x/y/z", "abc", 0))
+	testErr(t, topicStore.PutWithQoS("x/#", "abc", 2))
+	testErr(t, topicStore.PutWithQoS("x/+/z", "def", 1))
+
+	cLL, err := topicStore.GetMatchingClients("x/y/z")
+	testErr(t, err)
+
+	clientArr := cLL.GetItems()
+	if len(clientArr) != 2 || !slices.Contains(clientArr, Subscription{ClientID: "abc", Qos: 2}) ||
+		!slices.Contains(clientArr, Subscription{ClientID: "def", Qos: 1}) {
+		t.Error("Didn't find correct subscriptions", clientArr)
+	}
+}
+
+func TestResubscribingReplacesQoS(t *testing.T) {
+	topicStore := CreateTopicTrie()
+	testErr(t, topicStore.PutWithQoS("x/y", "abc", 2))
+	testErr(t, topicStore.PutWithQoS("x/y", "abc", 1))
+
+	cLL, err := topicStore.GetMatchingClients("x/y")
+	testErr(t, err)
+	if cLL.Size() != 1 || cLL.Head().Value().Qos != 1 {
+		t.Error("Resubscribing didn't replace the subscription", cLL.GetItems())
+	}
+}
+
+func TestTopLevelWildcards(t *testing.T) {
+	topicStore := CreateTopicTrie()
+	testErr(t, topicStore.Put("#", "everything"))
+	testErr(t, topicStore.Put("+/y", "plus"))
+	testErr(t, topicStore.Put("$SYS/#", "sys"))
+
+	cLL, err := topicStore.GetMatchingClients("x/y")
+	testErr(t, err)
+	clientArr := cLL.GetItems()
+	if len(clientArr) != 2 || !slices.Contains(clientArr, Subscription{ClientID: "everything"}) ||
+		!slices.Contains(clientArr, Subscription{ClientID: "plus"}) {
+		t.Error("Top level wildcards didn't match", clientArr)
+	}
+
+	// Wildcards at the first level don't match topics starting with $
+	cLL, err = topicStore.GetMatchingClients("$SYS/y")
+	testErr(t, err)
+	clientArr = cLL.GetItems()
+	if len(clientArr) != 1 || clientArr[0].ClientID != "sys" {
+		t.Error("$ topic was matched by a wildcard", clientArr)
+	}
+}
+
+// The trie routes live messages, and TopicMatchesFilter decides which retained messages a new
+// subscription gets, so they have to match the same topics
+func TestMatchingAgreesWithTopicMatchesFilter(t *testing.T) {
+	filters := []string{"a", "a/#", "a/+", "a/b", "a/b/#", "a/+/c", "+", "+/#", "+/b", "#", "$SYS/#"}
+	topicStore := CreateTopicTrie()
+	for _, filter := range filters {
+		testErr(t, topicStore.Put(filter, ClientID(filter)))
+	}
+
+	for _, topicName := range []string{"a", "a/b", "a/b/b", "a/b/c", "a/c", "b", "b/b", "$SYS", "$SYS/a"} {
+		expected := []ClientID{}
+		for _, filter := range filters {
+			if packets.TopicMatchesFilter(filter, topicName) {
+				expected = append(expected, ClientID(filter))
+			}
+		}
+		matched := []ClientID{}
+		if cLL, err := topicStore.GetMatchingClients(topicName); err == nil {
+			for _, subscription := range cLL.GetItems() {
+				matched = append(matched, subscription.ClientID)
+			}
+		}
+		slices.Sort(expected)
+		slices.Sort(matched)
+		if !slices.Equal(expected, matched) {
+			t.Errorf("%v was matched by %v, but TopicMatchesFilter matches %v", topicName, matched, expected)
+		}
+	}
+}
+
+func TestSharedSubscriptionsTakeTurns(t *testing.T) {
+	topicStore := CreateTopicTrie()
+	testErr(t, topicStore.Put("a/b", "plain"))
+	testErr(t, topicStore.PutWithQoS("$share/workers/a/+", "w1", 1))
+	testErr(t, topicStore.PutWithQoS("$share/workers/a/+", "w2", 1))
+	testErr(t, topicStore.PutWithQoS("$share/others/a/#", "o1", 0))
+
+	received := map[ClientID]int{}
+	for i := 0; i < 4; i++ {
+		cLL, err := topicStore.GetMatchingClients("a/b")
+		testErr(t, err)
+		if cLL.Size() != 3 {
+			t.Fatal("Expected one member of each group and the plain subscriber", cLL.GetItems())
+		}
+		for _, subscription := range cLL.GetItems() {
+			received[subscription.ClientID]++
+		}
+	}
+	if received["plain"] != 4 || received["o1"] != 4 || received["w1"] != 2 || received["w2"] != 2 {
+		t.Error("Messages weren't shared between the members", received)
+	}
+
+	// Members that leave are removed from their groups
+	worker := CreateClient("w1", nil)
+	worker.AddTopic(Topic{TopicFilter: "$share/workers/a/+", Qos: 1})
+	topicStore.DeleteClientSubscriptions(worker)
+	topicStore.Unsubscribe("o1", "$share/others/a/#")
+	for i := 0; i < 2; i++ {
+		cLL, err := topicStore.GetMatchingClients("a/b")
+		testErr(t, err)
+		clientArr := cLL.GetItems()
+		if len(clientArr) != 2 || !slices.Contains(clientArr, Subscription{ClientID: "w2", Qos: 1}) {
+			t.Error("Expected the remaining member to get every message", clientArr)
+		}
+	}
+	if topicStore.Contains("a/#") {
+		t.Error("Empty shared subscription wasn't removed")
+	}
+}
+
+func TestSharedSubscriptionsSkipDisconnectedMembers(t *testing.T) {
+	topicStore := CreateTopicTrie()
+	connected := map[ClientID]bool{"w1": false, "w2": true, "w3": true}
+	topicStore.SetConnectedCheck(func(clientID ClientID) bool {
+		return connected[clientID]
+	})
+	for _, clientID := range []ClientID{"w1", "w2", "w3"} {
+		testErr(t, topicStore.PutWithQoS("$share/workers/jobs", clientID, 1))
+	}
+
+	received := map[ClientID]int{}
+	for i := 0; i < 4; i++ {
+		cLL, err := topicStore.GetMatchingClients("jobs")
+		testErr(t, err)
+		for _, subscription := range cLL.GetItems() {
+			received[subscription.ClientID]++
+		}
+	}
+	if received["w1"] != 0 || received["w2"] != 2 || received["w3"] != 2 {
+		t.Error("Messages weren't shared between the connected members", received)
+	}
+
+	// When nobody is connected, the members still take turns so the messages are queued in their sessions
+	connected["w2"], connected["w3"] = false, false
+	received = map[ClientID]int{}
+	for i := 0; i < 3; i++ {
+		cLL, err := topicStore.GetMatchingClients("jobs")
+		testErr(t, err)
+		for _, subscription := range cLL.GetItems() {
+			received[subscription.ClientID]++
+		}
+	}
+	if received["w1"] != 1 || received["w2"] != 1 || received["w3"] != 1 {
+		t.Error("Messages weren't shared between the offline members", received)
+	}
+}
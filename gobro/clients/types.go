@@ -1,6 +1,8 @@
 package clients
 
 import (
+	"MQTT-GO/network"
+	"MQTT-GO/packets"
 	"MQTT-GO/structures"
 )
 
@@ -9,14 +11,41 @@ type Topic struct {
 	Qos         byte
 }
 
+// Subscription is a client that is subscribed to a topic, and the QoS they subscribed with
+type Subscription struct {
+	ClientID ClientID
+	Qos      byte
+}
+
+// Will is the message a client asks the broker to publish on its behalf
+// if it disconnects without sending a DISCONNECT
+type Will struct {
+	Topic   string
+	Message []byte
+	Qos     byte
+	Retain  bool
+}
+
+// Hooks are functions provided by the server that the client handler calls
+// when something happens to a client, and the server's settings the client handler needs
+type Hooks struct {
+	// PublishWill is called after a client has disconnected ungracefully
+	PublishWill func(client *Client, will *Will)
+	// Authenticate checks the credentials in a CONNECT and returns the CONNACK return code.
+	// Any return code other than 0 refuses the connection.
+	Authenticate func(connect *packets.Packet) byte
+	// ReceivingLatencies records when PUBLISH packets are received, for the stress tests.
+	// If it is nil they aren't recorded.
+	ReceivingLatencies chan<- *network.LatencyStruct
+}
+
 type TopicToClient map[Topic]*structures.LinkedList[ClientID]
 
-func (topicToClient *TopicToClient) Print() {
-	ServerPrintf("Topic to client map: ")
+// Print prints every topic with its clients, using the given printf in the same way as PrintTopics
+func (topicToClient *TopicToClient) Print(printf func(format string, args ...any)) {
+	printf("Topic to client map: ")
 	for t := range *topicToClient {
-		ServerPrintf("%v : ", t)
-		(*topicToClient)[t].PrintItems()
-		ServerPrintln()
+		printf("%v : %v\n", t, (*topicToClient)[t].GetItems())
 	}
 }
 
@@ -0,0 +1,426 @@
+package gobro
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"MQTT-GO/gobro/clients"
+)
+
+const (
+	// SnapshotAfter is how many changes the FileStore writes to its log before it takes a snapshot
+	SnapshotAfter = 10000
+
+	snapshotFilename = "snapshot.json"
+	logFilename      = "wal.log"
+)
+
+// These are the operations written to a FileStore's log
+const (
+	opSaveSession           = "saveSession"
+	opDeleteSession         = "deleteSession"
+	opSaveSubscription      = "saveSubscription"
+	opDeleteSubscription    = "deleteSubscription"
+	opSaveMessage           = "saveMessage"
+	opDeleteMessage         = "deleteMessage"
+	opSaveAwaitingRelease   = "saveAwaitingRelease"
+	opDeleteAwaitingRelease = "deleteAwaitingRelease"
+	opSaveRetained          = "saveRetained"
+	opDeleteRetained        = "deleteRetained"
+)
+
+// FileStore is a Store that keeps its state in a directory. Every change is appended to a
+// write-ahead log, and after SnapshotAfter changes the whole state is written to a snapshot
+// and the log is emptied. When the FileStore is opened the snapshot is read and the log is
+// replayed on top of it.
+//
+// Changes are written to the log straight away, so they survive the broker crashing, but
+// the files are only synced to disk when a snapshot is taken.
+type FileStore struct {
+	dir  string
+	lock sync.Mutex
+	// logFile is nil once the store has been closed
+	logFile   *os.File
+	logWriter *bufio.Writer
+	// changes is the number of changes in the log since the last snapshot
+	changes int
+
+	sessions     map[string]*fileStoreSession
+	retained     map[string]StoredRetained
+	lastSequence uint64
+}
+
+type fileStoreSession struct {
+	subscriptions   map[string]byte
+	messages        map[int]*fileStoreMessage
+	awaitingRelease map[int]struct{}
+}
+
+// fileStoreMessage keeps the order messages were first saved in
+type fileStoreMessage struct {
+	StoredMessage
+	sequence uint64
+}
+
+// logRecord is a single change written to the log
+type logRecord struct {
+	Op       string `json:"op"`
+	ClientID string `json:"clientID,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+	Qos      byte   `json:"qos,omitempty"`
+	PacketID int    `json:"packetID,omitempty"`
+	Packet   []byte `json:"packet,omitempty"`
+	Released bool   `json:"released,omitempty"`
+}
+
+// OpenFileStore opens the FileStore in a directory, creating the directory if it doesn't exist.
+// A change that was only partly written to the end of the log, because the broker stopped while
+// writing it, is discarded.
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	store := &FileStore{
+		dir:      dir,
+		sessions: make(map[string]*fileStoreSession),
+		retained: make(map[string]StoredRetained),
+	}
+	if err := store.readSnapshot(); err != nil {
+		return nil, err
+	}
+
+	logFile, err := os.OpenFile(filepath.Join(dir, logFilename), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.replayLog(logFile); err != nil {
+		logFile.Close()
+		return nil, err
+	}
+	store.logFile = logFile
+	store.logWriter = bufio.NewWriter(logFile)
+	return store, nil
+}
+
+func (store *FileStore) readSnapshot() error {
+	snapshot, err := os.ReadFile(filepath.Join(store.dir, snapshotFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	state := StoredState{}
+	if err := json.Unmarshal(snapshot, &state); err != nil {
+		return fmt.Errorf("error: the snapshot in %v is corrupt: %w", store.dir, err)
+	}
+	for _, session := range state.Sessions {
+		store.apply(logRecord{Op: opSaveSession, ClientID: session.ClientID})
+		for _, topic := range session.Subscriptions {
+			store.apply(logRecord{Op: opSaveSubscription, ClientID: session.ClientID,
+				Topic: topic.TopicFilter, Qos: topic.Qos})
+		}
+		for _, message := range session.Messages {
+			store.apply(logRecord{Op: opSaveMessage, ClientID: session.ClientID,
+				PacketID: message.PacketID, Packet: message.Packet, Released: message.Released})
+		}
+		for _, packetID := range session.AwaitingRelease {
+			store.apply(logRecord{Op: opSaveAwaitingRelease, ClientID: session.ClientID, PacketID: packetID})
+		}
+	}
+	for _, retained := range state.Retained {
+		store.apply(logRecord{Op: opSaveRetained, Topic: retained.TopicName, Qos: retained.Qos,
+			Packet: retained.Message})
+	}
+	return nil
+}
+
+// replayLog applies every change in the log, and leaves the file ready to be appended to
+func (store *FileStore) replayLog(logFile *os.File) error {
+	reader := bufio.NewReader(logFile)
+	var validLength int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("- Discarding a partly written change at the end of %v\n", logFile.Name())
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		record := logRecord{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("error: the log in %v is corrupt: %w", store.dir, err)
+		}
+		store.apply(record)
+		store.changes++
+		validLength += int64(len(line))
+	}
+
+	if err := logFile.Truncate(validLength); err != nil {
+		return err
+	}
+	_, err := logFile.Seek(validLength, io.SeekStart)
+	return err
+}
+
+// apply makes a change to the state held in memory. The lock must be held when calling this.
+func (store *FileStore) apply(record logRecord) {
+	session := store.sessions[record.ClientID]
+	switch record.Op {
+	case opSaveSession:
+		if session == nil {
+			store.sessions[record.ClientID] = &fileStoreSession{
+				subscriptions:   make(map[string]byte),
+				messages:        make(map[int]*fileStoreMessage),
+				awaitingRelease: make(map[int]struct{}),
+			}
+		}
+	case opDeleteSession:
+		delete(store.sessions, record.ClientID)
+	case opSaveRetained:
+		store.retained[record.Topic] = StoredRetained{TopicName: record.Topic, Qos: record.Qos, Message: record.Packet}
+	case opDeleteRetained:
+		delete(store.retained, record.Topic)
+	}
+	// The rest of the changes are to a session, which has to have been saved first
+	if session == nil {
+		return
+	}
+
+	switch record.Op {
+	case opSaveSubscription:
+		session.subscriptions[record.Topic] = record.Qos
+	case opDeleteSubscription:
+		delete(session.subscriptions, record.Topic)
+	case opSaveMessage:
+		message := StoredMessage{PacketID: record.PacketID, Packet: record.Packet, Released: record.Released}
+		if existing := session.messages[record.PacketID]; existing != nil {
+			existing.StoredMessage = message
+			break
+		}
+		store.lastSequence++
+		session.messages[record.PacketID] = &fileStoreMessage{StoredMessage: message, sequence: store.lastSequence}
+	case opDeleteMessage:
+		delete(session.messages, record.PacketID)
+	case opSaveAwaitingRelease:
+		session.awaitingRelease[record.PacketID] = struct{}{}
+	case opDeleteAwaitingRelease:
+		delete(session.awaitingRelease, record.PacketID)
+	}
+}
+
+// write applies a change and appends it to the log. Once enough changes have been
+// written a snapshot is taken.
+func (store *FileStore) write(record logRecord) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.logFile == nil {
+		return errors.New("error: the store has been closed")
+	}
+	store.apply(record)
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := store.logWriter.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := store.logWriter.Flush(); err != nil {
+		return err
+	}
+
+	store.changes++
+	if store.changes >= SnapshotAfter {
+		return store.snapshot()
+	}
+	return nil
+}
+
+// Snapshot writes the whole state to the snapshot file and empties the log
+func (store *FileStore) Snapshot() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.logFile == nil {
+		return errors.New("error: the store has been closed")
+	}
+	return store.snapshot()
+}
+
+// snapshot must be called with the lock held. The snapshot replaces the old one in a single
+// rename, so there is always a whole snapshot on disk. If the broker stops before the log is
+// emptied, the changes in the log are applied again to the new snapshot, which leaves it as it was.
+func (store *FileStore) snapshot() error {
+	snapshot, err := json.Marshal(store.state())
+	if err != nil {
+		return err
+	}
+
+	snapshotPath := filepath.Join(store.dir, snapshotFilename)
+	tempFile, err := os.CreateTemp(store.dir, snapshotFilename+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err := tempFile.Write(snapshot); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile.Name(), snapshotPath); err != nil {
+		return err
+	}
+
+	if err := store.logFile.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := store.logFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	store.changes = 0
+	return store.logFile.Sync()
+}
+
+// state returns a copy of the state held in memory. The lock must be held when calling this.
+func (store *FileStore) state() *StoredState {
+	state := &StoredState{
+		Sessions: make([]StoredSession, 0, len(store.sessions)),
+		Retained: make([]StoredRetained, 0, len(store.retained)),
+	}
+	for clientID, session := range store.sessions {
+		storedSession := StoredSession{
+			ClientID:      clientID,
+			Subscriptions: make([]clients.Topic, 0, len(session.subscriptions)),
+			Messages:      make([]StoredMessage, 0, len(session.messages)),
+		}
+		for topicFilter, qos := range session.subscriptions {
+			storedSession.Subscriptions = append(storedSession.Subscriptions, clients.Topic{TopicFilter: topicFilter, Qos: qos})
+		}
+
+		messages := make([]*fileStoreMessage, 0, len(session.messages))
+		for _, message := range session.messages {
+			messages = append(messages, message)
+		}
+		sort.Slice(messages, func(i, j int) bool {
+			return messages[i].sequence < messages[j].sequence
+		})
+		for _, message := range messages {
+			storedSession.Messages = append(storedSession.Messages, message.StoredMessage)
+		}
+		for packetID := range session.awaitingRelease {
+			storedSession.AwaitingRelease = append(storedSession.AwaitingRelease, packetID)
+		}
+		sort.Ints(storedSession.AwaitingRelease)
+		state.Sessions = append(state.Sessions, storedSession)
+	}
+	for _, retained := range store.retained {
+		state.Retained = append(state.Retained, retained)
+	}
+	return state
+}
+
+// Load implements the Store interface
+func (store *FileStore) Load() (*StoredState, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.state(), nil
+}
+
+// SaveSession implements the Store interface. Sessions that are already saved aren't written again.
+func (store *FileStore) SaveSession(clientID string) error {
+	if store.hasSession(clientID) {
+		return nil
+	}
+	return store.write(logRecord{Op: opSaveSession, ClientID: clientID})
+}
+
+// DeleteSession implements the Store interface. Nothing is written for sessions that aren't saved,
+// so it can be called for every client with a clean session.
+func (store *FileStore) DeleteSession(clientID string) error {
+	if !store.hasSession(clientID) {
+		return nil
+	}
+	return store.write(logRecord{Op: opDeleteSession, ClientID: clientID})
+}
+
+func (store *FileStore) hasSession(clientID string) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.sessions[clientID] != nil
+}
+
+// SaveSubscription implements the Store interface
+func (store *FileStore) SaveSubscription(clientID string, topic clients.Topic) error {
+	return store.write(logRecord{Op: opSaveSubscription, ClientID: clientID, Topic: topic.TopicFilter, Qos: topic.Qos})
+}
+
+// DeleteSubscription implements the Store interface
+func (store *FileStore) DeleteSubscription(clientID string, topicFilter string) error {
+	return store.write(logRecord{Op: opDeleteSubscription, ClientID: clientID, Topic: topicFilter})
+}
+
+// SaveMessage implements the Store interface
+func (store *FileStore) SaveMessage(clientID string, message StoredMessage) error {
+	return store.write(logRecord{Op: opSaveMessage, ClientID: clientID, PacketID: message.PacketID,
+		Packet: message.Packet, Released: message.Released})
+}
+
+// DeleteMessage implements the Store interface
+func (store *FileStore) DeleteMessage(clientID string, packetID int) error {
+	return store.write(logRecord{Op: opDeleteMessage, ClientID: clientID, PacketID: packetID})
+}
+
+// SaveAwaitingRelease implements the Store interface
+func (store *FileStore) SaveAwaitingRelease(clientID string, packetID int) error {
+	return store.write(logRecord{Op: opSaveAwaitingRelease, ClientID: clientID, PacketID: packetID})
+}
+
+// DeleteAwaitingRelease implements the Store interface
+func (store *FileStore) DeleteAwaitingRelease(clientID string, packetID int) error {
+	return store.write(logRecord{Op: opDeleteAwaitingRelease, ClientID: clientID, PacketID: packetID})
+}
+
+// SaveRetained implements the Store interface
+func (store *FileStore) SaveRetained(message StoredRetained) error {
+	return store.write(logRecord{Op: opSaveRetained, Topic: message.TopicName, Qos: message.Qos, Packet: message.Message})
+}
+
+// DeleteRetained implements the Store interface
+func (store *FileStore) DeleteRetained(topicName string) error {
+	return store.write(logRecord{Op: opDeleteRetained, Topic: topicName})
+}
+
+// Close implements the Store interface. It takes a snapshot, so the log is empty the next time the store is opened.
+// Closing a FileStore more than once does nothing.
+func (store *FileStore) Close() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.logFile == nil {
+		return nil
+	}
+	err := store.snapshot()
+	if closeErr := store.logFile.Close(); err == nil {
+		err = closeErr
+	}
+	store.logFile = nil
+	return err
+}
@@ -0,0 +1,85 @@
+package gobro
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HtpasswdAuthenticator is an Authenticator that checks credentials against an htpasswd style file.
+// Every line of the file is a username and a bcrypt hash separated by a colon, for example one
+// created with `htpasswd -B`. Blank lines and lines starting with # are ignored.
+type HtpasswdAuthenticator struct {
+	filename string
+	lock     sync.RWMutex
+	users    map[string][]byte
+}
+
+// NewHtpasswdAuthenticator creates an HtpasswdAuthenticator by reading the given file
+func NewHtpasswdAuthenticator(filename string) (*HtpasswdAuthenticator, error) {
+	authenticator := &HtpasswdAuthenticator{filename: filename}
+	err := authenticator.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return authenticator, nil
+}
+
+// Reload reads the file again, so that changes to it take effect.
+// If the file can't be read, the users from the last successful read are kept.
+func (authenticator *HtpasswdAuthenticator) Reload() error {
+	file, err := os.Open(authenticator.filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, found := strings.Cut(line, ":")
+		if !found || username == "" {
+			return fmt.Errorf("error: malformed line %v in %v", lineNumber, authenticator.filename)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("error: line %v in %v isn't a bcrypt hash: %w", lineNumber, authenticator.filename, err)
+		}
+		users[username] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	authenticator.lock.Lock()
+	authenticator.users = users
+	authenticator.lock.Unlock()
+	return nil
+}
+
+// Authenticate implements the Authenticator interface
+func (authenticator *HtpasswdAuthenticator) Authenticate(_ string, username string, password []byte) error {
+	if username == "" {
+		return ErrNotAuthorized
+	}
+	authenticator.lock.RLock()
+	hash, found := authenticator.users[username]
+	authenticator.lock.RUnlock()
+
+	if !found {
+		return ErrBadUsernameOrPassword
+	}
+	err := bcrypt.CompareHashAndPassword(hash, password)
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrBadUsernameOrPassword
+	}
+	return err
+}
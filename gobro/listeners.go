@@ -0,0 +1,77 @@
+package gobro
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+
+	"MQTT-GO/network"
+)
+
+// ListenerConfig describes an endpoint the server accepts connections on, and the settings for it.
+type ListenerConfig struct {
+	// Transport is the transport protocol, e.g. network.TCP or network.QUIC
+	Transport byte
+	IP        string
+	Port      int
+	// TLSConfig is used by TLS listeners, and must have a certificate. Clients that connect with a
+	// certificate it verifies are authenticated by it, and are known by the certificate's Common Name.
+	TLSConfig *tls.Config
+	// WebSocketPath is the HTTP path WebSocket listeners serve on, network.DefaultWebSocketPath if it is empty
+	WebSocketPath string
+}
+
+// String returns the transport and address of the listener
+func (config ListenerConfig) String() string {
+	return fmt.Sprintf("%v on %v:%v", network.TransportNames[config.Transport], config.IP, config.Port)
+}
+
+// newListener creates a listener with the config's settings
+func (config ListenerConfig) newListener() (network.Listener, error) {
+	switch config.Transport {
+	case network.TLS:
+		return network.NewTLSListener(config.TLSConfig), nil
+	case network.WebSocket:
+		path := config.WebSocketPath
+		if path == "" {
+			path = network.DefaultWebSocketPath
+		}
+		return network.NewWebSocketListener(path), nil
+	default:
+		return network.NewListener(config.Transport)
+	}
+}
+
+// openListeners starts listening on every endpoint. If any of them fails, the ones that
+// were already opened are closed again. It must be called with the listenersLock held.
+func (server *Server) openListeners() error {
+	for _, config := range server.options.Listeners {
+		listener, err := config.newListener()
+		if err == nil {
+			err = listener.Listen(config.IP, config.Port)
+		}
+		if err != nil {
+			log.Printf("- Error while trying to listen for %v: %v\n", config, err)
+			server.println("Error while trying to listen for", config, err)
+			for _, opened := range server.listeners {
+				opened.Close()
+			}
+			server.listeners = nil
+			return err
+		}
+		server.println("Listening for connections via", config)
+		server.listeners = append(server.listeners, listener)
+	}
+	return nil
+}
+
+// closeListeners stops accepting connections on every endpoint
+func (server *Server) closeListeners() {
+	server.listenersLock.Lock()
+	defer server.listenersLock.Unlock()
+
+	for _, listener := range server.listeners {
+		listener.Close()
+	}
+	server.listeners = nil
+}
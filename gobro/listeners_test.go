@@ -0,0 +1,68 @@
+package gobro_test
+
+import (
+	"bufio"
+	"context"
+	"testing"
+
+	"MQTT-GO/gobro"
+	"MQTT-GO/network"
+	"MQTT-GO/packets"
+)
+
+func TestClientsOnDifferentListenersShareTopics(t *testing.T) {
+	opts := tcpOptions(8021)
+	opts.Listeners = append(opts.Listeners, gobro.ListenerConfig{Transport: network.UDP, IP: "localhost", Port: 8020})
+	startServer(t, opts)
+
+	subscriber, reader := connectRawClient(t, "tcp-subscriber", 8021)
+	defer subscriber.Close()
+	subscribe, _ := packets.EncodeSubscribe(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.SUBSCRIBE, Flags: 2},
+		&packets.SubscribeVariableHeader{PacketIdentifier: 1},
+		&packets.PacketPayload{RawApplicationMessage: []byte{0, 7, 's', 'e', 'n', 's', 'o', 'r', 's', 0}},
+	))
+	_, err := subscriber.Write(subscribe)
+	testErr(t, err)
+	readPacketOfType(t, reader, packets.SUBACK)
+
+	publisher, err := network.NewConn(network.UDP)
+	testErr(t, err)
+	testErr(t, publisher.Connect("localhost", 8020))
+	defer publisher.Close()
+	connect, err := packets.EncodeConnect(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.CONNECT},
+		&packets.ConnectVariableHeader{KeepAlive: 60, ConnectFlags: packets.CleanSessionFlag},
+		&packets.PacketPayload{ClientID: "udp-publisher"},
+	))
+	testErr(t, err)
+	_, err = publisher.Write(connect)
+	testErr(t, err)
+	readPacketOfType(t, bufio.NewReader(publisher), packets.CONNACK)
+
+	publish, err := packets.CreatePublish("sensors", 0, 0, []byte("21"))
+	testErr(t, err)
+	_, err = publisher.Write(publish)
+	testErr(t, err)
+	received := readPacketOfType(t, reader, packets.PUBLISH)
+	if string(received.Payload.RawApplicationMessage) != "21" {
+		t.Error("Expected 21, got", string(received.Payload.RawApplicationMessage))
+	}
+}
+
+func TestListenersAreClosedIfOneFails(t *testing.T) {
+	opts := tcpOptions(8022)
+	// Both listeners use the same port, so the second can't listen
+	opts.Listeners = append(opts.Listeners, gobro.ListenerConfig{Transport: network.TCP, IP: "localhost", Port: 8022})
+	server := gobro.NewServer(opts)
+	if err := server.Start(context.Background()); err == nil {
+		t.Fatal("Server started with a listener that couldn't listen")
+	}
+	listener, err := network.NewListener(network.TCP)
+	testErr(t, err)
+	if err := listener.Listen("localhost", 8022); err != nil {
+		t.Error("The listener that opened wasn't closed:", err)
+	} else {
+		listener.Close()
+	}
+}
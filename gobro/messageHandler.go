@@ -1,6 +1,7 @@
 package gobro
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -28,12 +29,18 @@ func CreateMessageHandler(inputChan *chan clients.ClientMessage,
 }
 
 // Listen listens for incoming packets, decodes them and then runs the HandleMessage function
-// in a separate goroutine.
+// in a separate goroutine. It returns once the server has shut down.
 func (msgH *MessageHandler) Listen(server *Server) {
 	clientTable := server.clientTable
 
 	for {
-		clientMessage := <-(*msgH.AttachedInputChan)
+		var clientMessage clients.ClientMessage
+		select {
+		case clientMessage = <-(*msgH.AttachedInputChan):
+		case <-server.halted:
+			return
+		}
+		server.metrics.countReceived(clientMessage.Packet)
 		clientID := *clientMessage.ClientID
 		client := clientTable.Get(clientID)
 
@@ -43,10 +50,11 @@ func (msgH *MessageHandler) Listen(server *Server) {
 			continue
 		}
 
-		ticket := client.Tickets.GetTicket()
+		_, tickets := client.Connection()
+		ticket := tickets.GetTicket()
 		packetArray := clientMessage.Packet
 		packetType := packets.GetPacketType(packetArray)
-		if PrintOutput {
+		if server.options.PrintOutput {
 			fmt.Println(fmt.Sprintln("RECEIVED", packets.PacketTypeName(packetType)))
 		}
 
@@ -55,15 +63,22 @@ func (msgH *MessageHandler) Listen(server *Server) {
 			if !clientTable.Contains(clientID) {
 				log.Printf("Client '%v' not in the client table sent %v message, disconnecting.\n",
 					clientID, packets.PacketTypeName(packetType))
-				structures.Printf("Client '%v' not in the client table sent %v message, disconnecting.\n",
+				server.printf("Client '%v' not in the client table sent %v message, disconnecting.\n",
 					clientID, packets.PacketTypeName(packetType))
 
 				// If the client hasn't already been disconnected by the client handler
-				client.NetworkConnection.Close()
+				if connection, _ := client.Connection(); connection != nil {
+					connection.Close()
+				}
 				continue
 			}
 		}
-		go HandleMessage(packetType, packetArray, client, server, clientMessage, ticket)
+		// Shutdown waits for every packet that is being handled to be sent
+		server.handling.Add(1)
+		go func() {
+			defer server.handling.Add(-1)
+			HandleMessage(packetType, packetArray, client, server, clientMessage, ticket)
+		}()
 	}
 }
 
@@ -83,6 +98,11 @@ func HandleMessage(packetType byte, packetArray []byte, client *clients.Client,
 
 	clientConnection := clientMessage.ClientConnection
 	packetsToSend := make([]*clients.ClientMessage, 0, 10)
+	// followingPackets are sent one at a time, in order, once everything in packetsToSend has been sent
+	followingPackets := make([]*clients.ClientMessage, 0)
+	// Retained messages are only stored once it's this packet's turn, so that
+	// a client's retained messages are stored in the order they were published
+	var retainedUpdate *retainedMessage
 	topicTrie := server.topicTrie
 
 	defer ticket.Complete()
@@ -92,10 +112,18 @@ func HandleMessage(packetType byte, packetArray []byte, client *clients.Client,
 		// Check if the reserved flag is zero, if not disconnect them
 		// Finally send out a CONACK [X]
 
-		connack := packets.CreateConnACK(false, 0)
+		server.saveSession(client)
+		connack := packets.CreateConnACK(client.SessionPresent(), 0)
 		clientMsg := clients.CreateClientMessage(clientID, clientConnection, connack)
 		packetsToSend = append(packetsToSend, &clientMsg)
 
+		// Messages that were inflight or queued while a persistent session was
+		// offline are sent once the client has its CONNACK
+		for _, pending := range client.PendingMessages() {
+			pendingMsg := clients.CreateClientMessage(clientID, clientConnection, pending)
+			followingPackets = append(followingPackets, &pendingMsg)
+		}
+
 	case packets.PUBLISH:
 
 		varHeader, ok := packet.VariableLengthHeader.(*packets.PublishVariableHeader)
@@ -105,33 +133,96 @@ func HandleMessage(packetType byte, packetArray []byte, client *clients.Client,
 		}
 		topic := clients.Topic{
 			TopicFilter: varHeader.TopicFilter,
-			Qos:         packet.ControlHeader.Flags & 6,
+			Qos:         packets.GetQoS(packet.ControlHeader.Flags),
+		}
+		if topic.Qos > 2 {
+			log.Printf("- Client '%v' published with invalid QoS %v, disconnecting\n", clientID, topic.Qos)
+			go client.DisconnectConnection(clientConnection, topicTrie, clientTable)
+			break
 		}
 
 		messageToPrint := packet.Payload.RawApplicationMessage[:structures.Min(len(packet.Payload.RawApplicationMessage), 20)]
 		structures.Println("Received request to publish:", string(messageToPrint), "to topic:", topic.TopicFilter)
 
-		// Adds to the packets to send
-		handlePublish(topicTrie, topic, clientMessage, server.clientTable, &packetsToSend)
+		// A QoS 2 message we've already forwarded, but that the client hasn't released
+		// yet, is a duplicate. We only reply with another PUBREC.
+		alreadyReceived := topic.Qos == 2 && client.AwaitingRelease.Contains(varHeader.PacketIdentifier)
+		// Unauthorized publishes are still acknowledged, but they are dropped
+		authorized := server.canPublish(client, topic.TopicFilter)
+		if !alreadyReceived && authorized {
+			if packet.ControlHeader.Flags&packets.RetainFlag != 0 {
+				retainedUpdate = &retainedMessage{
+					topicName:          topic.TopicFilter,
+					qos:                topic.Qos,
+					applicationMessage: packet.Payload.RawApplicationMessage,
+				}
+				// Clients with existing subscriptions receive the message without the RETAIN flag
+				clientMessage.Packet[0] &^= packets.RetainFlag
+			}
+			// Adds to the packets to send
+			server.handlePublish(topic, varHeader.PacketIdentifier, packet.Payload.RawApplicationMessage,
+				retainedUpdate != nil, clientMessage, &packetsToSend)
+		}
+
+		var acknowledgement []byte
+		switch topic.Qos {
+		case 1:
+			acknowledgement = packets.CreatePubAck(varHeader.PacketIdentifier)
+		case 2:
+			if !alreadyReceived {
+				client.AwaitingRelease.Put(varHeader.PacketIdentifier, struct{}{})
+				server.saveAwaitingRelease(client, varHeader.PacketIdentifier)
+			}
+			acknowledgement = packets.CreatePubRec(varHeader.PacketIdentifier)
+		}
+		if acknowledgement != nil {
+			clientMsg := clients.CreateClientMessage(clientID, clientConnection, acknowledgement)
+			packetsToSend = append(packetsToSend, &clientMsg)
+		}
+
+	case packets.PUBACK, packets.PUBCOMP:
+		// The client has received a message we sent them, so we can stop redelivering it
+		packetID := packet.VariableLengthHeader.(*packets.PubackVariableHeader).PacketIdentifier
+		client.AcknowledgeMessage(packetID)
+		server.deleteMessage(client, packetID)
+
+	case packets.PUBREC:
+		// The client has received a QoS 2 message we sent them, we release it with a PUBREL
+		packetID := packet.VariableLengthHeader.(*packets.PubackVariableHeader).PacketIdentifier
+		if pubrel := client.ReleaseMessage(packetID); pubrel != nil {
+			if inflightMessage := client.Inflight.Get(packetID); inflightMessage != nil {
+				server.saveMessage(client, packetID, inflightMessage.Packet, true)
+			}
+			clientMsg := clients.CreateClientMessage(clientID, clientConnection, pubrel)
+			packetsToSend = append(packetsToSend, &clientMsg)
+		}
+
+	case packets.PUBREL:
+		// The client has released a QoS 2 message, so any new PUBLISH with
+		// this identifier is a new message
+		packetID := packet.VariableLengthHeader.(*packets.PubackVariableHeader).PacketIdentifier
+		client.AwaitingRelease.Delete(packetID)
+		server.deleteAwaitingRelease(client, packetID)
+		pubcomp := packets.CreatePubComp(packetID)
+		clientMsg := clients.CreateClientMessage(clientID, clientConnection, pubcomp)
+		packetsToSend = append(packetsToSend, &clientMsg)
 
 	case packets.SUBSCRIBE:
 		// Add the client to the topic in the subscription table
-		topics, err := handleSubscribe(topicTrie, client, *packet.Payload)
+		topics, returnCodes, err := handleSubscribe(topicTrie, client, *packet.Payload, server.options.Authorizer)
 		if err != nil {
 			log.Printf("Error during subscribe: %v, from client '%v'\n", err, clientID)
 			return
 		}
 
-		// Get the return code for every topic
-		returnCodes := make([]byte, len(topics))
-		for i, topic := range topics {
-			returnCodes[i] = topic.Qos
-		}
+		server.saveSubscriptions(client, topics)
 
 		packetID := packet.VariableLengthHeader.(*packets.SubscribeVariableHeader).PacketIdentifier
 		subackPacket := packets.CreateSubACK(packetID, returnCodes)
 		clientMsg := clients.CreateClientMessage(clientID, clientConnection, subackPacket)
 		packetsToSend = append(packetsToSend, &clientMsg)
+		// Retained messages must arrive after the SUBACK
+		server.sendRetained(client, topics, &followingPackets)
 
 	case packets.UNSUBSCRIBE:
 		packetID := packet.VariableLengthHeader.(*packets.UnsubscribeVariableHeader).PacketIdentifier
@@ -140,15 +231,20 @@ func HandleMessage(packetType byte, packetArray []byte, client *clients.Client,
 		for _, topic := range packet.Payload.TopicList {
 			topics = append(topics, topic.Topic)
 		}
-		handleUnsubscribe(topics, topicTrie, *client)
+		handleUnsubscribe(topics, topicTrie, client)
+		server.deleteSubscriptions(client, topics)
 		unsubackPacket := packets.CreateUnSuback(packetID)
 		clientMsg := clients.CreateClientMessage(clientID, clientConnection, unsubackPacket)
 		packetsToSend = append(packetsToSend, &clientMsg)
 
+	case packets.PINGREQ:
+		clientMsg := clients.CreateClientMessage(clientID, clientConnection, packets.CreatePingResp())
+		packetsToSend = append(packetsToSend, &clientMsg)
+
 	case packets.DISCONNECT:
 		// Close the client connection.
 		// Remove the packet from the client list
-		go client.Disconnect(topicTrie, clientTable)
+		go client.DisconnectConnection(clientConnection, topicTrie, clientTable)
 	}
 
 	// If we have packets to send - we have to wait
@@ -156,21 +252,40 @@ func HandleMessage(packetType byte, packetArray []byte, client *clients.Client,
 	ticket.StopTiming()
 	ticket.Wait()
 
-	if len(packetsToSend) > 0 {
-		waitGroup := sync.WaitGroup{}
-		waitGroup.Add(len(packetsToSend))
-		for _, packet := range packetsToSend {
-			packet.OutputWaitGroup = &waitGroup
-			(*server.outputChan) <- *packet
-		}
-		waitGroup.Wait()
+	if retainedUpdate != nil {
+		server.storeRetained(retainedUpdate.topicName, retainedUpdate.qos, retainedUpdate.applicationMessage)
+	}
+
+	sendAndWait(server.outputChan, packetsToSend)
+	for _, packet := range followingPackets {
+		sendAndWait(server.outputChan, []*clients.ClientMessage{packet})
 	}
 }
 
+// sendAndWait passes the packets to the MessageSender and waits for all of them to be sent.
+// Packets within the same call can be sent in any order.
+func sendAndWait(outputChan *chan clients.ClientMessage, packetsToSend []*clients.ClientMessage) {
+	if len(packetsToSend) == 0 {
+		return
+	}
+	waitGroup := sync.WaitGroup{}
+	waitGroup.Add(len(packetsToSend))
+	for _, packet := range packetsToSend {
+		packet.OutputWaitGroup = &waitGroup
+		(*outputChan) <- *packet
+	}
+	waitGroup.Wait()
+}
+
 // Decode topics and store them in subscription table.
-func handleSubscribe(topicTrie *clients.TopicTrie,
-	client *clients.Client, packetPayload packets.PacketPayload) ([]clients.Topic, error) {
+// Returns the topics the client was subscribed to, and the SUBACK return code for every
+// requested topic. Topics the authorizer denies get a return code of 0x80.
+// $share/<group>/<filter> topics subscribe the client to a shared subscription, where each
+// message is sent to only one member of the group.
+func handleSubscribe(topicTrie *clients.TopicTrie, client *clients.Client, packetPayload packets.PacketPayload,
+	authorizer Authorizer) ([]clients.Topic, []byte, error) {
 	newTopics := make([]clients.Topic, 0)
+	returnCodes := make([]byte, 0)
 	payload := packetPayload.RawApplicationMessage
 	topicNumber, offset := 0, 0
 
@@ -180,24 +295,45 @@ func handleSubscribe(topicTrie *clients.TopicTrie,
 		topicFilter, utfStringLen, err := packets.DecodeUTFString(payload[offset:])
 		if err != nil {
 			structures.Println("Error decoding UTF string")
-			return nil, err
+			return nil, nil, err
 		}
 
 		requestedQOS := payload[offset+utfStringLen]
+		topicNumber++
+		offset += utfStringLen + 1
+
+		// Members of a shared subscription are authorized for the filter they share
+		authorizedFilter := topicFilter
+		if clients.IsSharedFilter(topicFilter) {
+			_, filter, ok := clients.SplitSharedFilter(topicFilter)
+			if !ok {
+				log.Printf("- Client '%v' tried to subscribe to invalid shared subscription '%v'\n",
+					client.ClientIdentifier, topicFilter)
+				returnCodes = append(returnCodes, packets.SubackFailure)
+				continue
+			}
+			authorizedFilter = filter
+		}
+
+		if authorizer != nil &&
+			!authorizer.CanSubscribe(string(client.ClientIdentifier), client.Settings().Username, authorizedFilter) {
+			log.Printf("- Client '%v' isn't authorized to subscribe to '%v'\n", client.ClientIdentifier, topicFilter)
+			returnCodes = append(returnCodes, packets.SubackFailure)
+			continue
+		}
 
 		topic := clients.Topic{
 			TopicFilter: topicFilter,
 			Qos:         requestedQOS,
 		}
 		newTopics = append(newTopics, topic)
-		topicNumber++
-		offset += utfStringLen + 1
+		returnCodes = append(returnCodes, requestedQOS)
 
 		if !topicTrie.Contains(topic.TopicFilter) {
 			err = topicTrie.AddTopic(topic.TopicFilter)
 			if err != nil {
 				log.Printf("- Error while adding new topic %v, the topic name was '%v'\n", err, topicFilter)
-				return nil, err
+				return nil, nil, err
 			}
 		}
 	}
@@ -207,18 +343,18 @@ func handleSubscribe(topicTrie *clients.TopicTrie,
 
 	for _, newTopic := range newTopics {
 		client.AddTopic(newTopic)
-		err := topicTrie.Put(newTopic.TopicFilter, client.ClientIdentifier)
+		err := topicTrie.PutWithQoS(newTopic.TopicFilter, client.ClientIdentifier, newTopic.Qos)
 		if err != nil {
 			log.Printf("- Error while adding new topic %v, the topic name was '%v'\n", err, newTopic.TopicFilter)
-			return nil, err
+			return nil, nil, err
 		}
 		structures.PrintCentrally("SUBSCRIBED TO ", newTopic.TopicFilter)
 	}
 
-	return newTopics, nil
+	return newTopics, returnCodes, nil
 }
 
-func handleUnsubscribe(topics []string, topicToSubscribers *clients.TopicTrie, client clients.Client) {
+func handleUnsubscribe(topics []string, topicToSubscribers *clients.TopicTrie, client *clients.Client) {
 	topicToSubscribers.Unsubscribe(client.ClientIdentifier, topics...)
 	for _, topic := range topics {
 		err := client.RemoveTopic(clients.Topic{TopicFilter: topic})
@@ -226,11 +362,17 @@ func handleUnsubscribe(topics []string, topicToSubscribers *clients.TopicTrie, c
 	}
 }
 
-// Augments the toSend array in place
-func handlePublish(tCMap *clients.TopicTrie, topic clients.Topic, msgToForward clients.ClientMessage,
-	clientTable *structures.SafeMap[clients.ClientID, *clients.Client], toSend *[]*clients.ClientMessage) {
-	clientList, err := tCMap.GetMatchingClients(topic.TopicFilter)
+// Augments the toSend array in place. Subscribers are sent the message without the RETAIN flag,
+// but bridges forward retained messages as retained.
+func (server *Server) handlePublish(topic clients.Topic, packetID int, applicationMessage []byte, retain bool,
+	msgToForward clients.ClientMessage, toSend *[]*clients.ClientMessage) {
+	server.forwardToBridges(*msgToForward.ClientID, topic.TopicFilter, topic.Qos, retain, applicationMessage)
+	clientList, err := server.topicTrie.GetMatchingClients(topic.TopicFilter)
 
+	// Nobody is subscribed to the topic
+	if errors.Is(err, clients.ErrTopicDoesntExist) {
+		return
+	}
 	if err != nil {
 		log.Printf("- Error while getting matching clients during a publish to '%v' by '%v': %v\n",
 			topic.TopicFilter, *msgToForward.ClientID, err)
@@ -241,19 +383,60 @@ func handlePublish(tCMap *clients.TopicTrie, topic clients.Topic, msgToForward c
 
 	// For every client that is subscribed to the topic, create a new message to send to them
 	for clientNode != nil {
-		clientID := clientNode.Value()
-		alteredMsg := msgToForward
-		alteredMsg.ClientID = &clientID
-
-		if client := clientTable.Get(clientID); client != nil {
-			alteredMsg.ClientConnection = client.NetworkConnection
-		} else {
+		subscription := clientNode.Value()
+		clientID := subscription.ClientID
+		client := server.clientTable.Get(clientID)
+		if client == nil {
 			log.Printf("- Error: Can't find subscribed client '%v' in clientTable\n", clientID)
 			clientNode = clientNode.Next()
 			continue
 		}
 
-		(*toSend) = append(*toSend, &alteredMsg)
+		// Bridges aren't sent their own messages, which would loop back to the broker they came from
+		if client.Settings().Bridge && clientID == *msgToForward.ClientID {
+			clientNode = clientNode.Next()
+			continue
+		}
+
+		// The subscriber's access may have been revoked since it subscribed
+		if !server.canReceive(client, topic.TopicFilter) {
+			clientNode = clientNode.Next()
+			continue
+		}
+
+		// Messages are delivered at the lower of the publish QoS and the subscription QoS
+		qos := structures.Min(topic.Qos, subscription.Qos)
+		connection, _ := client.Connection()
+
+		switch {
+		case !client.IsConnected():
+			// Clients with a persistent session get QoS 1 and 2 messages when they reconnect
+			server.queueOfflineMessage(client, topic.TopicFilter, qos, applicationMessage)
+		case topic.Qos == 0:
+			// QoS 0 messages can be forwarded as they are
+			alteredMsg := msgToForward
+			alteredMsg.ClientID = &clientID
+			alteredMsg.ClientConnection = connection
+			(*toSend) = append(*toSend, &alteredMsg)
+		case qos == 0:
+			// Downgraded messages need re-encoding without the publisher's QoS flags
+			publish, err := packets.CreatePublish(topic.TopicFilter, packetID, 0, applicationMessage)
+			if err != nil {
+				log.Printf("- Error while creating publish for '%v': %v\n", clientID, err)
+				break
+			}
+			alteredMsg := clients.CreateClientMessage(clientID, connection, publish)
+			(*toSend) = append(*toSend, &alteredMsg)
+		default:
+			// Otherwise the subscriber needs its own packet identifier so that it can acknowledge the message
+			alteredMsg, err := server.createInflightPublish(client, topic.TopicFilter, qos, false, applicationMessage)
+			if err != nil {
+				log.Printf("- Error while creating publish for '%v': %v\n", clientID, err)
+			} else {
+				(*toSend) = append(*toSend, alteredMsg)
+			}
+		}
+
 		clientNode = clientNode.Next()
 	}
 }
@@ -4,7 +4,6 @@ import (
 	"MQTT-GO/gobro/clients"
 	"MQTT-GO/network"
 	"MQTT-GO/packets"
-	"fmt"
 	"sync"
 	"time"
 )
@@ -23,7 +22,7 @@ func CreateMessageSender(outputPool *chan clients.ClientMessage) MessageSender {
 
 // ListenAndSend listens for outgoing packets, finds the appropriate client and sends them.
 // It waits for a ticket to be available before sending the packet to ensure messages.
-// are sent in the correct order
+// are sent in the correct order. It returns once the server has shut down.
 func (MessageSender) ListenAndSend(server *Server) {
 	const maxMessageSenders = 8000
 	queue := make(chan struct{}, maxMessageSenders)
@@ -33,41 +32,52 @@ func (MessageSender) ListenAndSend(server *Server) {
 	}
 
 	for {
-		clientMsg := <-(*server.outputChan)
+		var clientMsg clients.ClientMessage
+		select {
+		case clientMsg = <-(*server.outputChan):
+		case <-server.halted:
+			return
+		}
 
 		clientID := *clientMsg.ClientID
 		client := server.clientTable.Get(clientID)
 		if client == nil {
-			fmt.Println("Nil client")
+			server.println("Nil client")
+			// The message handler is still waiting for this message to be sent
+			if clientMsg.OutputWaitGroup != nil {
+				clientMsg.OutputWaitGroup.Done()
+			}
 			continue
 		}
 		// Wait for there to be space in the queue (when a thread has finished and added to it)
 		<-queue
-		go waitAndSend(&clientMsg, clientMsg.OutputWaitGroup, queue)
+		go server.waitAndSend(&clientMsg, clientMsg.OutputWaitGroup, queue)
 		// We look up the client rather than using the connection directly
 		// This is to ensure we get an error if the client doesn't exist
 	}
 }
 
-func waitAndSend(clientMsg *clients.ClientMessage, waitGroup *sync.WaitGroup, queue chan struct{}) {
+func (server *Server) waitAndSend(clientMsg *clients.ClientMessage, waitGroup *sync.WaitGroup, queue chan struct{}) {
 
 	defer waitGroup.Done()
 	_, err := clientMsg.ClientConnection.Write(clientMsg.Packet)
 
-	go logSend(clientMsg.Packet)
+	if server.sendingLatencies != nil {
+		go server.logSend(clientMsg.Packet)
+	}
 
 	if err != nil {
-		clients.ServerPrintln("Failed to send packet to", clientMsg.ClientID, "- Error:", err)
+		server.println("Failed to send packet to", *clientMsg.ClientID, "- Error:", err)
+	} else {
+		server.metrics.countSent(clientMsg.Packet)
 	}
 	queue <- struct{}{}
 }
 
-func logSend(packet []byte) {
-	if clients.LogLatency {
-		decodedPacket, packetType, err := packets.DecodePacket(packet)
-		if err == nil && packetType == packets.PUBLISH {
-			packetID := decodedPacket.VariableLengthHeader.(*packets.PublishVariableHeader).PacketIdentifier
-			clients.SendingLatencyChannel <- &network.LatencyStruct{T: time.Now(), PacketID: packetID}
-		}
+func (server *Server) logSend(packet []byte) {
+	decodedPacket, packetType, err := packets.DecodePacket(packet)
+	if err == nil && packetType == packets.PUBLISH {
+		packetID := decodedPacket.VariableLengthHeader.(*packets.PublishVariableHeader).PacketIdentifier
+		server.sendingLatencies <- &network.LatencyStruct{T: time.Now(), PacketID: packetID}
 	}
 }
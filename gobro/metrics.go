@@ -0,0 +1,115 @@
+package gobro
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"MQTT-GO/packets"
+)
+
+// metrics counts the packets and bytes the server has received and sent.
+// The rest of the metrics are read from the server's state when they are served.
+type metrics struct {
+	// received and sent are indexed by packet type
+	received      [packets.AUTH + 1]atomic.Uint64
+	sent          [packets.AUTH + 1]atomic.Uint64
+	bytesReceived atomic.Uint64
+	bytesSent     atomic.Uint64
+}
+
+// countReceived counts a packet the server has received
+func (metrics *metrics) countReceived(packet []byte) {
+	metrics.received[packets.GetPacketType(packet)&packets.AUTH].Add(1)
+	metrics.bytesReceived.Add(uint64(len(packet)))
+}
+
+// countSent counts a packet the server has sent
+func (metrics *metrics) countSent(packet []byte) {
+	metrics.sent[packets.GetPacketType(packet)&packets.AUTH].Add(1)
+	metrics.bytesSent.Add(uint64(len(packet)))
+}
+
+// MetricsHandler returns an http.Handler that serves the server's metrics in the Prometheus text format.
+// The server serves it on /metrics itself if Options.MetricsAddress is set.
+func (server *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		output := bufio.NewWriter(writer)
+		server.writeMetrics(output)
+		if err := output.Flush(); err != nil {
+			log.Println("- Error while writing metrics:", err)
+		}
+	})
+}
+
+// writeMetrics writes every metric in the Prometheus text format
+func (server *Server) writeMetrics(output *bufio.Writer) {
+	connected, inflight := 0, 0
+	sessions := server.clientTable.Values()
+	for _, client := range sessions {
+		if client.IsConnected() {
+			connected++
+		}
+		inflight += client.Inflight.Size()
+	}
+
+	writeMetric(output, "gobro_connected_clients", "gauge", "Clients that are connected.", connected)
+	writeMetric(output, "gobro_sessions", "gauge", "Sessions, including the persistent sessions of offline clients.",
+		len(sessions))
+	writeMetric(output, "gobro_subscriptions", "gauge", "Subscriptions of every session.",
+		server.topicTrie.SubscriptionCount())
+	writeMetric(output, "gobro_topic_nodes", "gauge", "Topic levels stored in the topic trie.",
+		server.topicTrie.NodeCount())
+	writeMetric(output, "gobro_inflight_messages", "gauge",
+		"QoS 1 and 2 messages sent or queued for clients that haven't been acknowledged.", inflight)
+	writeMetric(output, "gobro_retained_messages", "gauge", "Retained messages.", server.retained.Size())
+	writeMetric(output, "gobro_input_queue_length", "gauge",
+		"Packets waiting for the message handler.", len(*server.inputChan))
+	writeMetric(output, "gobro_output_queue_length", "gauge",
+		"Packets waiting for the message sender.", len(*server.outputChan))
+
+	writePacketMetric(output, "gobro_packets_received_total", "Packets received, by packet type.",
+		&server.metrics.received)
+	writePacketMetric(output, "gobro_packets_sent_total", "Packets sent, by packet type.", &server.metrics.sent)
+	writeMetric(output, "gobro_received_bytes_total", "counter", "Bytes of packets received.",
+		server.metrics.bytesReceived.Load())
+	writeMetric(output, "gobro_sent_bytes_total", "counter", "Bytes of packets sent.",
+		server.metrics.bytesSent.Load())
+}
+
+func writeMetric(output *bufio.Writer, name string, metricType string, help string, value any) {
+	fmt.Fprintf(output, "# HELP %v %v\n# TYPE %v %v\n%v %v\n", name, help, name, metricType, name, value)
+}
+
+func writePacketMetric(output *bufio.Writer, name string, help string, counts *[packets.AUTH + 1]atomic.Uint64) {
+	fmt.Fprintf(output, "# HELP %v %v\n# TYPE %v counter\n", name, help, name)
+	for packetType := packets.CONNECT; packetType <= packets.AUTH; packetType++ {
+		fmt.Fprintf(output, "%v{type=%q} %v\n", name, packets.PacketTypeName(packetType), counts[packetType].Load())
+	}
+}
+
+// serveMetrics serves the metrics on /metrics at the MetricsAddress, until the server shuts down
+func (server *Server) serveMetrics() error {
+	listener, err := net.Listen("tcp", server.options.MetricsAddress)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", server.MetricsHandler())
+	server.metricsServer = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		err := server.metricsServer.Serve(listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Println("- Error while serving metrics:", err)
+		}
+	}()
+	log.Println("+ Serving metrics on", listener.Addr())
+	return nil
+}
@@ -0,0 +1,76 @@
+package gobro_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"MQTT-GO/packets"
+)
+
+func TestMetricsAreServed(t *testing.T) {
+	opts := tcpOptions(8030)
+	opts.MetricsAddress = "localhost:8029"
+	startServer(t, opts)
+
+	subscriber, reader := connectRawClient(t, "metrics", 8030)
+	defer subscriber.Close()
+	subscribe, _ := packets.EncodeSubscribe(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.SUBSCRIBE, Flags: 2},
+		&packets.SubscribeVariableHeader{PacketIdentifier: 1},
+		&packets.PacketPayload{RawApplicationMessage: []byte{0, 3, 'a', '/', 'b', 1}},
+	))
+	_, err := subscriber.Write(subscribe)
+	testErr(t, err)
+	readPacketOfType(t, reader, packets.SUBACK)
+
+	// The message stays inflight, as it isn't acknowledged
+	publish, err := packets.CreatePublish("a/b", 1, packets.CreatePublishFlags(1, false, false), []byte("hi"))
+	testErr(t, err)
+	_, err = subscriber.Write(publish)
+	testErr(t, err)
+	// The PUBLISH and PUBACK can arrive in either order
+	for i := 0; i < 2; i++ {
+		_, err := packets.ReadPacketFromConnection(reader)
+		testErr(t, err)
+	}
+	// Packets are counted once they have been written
+	time.Sleep(50 * time.Millisecond)
+
+	response, err := http.Get("http://localhost:8029/metrics")
+	testErr(t, err)
+	defer response.Body.Close()
+	if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Error("Metrics were served as", contentType)
+	}
+	body, err := io.ReadAll(response.Body)
+	testErr(t, err)
+
+	lines := strings.Split(string(body), "\n")
+	for _, expected := range []string{
+		"gobro_connected_clients 1",
+		"gobro_subscriptions 1",
+		"gobro_topic_nodes 2",
+		"gobro_inflight_messages 1",
+		`gobro_packets_received_total{type="CONNECT"} 1`,
+		`gobro_packets_received_total{type="PUBLISH"} 1`,
+		`gobro_packets_sent_total{type="PUBLISH"} 1`,
+		`gobro_packets_sent_total{type="PUBACK"} 1`,
+		"# TYPE gobro_sent_bytes_total counter",
+	} {
+		if !contains(lines, expected) {
+			t.Errorf("Metrics didn't contain '%v':\n%v", expected, string(body))
+		}
+	}
+}
+
+func contains(lines []string, expected string) bool {
+	for _, line := range lines {
+		if line == expected {
+			return true
+		}
+	}
+	return false
+}
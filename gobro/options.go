@@ -0,0 +1,64 @@
+package gobro
+
+import (
+	"time"
+)
+
+const (
+	// DefaultRedeliveryInterval is the RedeliveryInterval used if the Options don't set one
+	DefaultRedeliveryInterval = 10 * time.Second
+	// DefaultMaxQueuedMessages is the MaxQueuedMessages used if the Options don't set one
+	DefaultMaxQueuedMessages = 1000
+	// DefaultSysInterval is the SysInterval used if the Options don't set one
+	DefaultSysInterval = 10 * time.Second
+)
+
+// Options configure a Server. A server with the zero value doesn't have any listeners,
+// lets anyone connect, and lets clients publish and subscribe to any topic.
+type Options struct {
+	// Listeners are the endpoints the server accepts connections on. Clients on every
+	// endpoint share the same sessions and subscriptions, so they can talk to each other.
+	Listeners []ListenerConfig
+	// Authenticator checks the credentials of connecting clients, if it is nil anyone can connect
+	Authenticator Authenticator
+	// Authorizer checks which topics clients can publish and subscribe to, if it is nil there are no limits
+	Authorizer Authorizer
+	// Store saves sessions and retained messages so that they survive a restart. The server loads
+	// them when it is created, and closes the Store when it shuts down. If it is nil nothing is saved.
+	Store Store
+	// Bridges connect the server to other brokers, and forward messages between them
+	Bridges []BridgeConfig
+	// RedeliveryInterval is how long the server waits for a client to acknowledge
+	// a QoS 1 or 2 message before sending it again
+	RedeliveryInterval time.Duration
+	// MetricsAddress is the address the server serves its metrics on, at /metrics in the Prometheus
+	// text format. If it is empty the metrics aren't served.
+	MetricsAddress string
+	// SysInterval is how often the server publishes its statistics to the $SYS topics, such as
+	// $SYS/broker/clients/connected. If it is negative they aren't published.
+	SysInterval time.Duration
+	// MaxQueuedMessages is the most QoS 1 and 2 messages the server will hold
+	// for an offline client with a persistent session
+	MaxQueuedMessages int
+	// Verbose prints connections and errors to stdout, as well as to the log
+	Verbose bool
+	// PrintOutput prints every packet the server receives to stdout
+	PrintOutput bool
+	// LogLatency records when PUBLISH packets are received and sent, for the stress tests.
+	// The times are read from Server.Latencies.
+	LogLatency bool
+}
+
+// withDefaults returns the options with defaults for the settings that weren't set
+func (opts Options) withDefaults() Options {
+	if opts.RedeliveryInterval <= 0 {
+		opts.RedeliveryInterval = DefaultRedeliveryInterval
+	}
+	if opts.SysInterval == 0 {
+		opts.SysInterval = DefaultSysInterval
+	}
+	if opts.MaxQueuedMessages <= 0 {
+		opts.MaxQueuedMessages = DefaultMaxQueuedMessages
+	}
+	return opts
+}
@@ -0,0 +1,97 @@
+package gobro
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"MQTT-GO/gobro/clients"
+	"MQTT-GO/packets"
+)
+
+// createInflightPublish encodes a PUBLISH for a single subscriber using one of their packet
+// identifiers, and stores it as inflight until the subscriber acknowledges it.
+func (server *Server) createInflightPublish(client *clients.Client, topicName string, qos byte, retain bool,
+	applicationMessage []byte) (*clients.ClientMessage, error) {
+	packetID := client.NextPacketID()
+	flags := packets.CreatePublishFlags(qos, false, retain)
+	publish, err := packets.CreatePublish(topicName, packetID, flags, applicationMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	client.CreateInflightMessage(packetID, publish)
+	server.saveMessage(client, packetID, publish, false)
+	connection, _ := client.Connection()
+	clientMsg := clients.CreateClientMessage(client.ClientIdentifier, connection, publish)
+	return &clientMsg, nil
+}
+
+// queueOfflineMessage stores a message for a client with a persistent session that is offline,
+// so that it can be sent when the client reconnects. QoS 0 messages are dropped.
+func (server *Server) queueOfflineMessage(client *clients.Client, topicName string, qos byte,
+	applicationMessage []byte) {
+	if qos == 0 {
+		return
+	}
+	if client.Inflight.Size() >= server.options.MaxQueuedMessages {
+		log.Printf("- Dropping message to '%v' for offline client '%v', their queue is full\n",
+			topicName, client.ClientIdentifier)
+		return
+	}
+
+	packetID := client.NextPacketID()
+	flags := packets.CreatePublishFlags(qos, false, false)
+	publish, err := packets.CreatePublish(topicName, packetID, flags, applicationMessage)
+	if err != nil {
+		log.Printf("- Error while queueing publish for '%v': %v\n", client.ClientIdentifier, err)
+		return
+	}
+	client.QueueMessage(packetID, publish)
+	server.saveMessage(client, packetID, publish, false)
+}
+
+// redeliverUnacknowledged periodically looks through every client's inflight messages
+// and resends any that haven't been acknowledged within the RedeliveryInterval.
+// Resent PUBLISH messages have the DUP flag set. This runs until the server is stopped.
+func (server *Server) redeliverUnacknowledged() {
+	ticker := time.NewTicker(server.options.RedeliveryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-server.stopped:
+			return
+		case <-ticker.C:
+		}
+
+		toResend := make([]clients.ClientMessage, 0)
+		for _, client := range server.clientTable.Values() {
+			// Offline clients get their inflight messages when they reconnect
+			if !client.IsConnected() {
+				continue
+			}
+			connection, _ := client.Connection()
+			for _, inflightMessage := range client.Inflight.Values() {
+				packet := inflightMessage.Redeliver(server.options.RedeliveryInterval)
+				if packet == nil {
+					continue
+				}
+				toResend = append(toResend, clients.CreateClientMessage(client.ClientIdentifier, connection, packet))
+			}
+		}
+
+		if len(toResend) == 0 {
+			continue
+		}
+		log.Printf("- Redelivering %v unacknowledged messages\n", len(toResend))
+
+		waitGroup := sync.WaitGroup{}
+		waitGroup.Add(len(toResend))
+		for _, clientMsg := range toResend {
+			clientMsg.OutputWaitGroup = &waitGroup
+			(*server.outputChan) <- clientMsg
+		}
+		waitGroup.Wait()
+	}
+}
@@ -0,0 +1,79 @@
+package gobro
+
+import (
+	"log"
+
+	"MQTT-GO/gobro/clients"
+	"MQTT-GO/packets"
+	"MQTT-GO/structures"
+)
+
+// retainedMessage is the last message published to a topic with the RETAIN flag set.
+// It is sent to every client that subscribes to a matching filter.
+type retainedMessage struct {
+	topicName          string
+	qos                byte
+	applicationMessage []byte
+}
+
+// storeRetained replaces the retained message for a topic.
+// An empty application message removes the retained message instead.
+// The change is also saved to the server's Store, if it has one.
+func (server *Server) storeRetained(topicName string, qos byte, applicationMessage []byte) {
+	store := server.options.Store
+	if len(applicationMessage) == 0 {
+		server.retained.Delete(topicName)
+		if store != nil {
+			logStoreError(store.DeleteRetained(topicName))
+		}
+		return
+	}
+	server.retained.Put(topicName, retainedMessage{
+		topicName:          topicName,
+		qos:                qos,
+		applicationMessage: applicationMessage,
+	})
+	if store != nil {
+		logStoreError(store.SaveRetained(StoredRetained{TopicName: topicName, Qos: qos, Message: applicationMessage}))
+	}
+}
+
+// sendRetained finds every retained message matching the newly subscribed topics and
+// creates a PUBLISH for each with the RETAIN flag set, at the lower of the two QoS levels.
+// Augments the toSend array in place
+func (server *Server) sendRetained(client *clients.Client, topics []clients.Topic,
+	toSend *[]*clients.ClientMessage) {
+	if server.retained.Size() == 0 {
+		return
+	}
+	retainedMessages := server.retained.Values()
+	connection, _ := client.Connection()
+
+	for _, topic := range topics {
+		for _, retained := range retainedMessages {
+			if !packets.TopicMatchesFilter(topic.TopicFilter, retained.topicName) {
+				continue
+			}
+			qos := structures.Min(retained.qos, topic.Qos)
+			if qos > 0 {
+				clientMsg, err := server.createInflightPublish(client, retained.topicName, qos, true, retained.applicationMessage)
+				if err != nil {
+					log.Printf("- Error while creating retained publish for '%v': %v\n", client.ClientIdentifier, err)
+					continue
+				}
+				(*toSend) = append(*toSend, clientMsg)
+				continue
+			}
+
+			// QoS 0 messages aren't acknowledged, so they don't need a packet identifier
+			flags := packets.CreatePublishFlags(0, false, true)
+			publish, err := packets.CreatePublish(retained.topicName, 0, flags, retained.applicationMessage)
+			if err != nil {
+				log.Printf("- Error while creating retained publish for '%v': %v\n", client.ClientIdentifier, err)
+				continue
+			}
+			clientMsg := clients.CreateClientMessage(client.ClientIdentifier, connection, publish)
+			(*toSend) = append(*toSend, &clientMsg)
+		}
+	}
+}
@@ -5,12 +5,13 @@
 package gobro
 
 import (
-	"flag"
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"os"
-	"os/signal"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"MQTT-GO/gobro/clients"
@@ -18,108 +19,207 @@ import (
 	"MQTT-GO/structures"
 )
 
-var (
-	scheduledShutdown = flag.Float64("shutdown", 0.0, "Schedule a shutdown after a certain number of hours")
-	// ConnectionType is the type of transport protocol that is used
-	// It is set by main.go, and can be either TCP, UDP or QUIC
-	ConnectionType = network.TCP
-	PrintOutput    = false
-)
+// latencyBufferSize is how many latencies the server records before recording them blocks
+const latencyBufferSize = 1000000
 
 // Server is the main struct that is used to create a broker and listen for clients.
 // It stores a map of clients, a map of topics to subscribers, a channel for incoming packets,
-// a channel for outgoing packets, and a log file.
+// a channel for outgoing packets, and the retained messages.
 type Server struct {
 	clientTable *structures.SafeMap[clients.ClientID, *clients.Client]
-	topicTrie   *clients.TopicTrie
-	inputChan   *chan clients.ClientMessage
-	outputChan  *chan clients.ClientMessage
-	logFile     *os.File
-	listener    *network.Listener
+	// takeoverLock is held while a new connection takes over a session in the clientTable
+	takeoverLock *sync.Mutex
+	topicTrie    *clients.TopicTrie
+	inputChan    *chan clients.ClientMessage
+	outputChan   *chan clients.ClientMessage
+	options      Options
+	started      bool
+	startTime    time.Time
+	// stopped is closed when the server starts shutting down, and halted once it has finished
+	stopped  chan struct{}
+	stopOnce *sync.Once
+	halted   chan struct{}
+	haltOnce *sync.Once
+	// handling counts the packets the MessageHandler has taken, but not finished handling
+	handling *atomic.Int64
+	// retained stores the last retained message published to each topic name
+	retained *structures.SafeMap[string, retainedMessage]
+	// listeners are the open listeners, and accepting waits for all of them to stop accepting connections
+	listeners     []network.Listener
+	listenersLock *sync.Mutex
+	accepting     *sync.WaitGroup
+	// restoreErr is the error from restoring the Store's state, or loading a bridge's queue,
+	// which stops the server from starting
+	restoreErr error
+	// metrics counts the server's traffic, and metricsServer serves the metrics if there is a MetricsAddress
+	metrics       *metrics
+	metricsServer *http.Server
+	// bridges forward messages to and from other brokers, and bridging waits for them to disconnect
+	bridges  []*bridge
+	bridging *sync.WaitGroup
+	// receivingLatencies and sendingLatencies record when PUBLISH packets are received and sent,
+	// if the options have LogLatency set. Otherwise they are nil.
+	receivingLatencies chan *network.LatencyStruct
+	sendingLatencies   chan *network.LatencyStruct
+	// connectedClients has the ID of every connected client, and empty strings where clients have left
+	connectedClients      []string
+	connectedClientsMutex *sync.Mutex
 }
 
 // NewServer creates a new server with a new client table, topic map, and channels for incoming and outgoing packets.
-func NewServer() Server {
+// If the options have a Store, the sessions and retained messages saved in it are restored.
+// The server doesn't listen for connections until it is started.
+func NewServer(opts Options) *Server {
 	clientTable := structures.CreateSafeMap[clients.ClientID, *clients.Client]()
 	topicTrie := clients.CreateTopicTrie()
+	topicTrie.SetConnectedCheck(func(clientID clients.ClientID) bool {
+		client := clientTable.Get(clientID)
+		return client != nil && client.IsConnected()
+	})
 
 	inputChan := make(chan clients.ClientMessage, 10000)
 	outputChan := make(chan clients.ClientMessage, 10000)
 
-	return Server{
-		clientTable: clientTable,
-		topicTrie:   topicTrie,
-		inputChan:   &inputChan,
-		outputChan:  &outputChan,
-	}
-}
+	server := &Server{
+		clientTable:  clientTable,
+		takeoverLock: &sync.Mutex{},
+		topicTrie:    topicTrie,
+		inputChan:    &inputChan,
+		outputChan:   &outputChan,
+		options:      opts.withDefaults(),
+		stopped:      make(chan struct{}),
+		stopOnce:     &sync.Once{},
+		halted:       make(chan struct{}),
+		haltOnce:     &sync.Once{},
+		handling:     &atomic.Int64{},
+		metrics:      &metrics{},
+		retained:     structures.CreateSafeMap[string, retainedMessage](),
 
-// StopServer stops the server by closing the log file and exiting the program.
-func (server *Server) StopServer(shutdownProgram bool) {
-	cleanupAndExit(server, shutdownProgram)
+		bridging:              &sync.WaitGroup{},
+		listenersLock:         &sync.Mutex{},
+		accepting:             &sync.WaitGroup{},
+		connectedClients:      make([]string, 100, 500),
+		connectedClientsMutex: &sync.Mutex{},
+	}
+	if server.options.LogLatency {
+		server.receivingLatencies = make(chan *network.LatencyStruct, latencyBufferSize)
+		server.sendingLatencies = make(chan *network.LatencyStruct, latencyBufferSize)
+	}
+	for _, config := range server.options.Bridges {
+		remoteBridge, err := newBridge(server, config)
+		if err != nil {
+			server.restoreErr = err
+			return server
+		}
+		server.bridges = append(server.bridges, remoteBridge)
+	}
+	if server.options.Store != nil {
+		server.restoreErr = server.restoreState()
+	}
+	return server
 }
 
-// StartServer starts the server by listening for connections, and then listening for packets.
-// It also starts a goroutine to listen for a shutdown signal.
-// It runs the msgSender and msgListener functions in separate goroutines.
-// We run AcceptConnections in the main thread, because it blocks.
-func (server *Server) StartServer(ip string, port int) {
-	flag.Parse()
-	file, err := os.OpenFile("logs.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-	server.logFile = file
-	if err != nil {
-		log.Fatal(err)
+// Start starts listening on every one of the server's listeners, and starts handling packets.
+// It returns once the server is listening, and the server keeps running until it is shut down.
+// If any of the listeners can't listen, none of them are left open and the error is returned.
+// The server can't start if its state couldn't be restored from its Store.
+func (server *Server) Start(ctx context.Context) error {
+	server.listenersLock.Lock()
+	defer server.listenersLock.Unlock()
+	if server.started {
+		return errors.New("error: the server has already been started")
+	}
+	if server.restoreErr != nil {
+		return fmt.Errorf("error: couldn't restore the saved state: %w", server.restoreErr)
+	}
+	if err := validateBridges(server.options.Bridges); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	defer file.Close()
-	go scheduleShutdown(server)
-
-	listenForExit(server, true)
-	log.SetOutput(file)
-	// Sets the log to storefile & line numbers
-	log.SetFlags(log.Lshortfile | log.Ldate | log.Ltime)
 	log.Println("--Server starting--")
-	// Listen for connections
-	structures.Println("Listening for connections via", []string{"TCP", "QUIC", "UDP"}[ConnectionType])
-	structures.Printf("Listening on %v\n", ip+":"+fmt.Sprint(port))
 
-	listener, err := network.NewListener(ConnectionType)
+	err := server.openListeners()
 	if err != nil {
-		log.Print(err)
-		clients.ServerPrintln("FATAL:", err)
-		return
+		return err
 	}
-	server.listener = &listener
-	err = listener.Listen(ip, port)
-
-	if err != nil {
-		log.Println("- Error while trying to listen for TCP connections:", err)
-		clients.ServerPrintln("Error while trying to listen for TCP connections:", err)
-		return
+	if server.options.MetricsAddress != "" {
+		if err := server.serveMetrics(); err != nil {
+			server.closeListeners()
+			return err
+		}
 	}
-	defer listener.Close()
+	server.started = true
+	server.startTime = time.Now()
 
 	msgSender := CreateMessageSender(server.outputChan)
 	go msgSender.ListenAndSend(server)
 	msgHandler := CreateMessageHandler(server.inputChan, server.outputChan)
 	go msgHandler.Listen(server)
-	AcceptConnections(listener, server)
+	go server.redeliverUnacknowledged()
+	if server.options.SysInterval > 0 {
+		go server.publishSysPeriodically()
+	}
+	server.startBridges()
+	if server.options.Verbose {
+		go server.printConnectedClients()
+	}
+
+	// Every listener accepts connections in its own goroutine
+	for _, listener := range server.listeners {
+		server.accepting.Add(1)
+		go func(listener network.Listener) {
+			defer server.accepting.Done()
+			AcceptConnections(listener, server)
+		}(listener)
+	}
+	return nil
 }
 
-var (
-	connectedClients      = make([]string, 100, 500)
-	connectedClientsMutex = sync.Mutex{}
-)
+// Latencies returns the channels the times PUBLISH packets are received and sent on, for the
+// stress tests. They are nil unless the options have LogLatency set.
+func (server *Server) Latencies() (received chan *network.LatencyStruct, sent chan *network.LatencyStruct) {
+	return server.receivingLatencies, server.sendingLatencies
+}
 
-// AcceptConnections accepts connections from clients, and then creates a new goroutine to handle the client.
-func AcceptConnections(listener network.Listener, server *Server) {
-	clients.ServerPrintln("Connected clients:", connectedClients)
-	go func(connectedClients []string) {
-		for {
-			time.Sleep(time.Second * 5)
-			fmt.Println((connectedClients), "USERS")
+// Done returns a channel that's closed when the server starts shutting down
+func (server *Server) Done() <-chan struct{} {
+	return server.stopped
+}
+
+// println prints to stdout if the server is verbose
+func (server *Server) println(args ...any) {
+	if server.options.Verbose {
+		fmt.Println(args...)
+	}
+}
+
+// printf prints to stdout if the server is verbose
+func (server *Server) printf(format string, args ...any) {
+	if server.options.Verbose {
+		structures.Printf(format, args...)
+	}
+}
+
+func (server *Server) printConnectedClients() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-server.stopped:
+			return
+		case <-ticker.C:
 		}
-	}(connectedClients)
+		server.connectedClientsMutex.Lock()
+		fmt.Println(server.connectedClients, "USERS")
+		server.connectedClientsMutex.Unlock()
+	}
+}
 
+// AcceptConnections accepts connections from clients, and then creates a new goroutine to handle the client.
+// It returns when the listener is closed.
+func AcceptConnections(listener network.Listener, server *Server) {
 	waitingToPrint := sync.Mutex{}
 	lastPrintTime := time.Now()
 	for {
@@ -129,24 +229,27 @@ func AcceptConnections(listener network.Listener, server *Server) {
 			return
 		}
 
-		fmt.Print("\rAccepted a connection", server.clientTable.Size())
+		server.printf("\rAccepted a connection %v", server.clientTable.Size())
 		var newArrayPos *string
-		connectedClientsMutex.Lock()
-		for i, val := range connectedClients {
+		server.connectedClientsMutex.Lock()
+		for i, val := range server.connectedClients {
 			if val == "" {
-				newArrayPos = &(connectedClients[i])
+				newArrayPos = &(server.connectedClients[i])
 				break
 			}
-			if i == len(connectedClients)-1 {
-				connectedClients = append(connectedClients, "")
-				newArrayPos = &connectedClients[len(connectedClients)-1]
+			if i == len(server.connectedClients)-1 {
+				server.connectedClients = append(server.connectedClients, "")
+				newArrayPos = &server.connectedClients[len(server.connectedClients)-1]
 			}
 		}
 		// Done so that another thread doesn't also use this array position
 		*newArrayPos = "taken"
-		connectedClientsMutex.Unlock()
+		server.connectedClientsMutex.Unlock()
 
 		go func() {
+			if !server.options.Verbose {
+				return
+			}
 			time.Sleep(time.Millisecond * 200)
 			if time.Since(lastPrintTime) < time.Millisecond*500 {
 				return
@@ -156,61 +259,23 @@ func AcceptConnections(listener network.Listener, server *Server) {
 				return
 			}
 			lastPrintTime = time.Now()
-			clients.ServerPrintf("Connected clients: ")
-			connectedClientsMutex.Lock()
-			structures.PrintArray(connectedClients, "")
-			connectedClientsMutex.Unlock()
+			fmt.Printf("Connected clients: ")
+			server.connectedClientsMutex.Lock()
+			structures.PrintArray(server.connectedClients, "")
+			server.connectedClientsMutex.Unlock()
 			waitingToPrint.Unlock()
 		}()
 
-		go clients.ClientHandler(connection, *server.inputChan, server.clientTable,
-			server.topicTrie, newArrayPos, &connectedClientsMutex)
+		go clients.ClientHandler(connection, *server.inputChan, server.clientTable, server.takeoverLock,
+			server.topicTrie, newArrayPos, server.connectedClientsMutex, server.hooks())
 	}
 }
 
-func scheduleShutdown(server *Server) {
-	if *scheduledShutdown != 0 {
-		// Convert from microseconds to seconds to hours
-		const hourInNano = 1000000000 * 3600
-		time.Sleep(time.Duration(*scheduledShutdown * float64(hourInNano)))
-		server.StopServer(true)
+// hooks returns the functions the client handlers call to act on the server
+func (server *Server) hooks() clients.Hooks {
+	return clients.Hooks{
+		PublishWill:        server.publishWill,
+		Authenticate:       server.authenticateHook(),
+		ReceivingLatencies: server.receivingLatencies,
 	}
 }
-
-func listenForExit(server *Server, exit bool) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go func() {
-		for range c {
-			fmt.Println("CLOSING")
-			cleanupAndExit(server, exit)
-		}
-	}()
-}
-
-func cleanupAndExit(server *Server, exit bool) {
-	for _, client := range server.clientTable.Values() {
-		client.Disconnect(server.topicTrie, server.clientTable)
-	}
-	structures.StopWriting()
-	(*server.listener).Close()
-	server.topicTrie.DeleteAll()
-	log.Print("--Server exiting--\n\n")
-	if server.logFile != nil {
-		server.logFile.Close()
-	}
-	if exit {
-		os.Exit(0)
-
-	}
-}
-
-// DisableStdOutput disables the output to stdout.
-func DisableStdOutput() {
-	clients.VerboseOutput = false
-}
-
-// EnableStdOutput enables the output to stdout.
-func EnableStdOutput() {
-	clients.VerboseOutput = true
-}
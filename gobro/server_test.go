@@ -1,10 +1,18 @@
 package gobro_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"testing"
 	"time"
 
+	"MQTT-GO/client"
 	"MQTT-GO/gobro"
+	"MQTT-GO/network"
+	"MQTT-GO/packets"
 )
 
 func TestServerStarts(t *testing.T) {
@@ -15,9 +23,547 @@ func TestServerStarts(t *testing.T) {
 		}
 	}()
 
-	server := gobro.NewServer()
-	go server.StartServer("localhost", 8000)
+	server := gobro.NewServer(tcpOptions(8023))
+	testErr(t, server.Start(context.Background()))
+	if err := server.Start(context.Background()); err == nil {
+		t.Error("Server was started twice")
+	}
+	testErr(t, server.Shutdown(context.Background()))
+	testErr(t, server.Shutdown(context.Background()))
+}
+
+func TestServersRunSideBySide(t *testing.T) {
+	first := gobro.NewServer(tcpOptions(8024))
+	testErr(t, first.Start(context.Background()))
+	startServer(t, tcpOptions(8025))
+
+	conn, reader := connectRawClient(t, "first", 8024)
+	defer conn.Close()
+	testErr(t, first.Shutdown(context.Background()))
+	select {
+	case <-first.Done():
+	default:
+		t.Error("Done wasn't closed after Shutdown")
+	}
+	testErr(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	if _, err := reader.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Error("Connection was kept open after Shutdown")
+	}
+
+	// Shutting one server down leaves the other running
+	conn, _ = connectRawClient(t, "second", 8025)
+	conn.Close()
+}
+
+func TestServersRecordTheirOwnLatencies(t *testing.T) {
+	firstOpts, secondOpts := tcpOptions(8045), tcpOptions(8046)
+	firstOpts.LogLatency, secondOpts.LogLatency = true, true
+	first := startServer(t, firstOpts)
+	second := startServer(t, secondOpts)
+
+	publisher, _ := connectRawClient(t, "timed", 8045)
+	defer publisher.Close()
+	publish, err := packets.CreatePublish("timed", 0, 0, []byte("now"))
+	testErr(t, err)
+	_, err = publisher.Write(publish)
+	testErr(t, err)
+
+	firstReceived, _ := first.Latencies()
+	secondReceived, _ := second.Latencies()
+	select {
+	case <-firstReceived:
+	case <-time.After(time.Second):
+		t.Fatal("The server didn't record when it received the PUBLISH")
+	}
+	if len(secondReceived) != 0 {
+		t.Error("Another server recorded the PUBLISH")
+	}
+}
+
+func TestQoS1Redelivery(t *testing.T) {
+	opts := tcpOptions(8001)
+	opts.RedeliveryInterval = 200 * time.Millisecond
+	startServer(t, opts)
+
+	subscriber, reader := connectRawClient(t, "redelivery", 8001)
+	defer subscriber.Close()
+	subscribe, _ := packets.EncodeSubscribe(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.SUBSCRIBE, Flags: 2},
+		&packets.SubscribeVariableHeader{PacketIdentifier: 1},
+		&packets.PacketPayload{RawApplicationMessage: []byte{0, 1, 'x', 1}},
+	))
+	_, err := subscriber.Write(subscribe)
+	testErr(t, err)
+	readPacketOfType(t, reader, packets.SUBACK)
+
+	publisher, err := client.CreateAndConnectClient("localhost", 8001)
+	testErr(t, err)
+	defer publisher.SendDisconnect()
+	testErr(t, publisher.SendPublishWithQoS([]byte("hello"), "x", 1))
+
+	first := readPacketOfType(t, reader, packets.PUBLISH)
+	if first.ControlHeader.Flags&packets.DupFlag != 0 {
+		t.Error("First delivery had the DUP flag set")
+	}
+
+	// We don't acknowledge the message, so the broker should send it again
+	second := readPacketOfType(t, reader, packets.PUBLISH)
+	firstID := first.VariableLengthHeader.(*packets.PublishVariableHeader).PacketIdentifier
+	secondID := second.VariableLengthHeader.(*packets.PublishVariableHeader).PacketIdentifier
+	if second.ControlHeader.Flags&packets.DupFlag == 0 || firstID != secondID {
+		t.Error("Message was not redelivered with the DUP flag set")
+	}
+
+	_, err = subscriber.Write(packets.CreatePubAck(firstID))
+	testErr(t, err)
+	time.Sleep(opts.RedeliveryInterval * 3)
+	testErr(t, subscriber.SetReadDeadline(time.Now().Add(opts.RedeliveryInterval*2)))
+	if _, err := packets.ReadPacketFromConnection(reader); err == nil {
+		t.Error("Message was redelivered after being acknowledged")
+	}
+}
+
+// tcpOptions returns the options for a server with a TCP listener on the port
+func tcpOptions(port int) gobro.Options {
+	return gobro.Options{
+		Listeners: []gobro.ListenerConfig{{Transport: network.TCP, IP: "localhost", Port: port}},
+	}
+}
+
+// startServer starts a server, which is shut down when the test ends
+func startServer(t *testing.T, opts gobro.Options) *gobro.Server {
+	t.Helper()
+	server := gobro.NewServer(opts)
+	testErr(t, server.Start(context.Background()))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		testErr(t, server.Shutdown(ctx))
+	})
+	return server
+}
+
+func testErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// connectRawClient connects to the broker without using the client package, so that
+// tests can control exactly which packets get sent.
+func connectRawClient(t *testing.T, clientID string, port int) (network.Conn, *bufio.Reader) {
+	t.Helper()
+	return connectRawClientWithKeepAlive(t, clientID, port, 60)
+}
+
+func connectRawClientWithKeepAlive(t *testing.T, clientID string, port int, keepAlive int) (network.Conn, *bufio.Reader) {
+	t.Helper()
+	connection, reader, _ := connectRawClientWithFlags(t, clientID, port, keepAlive, packets.CleanSessionFlag)
+	return connection, reader
+}
+
+// connectRawClientWithFlags connects with the given CONNECT flags and also returns the CONNACK
+func connectRawClientWithFlags(t *testing.T, clientID string, port int, keepAlive int,
+	connectFlags byte) (network.Conn, *bufio.Reader, *packets.Packet) {
+	t.Helper()
+	connection, err := network.NewConn(network.TCP)
+	testErr(t, err)
+	testErr(t, connection.Connect("localhost", port))
+
+	connect, err := packets.EncodeConnect(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.CONNECT},
+		&packets.ConnectVariableHeader{KeepAlive: keepAlive, ConnectFlags: connectFlags},
+		&packets.PacketPayload{ClientID: clientID},
+	))
+	testErr(t, err)
+	_, err = connection.Write(connect)
+	testErr(t, err)
+
+	reader := bufio.NewReader(connection)
+	connack := readPacketOfType(t, reader, packets.CONNACK)
+	return connection, reader, connack
+}
+
+func readPacketOfType(t *testing.T, reader *bufio.Reader, packetType byte) *packets.Packet {
+	t.Helper()
+	packetArr, err := packets.ReadPacketFromConnection(reader)
+	testErr(t, err)
+	packet, decodedType, err := packets.DecodePacket(packetArr)
+	testErr(t, err)
+	if decodedType != packetType {
+		t.Fatalf("Expected a %v but got a %v", packets.PacketTypeName(packetType), packets.PacketTypeName(decodedType))
+	}
+	return packet
+}
+
+func TestQoS2DuplicatesAreNotForwarded(t *testing.T) {
+	startServer(t, tcpOptions(8002))
+
+	subscriber, err := client.CreateAndConnectClient("localhost", 8002)
+	testErr(t, err)
+	subscriber.StoreReceivedPackets(true)
+	defer subscriber.SendDisconnect()
+	testErr(t, subscriber.SendSubscribe(packets.TopicWithQoS{Topic: "billing", QoS: 2}))
+
+	publisher, reader := connectRawClient(t, "billing-publisher", 8002)
+	defer publisher.Close()
+	publish, err := packets.CreatePublish("billing", 7, packets.CreatePublishFlags(2, false, false), []byte("charge"))
+	testErr(t, err)
+	duplicate, err := packets.CreatePublish("billing", 7, packets.CreatePublishFlags(2, true, false), []byte("charge"))
+	testErr(t, err)
+
+	// The publisher didn't see our PUBREC, so it sends the message again before releasing it
+	_, err = publisher.Write(publish)
+	testErr(t, err)
+	readPacketOfType(t, reader, packets.PUBREC)
+	_, err = publisher.Write(duplicate)
+	testErr(t, err)
+	readPacketOfType(t, reader, packets.PUBREC)
+
+	_, err = publisher.Write(packets.CreatePubRel(7))
+	testErr(t, err)
+	pubcomp := readPacketOfType(t, reader, packets.PUBCOMP)
+	if pubcomp.VariableLengthHeader.(*packets.PubackVariableHeader).PacketIdentifier != 7 {
+		t.Error("PUBCOMP has the wrong packet identifier")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if subscriber.ReceivedPackets.Size() != 1 {
+		t.Error("Subscriber received", subscriber.ReceivedPackets.Size(), "messages instead of 1")
+	}
+}
+
+func TestPublishIsDowngradedToSubscriptionQoS(t *testing.T) {
+	startServer(t, tcpOptions(8003))
+
+	subscriber, reader := connectRawClient(t, "downgrade", 8003)
+	defer subscriber.Close()
+	subscribe, _ := packets.EncodeSubscribe(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.SUBSCRIBE, Flags: 2},
+		&packets.SubscribeVariableHeader{PacketIdentifier: 1},
+		&packets.PacketPayload{RawApplicationMessage: []byte{0, 1, 'x', 0, 0, 1, 'y', 1}},
+	))
+	_, err := subscriber.Write(subscribe)
+	testErr(t, err)
+	readPacketOfType(t, reader, packets.SUBACK)
+
+	publisher, err := client.CreateAndConnectClient("localhost", 8003)
+	testErr(t, err)
+	defer publisher.SendDisconnect()
+
+	testErr(t, publisher.SendPublishWithQoS([]byte("hello"), "x", 2))
+	publish := readPacketOfType(t, reader, packets.PUBLISH)
+	if qos := packets.GetQoS(publish.ControlHeader.Flags); qos != 0 {
+		t.Error("Expected the publish to be delivered with QoS 0, got", qos)
+	}
+
+	testErr(t, publisher.SendPublishWithQoS([]byte("hello"), "y", 2))
+	publish = readPacketOfType(t, reader, packets.PUBLISH)
+	if qos := packets.GetQoS(publish.ControlHeader.Flags); qos != 1 {
+		t.Error("Expected the publish to be delivered with QoS 1, got", qos)
+	}
+}
+
+func TestRetainedMessagesAreSentOnSubscribe(t *testing.T) {
+	startServer(t, tcpOptions(8004))
+
+	publisher, _ := connectRawClient(t, "retained-publisher", 8004)
+	defer publisher.Close()
+	retainFlags := packets.CreatePublishFlags(0, false, true)
+	for _, message := range []struct{ topic, payload string }{
+		{"sensors/temp", "21"},
+		{"sensors/humidity", "40"},
+		// An empty retained message removes the retained humidity reading
+		{"sensors/humidity", ""},
+	} {
+		publish, err := packets.CreatePublish(message.topic, 1, retainFlags, []byte(message.payload))
+		testErr(t, err)
+		_, err = publisher.Write(publish)
+		testErr(t, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	subscriber, reader := connectRawClient(t, "dashboard", 8004)
+	defer subscriber.Close()
+	subscribe, _ := packets.EncodeSubscribe(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.SUBSCRIBE, Flags: 2},
+		&packets.SubscribeVariableHeader{PacketIdentifier: 1},
+		&packets.PacketPayload{RawApplicationMessage: []byte{0, 9, 's', 'e', 'n', 's', 'o', 'r', 's', '/', '+', 0}},
+	))
+	_, err := subscriber.Write(subscribe)
+	testErr(t, err)
+	readPacketOfType(t, reader, packets.SUBACK)
+
+	retained := readPacketOfType(t, reader, packets.PUBLISH)
+	if retained.VariableLengthHeader.(*packets.PublishVariableHeader).TopicFilter != "sensors/temp" ||
+		string(retained.Payload.RawApplicationMessage) != "21" {
+		t.Fatal("Received the wrong retained message")
+	}
+	if retained.ControlHeader.Flags&packets.RetainFlag == 0 {
+		t.Error("Retained message didn't have the RETAIN flag set")
+	}
+
+	// Messages matching an existing subscription don't have the RETAIN flag set
+	publish, err := packets.CreatePublish("sensors/temp", 2, retainFlags, []byte("22"))
+	testErr(t, err)
+	_, err = publisher.Write(publish)
+	testErr(t, err)
+	live := readPacketOfType(t, reader, packets.PUBLISH)
+	if string(live.Payload.RawApplicationMessage) != "22" {
+		t.Fatal("Expected the new reading, got", string(live.Payload.RawApplicationMessage))
+	}
+	if live.ControlHeader.Flags&packets.RetainFlag != 0 {
+		t.Error("Message to an existing subscription had the RETAIN flag set")
+	}
+}
+
+func TestWillIsPublishedOnUngracefulDisconnect(t *testing.T) {
+	startServer(t, tcpOptions(8005))
+
+	subscriber, err := client.CreateAndConnectClient("localhost", 8005)
+	testErr(t, err)
+	subscriber.StoreReceivedPackets(true)
+	defer subscriber.SendDisconnect()
+	testErr(t, subscriber.SendSubscribe(packets.TopicWithQoS{Topic: "status/+", QoS: 1}))
+
+	connectWithWill := func(clientID string) network.Conn {
+		connection, err := network.NewConn(network.TCP)
+		testErr(t, err)
+		testErr(t, connection.Connect("localhost", 8005))
+		connect, err := packets.EncodeConnect(packets.CombinePacketSections(
+			&packets.ControlHeader{Type: packets.CONNECT},
+			&packets.ConnectVariableHeader{ConnectFlags: packets.WillFlag | 1<<3, KeepAlive: 60},
+			&packets.PacketPayload{ClientID: clientID, WillTopic: "status/" + clientID, WillMessage: []byte("offline")},
+		))
+		testErr(t, err)
+		_, err = connection.Write(connect)
+		testErr(t, err)
+		readPacketOfType(t, bufio.NewReader(connection), packets.CONNACK)
+		return connection
+	}
+
+	// A clean disconnect discards the will
+	graceful := connectWithWill("graceful")
+	_, err = graceful.Write([]byte{packets.DISCONNECT << 4, 0})
+	testErr(t, err)
+	time.Sleep(100 * time.Millisecond)
+	graceful.Close()
+
+	ungraceful := connectWithWill("ungraceful")
+	ungraceful.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	if subscriber.ReceivedPackets.Size() != 1 {
+		t.Fatal("Subscriber received", subscriber.ReceivedPackets.Size(), "wills instead of 1")
+	}
+	will := subscriber.ReceivedPackets.Head().Value()
+	if will.VariableLengthHeader.(*packets.PublishVariableHeader).TopicFilter != "status/ungraceful" ||
+		string(will.Payload.RawApplicationMessage) != "offline" {
+		t.Error("Received the wrong will")
+	}
+	if packets.GetQoS(will.ControlHeader.Flags) != 1 {
+		t.Error("Will wasn't published with QoS 1")
+	}
+}
+
+func TestLongConnectIsReadWhole(t *testing.T) {
+	startServer(t, tcpOptions(8037))
+
+	subscriber, err := client.CreateAndConnectClient("localhost", 8037)
+	testErr(t, err)
+	subscriber.StoreReceivedPackets(true)
+	defer subscriber.SendDisconnect()
+	testErr(t, subscriber.SendSubscribe(packets.TopicWithQoS{Topic: "status/+", QoS: 0}))
+
+	// The will makes the CONNECT longer than a single read of 300 bytes
+	willMessage := bytes.Repeat([]byte("offline "), 100)
+	connection, err := network.NewConn(network.TCP)
+	testErr(t, err)
+	testErr(t, connection.Connect("localhost", 8037))
+	connect, err := packets.EncodeConnect(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.CONNECT},
+		&packets.ConnectVariableHeader{ConnectFlags: packets.WillFlag, KeepAlive: 60},
+		&packets.PacketPayload{ClientID: "long", WillTopic: "status/long", WillMessage: willMessage},
+	))
+	testErr(t, err)
+	_, err = connection.Write(connect)
+	testErr(t, err)
+	connack := readPacketOfType(t, bufio.NewReader(connection), packets.CONNACK)
+	if returnCode := connack.VariableLengthHeader.(*packets.ConnackVariableHeader).ConnectReturnCode; returnCode != 0 {
+		t.Fatal("Long CONNECT was refused with return code", returnCode)
+	}
+	connection.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	if subscriber.ReceivedPackets.Size() != 1 {
+		t.Fatal("Subscriber received", subscriber.ReceivedPackets.Size(), "wills instead of 1")
+	}
+	will := subscriber.ReceivedPackets.Head().Value()
+	if !bytes.Equal(will.Payload.RawApplicationMessage, willMessage) {
+		t.Error("Will was cut short, it was", len(will.Payload.RawApplicationMessage), "bytes long")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	startServer(t, tcpOptions(8006))
+
+	connection, reader := connectRawClientWithKeepAlive(t, "keepalive", 8006, 1)
+	defer connection.Close()
+
+	_, err := connection.Write([]byte{packets.PINGREQ << 4, 0})
+	testErr(t, err)
+	readPacketOfType(t, reader, packets.PINGRESP)
+
+	// After the PINGRESP we go quiet, so the broker should close the connection
+	// one and a half seconds after the PINGREQ
+	start := time.Now()
+	_, err = packets.ReadPacketFromConnection(reader)
+	if err == nil {
+		t.Fatal("Broker sent a packet instead of closing the connection")
+	}
+	if waited := time.Since(start); waited < time.Second || waited > 3*time.Second {
+		t.Error("Broker closed the connection after", waited)
+	}
+}
+
+func TestPersistentSession(t *testing.T) {
+	startServer(t, tcpOptions(8007))
+
+	subscriber, reader, connack := connectRawClientWithFlags(t, "persistent", 8007, 60, 0)
+	if connack.VariableLengthHeader.(*packets.ConnackVariableHeader).ConnectAcknowledgementFlags != 0 {
+		t.Error("New session was reported as present")
+	}
+	subscribe, _ := packets.EncodeSubscribe(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.SUBSCRIBE, Flags: 2},
+		&packets.SubscribeVariableHeader{PacketIdentifier: 1},
+		&packets.PacketPayload{RawApplicationMessage: []byte{0, 6, 'o', 'r', 'd', 'e', 'r', 's', 1}},
+	))
+	_, err := subscriber.Write(subscribe)
+	testErr(t, err)
+	readPacketOfType(t, reader, packets.SUBACK)
+	_, err = subscriber.Write([]byte{packets.DISCONNECT << 4, 0})
+	testErr(t, err)
+	time.Sleep(100 * time.Millisecond)
+	subscriber.Close()
+
+	publisher, err := client.CreateAndConnectClient("localhost", 8007)
+	testErr(t, err)
+	defer publisher.SendDisconnect()
+	testErr(t, publisher.SendPublishWithQoS([]byte("first"), "orders", 1))
+	testErr(t, publisher.SendPublishWithQoS([]byte("second"), "orders", 2))
+	// QoS 0 messages aren't queued for offline clients
+	testErr(t, publisher.SendPublish([]byte("dropped"), "orders"))
+	time.Sleep(100 * time.Millisecond)
+
+	subscriber, reader, connack = connectRawClientWithFlags(t, "persistent", 8007, 60, 0)
+	if connack.VariableLengthHeader.(*packets.ConnackVariableHeader).ConnectAcknowledgementFlags != 1 {
+		t.Error("Resumed session wasn't reported as present")
+	}
+	for _, expected := range []string{"first", "second"} {
+		publish := readPacketOfType(t, reader, packets.PUBLISH)
+		if string(publish.Payload.RawApplicationMessage) != expected {
+			t.Fatal("Expected queued message", expected, "got", string(publish.Payload.RawApplicationMessage))
+		}
+		packetID := publish.VariableLengthHeader.(*packets.PublishVariableHeader).PacketIdentifier
+		_, err = subscriber.Write(packets.CreatePubAck(packetID))
+		testErr(t, err)
+	}
+
+	// The subscription was kept, so new messages arrive too
+	testErr(t, publisher.SendPublishWithQoS([]byte("third"), "orders", 1))
+	publish := readPacketOfType(t, reader, packets.PUBLISH)
+	if string(publish.Payload.RawApplicationMessage) != "third" {
+		t.Error("Expected a new message, got", string(publish.Payload.RawApplicationMessage))
+	}
+	subscriber.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// Asking for a clean session throws the old one away
+	subscriber, _, connack = connectRawClientWithFlags(t, "persistent", 8007, 60, packets.CleanSessionFlag)
+	defer subscriber.Close()
+	if connack.VariableLengthHeader.(*packets.ConnackVariableHeader).ConnectAcknowledgementFlags != 0 {
+		t.Error("Clean session was reported as present")
+	}
+}
+
+func TestSessionTakeover(t *testing.T) {
+	startServer(t, tcpOptions(8008))
+
+	oldConnection, oldReader, _ := connectRawClientWithFlags(t, "takeover", 8008, 60, 0)
+	defer oldConnection.Close()
+	subscribe, _ := packets.EncodeSubscribe(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.SUBSCRIBE, Flags: 2},
+		&packets.SubscribeVariableHeader{PacketIdentifier: 1},
+		&packets.PacketPayload{RawApplicationMessage: []byte{0, 4, 'j', 'o', 'b', 's', 1}},
+	))
+	_, err := oldConnection.Write(subscribe)
+	testErr(t, err)
+	readPacketOfType(t, oldReader, packets.SUBACK)
+
+	newConnection, newReader, connack := connectRawClientWithFlags(t, "takeover", 8008, 60, 0)
+	defer newConnection.Close()
+	connackHeader := connack.VariableLengthHeader.(*packets.ConnackVariableHeader)
+	if connackHeader.ConnectReturnCode != 0 || connackHeader.ConnectAcknowledgementFlags != 1 {
+		t.Fatal("New connection didn't take over the session", connackHeader)
+	}
+
+	// The broker closes the old connection
+	if _, err := packets.ReadPacketFromConnection(oldReader); err == nil {
+		t.Error("Old connection received a packet instead of being closed")
+	}
+
+	publisher, err := client.CreateAndConnectClient("localhost", 8008)
+	testErr(t, err)
+	defer publisher.SendDisconnect()
+	testErr(t, publisher.SendPublishWithQoS([]byte("build"), "jobs", 1))
+
+	publish := readPacketOfType(t, newReader, packets.PUBLISH)
+	if string(publish.Payload.RawApplicationMessage) != "build" {
+		t.Error("New connection received the wrong message")
+	}
+}
+
+func TestSharedSubscriptionsAreLoadBalanced(t *testing.T) {
+	startServer(t, tcpOptions(8032))
+
+	worker1, reader1 := connectRawClient(t, "worker-1", 8032)
+	defer worker1.Close()
+	subscribeTo(t, worker1, reader1, "$share/workers/telemetry/#")
+	worker2, reader2 := connectRawClient(t, "worker-2", 8032)
+	defer worker2.Close()
+	subscribeTo(t, worker2, reader2, "$share/workers/telemetry/#")
+	monitor, monitorReader := connectRawClient(t, "telemetry-monitor", 8032)
+	defer monitor.Close()
+	subscribeTo(t, monitor, monitorReader, "telemetry/#")
+
+	publisher, _ := connectRawClient(t, "telemetry-publisher", 8032)
+	defer publisher.Close()
+	publishTelemetry := func(count int) {
+		for i := 0; i < count; i++ {
+			publish, err := packets.CreatePublish("telemetry/temperature", 0, 0, []byte{byte(i)})
+			testErr(t, err)
+			_, err = publisher.Write(publish)
+			testErr(t, err)
+		}
+	}
+
+	// Every worker gets half of the messages, and the monitor gets all of them
+	publishTelemetry(4)
+	for i := 0; i < 4; i++ {
+		readPacketOfType(t, monitorReader, packets.PUBLISH)
+	}
+	for i := 0; i < 2; i++ {
+		readPacketOfType(t, reader1, packets.PUBLISH)
+		readPacketOfType(t, reader2, packets.PUBLISH)
+	}
 
-	time.Sleep(time.Millisecond * 200)
-	server.StopServer(false)
+	// Once a worker leaves, the other gets every message
+	_, err := worker1.Write([]byte{packets.DISCONNECT << 4, 0})
+	testErr(t, err)
+	time.Sleep(100 * time.Millisecond)
+	publishTelemetry(2)
+	for i := 0; i < 2; i++ {
+		readPacketOfType(t, reader2, packets.PUBLISH)
+	}
 }
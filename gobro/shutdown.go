@@ -0,0 +1,130 @@
+package gobro
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"MQTT-GO/gobro/clients"
+)
+
+// drainPollInterval is how often Shutdown checks whether every packet has been handled and sent
+const drainPollInterval = 10 * time.Millisecond
+
+// Shutdown gracefully stops the server. It stops accepting connections, and publishes the will of
+// every connected client, as their connections are closed without them sending a DISCONNECT.
+// It then waits for the packets the server has already received to be handled and sent, and closes
+// every client's connection. MQTT 3.1.1 only lets clients send a DISCONNECT, so the server closes the
+// connections without one. The bridges disconnect from their remote brokers, and finally the Store
+// is closed, so that the persistent sessions are saved.
+//
+// If the context ends before the packets have been drained, the clients are disconnected straight
+// away and the context's error is returned. Shutdown never exits the program, and the server
+// can't be started again.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.stopOnce.Do(func() { close(server.stopped) })
+	server.closeListeners()
+	log.Println("--Server shutting down--")
+
+	err := server.waitForListeners(ctx)
+	if err == nil {
+		server.publishWills()
+		err = server.drain(ctx)
+	}
+	if err != nil {
+		log.Println("- Shutdown deadline exceeded, closing connections without draining:", err)
+	}
+	for _, client := range server.clientTable.Values() {
+		client.Disconnect(server.topicTrie, server.clientTable)
+	}
+
+	server.haltOnce.Do(func() { close(server.halted) })
+	if bridgeErr := server.waitForBridges(ctx); bridgeErr != nil {
+		log.Println("- Shutdown deadline exceeded while disconnecting bridges:", bridgeErr)
+	}
+	if server.metricsServer != nil {
+		server.metricsServer.Close()
+	}
+	if server.options.Store != nil {
+		if storeErr := server.options.Store.Close(); storeErr != nil {
+			log.Println("- Error while closing the store:", storeErr)
+			if err == nil {
+				err = storeErr
+			}
+		}
+	}
+	server.topicTrie.DeleteAll()
+	log.Print("--Server exiting--\n\n")
+	return err
+}
+
+// waitForListeners waits for every listener to stop accepting connections
+func (server *Server) waitForListeners(ctx context.Context) error {
+	stoppedAccepting := make(chan struct{})
+	go func() {
+		server.accepting.Wait()
+		close(stoppedAccepting)
+	}()
+	select {
+	case <-stoppedAccepting:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitForBridges waits for every bridge to disconnect from its remote broker
+func (server *Server) waitForBridges(ctx context.Context) error {
+	disconnected := make(chan struct{})
+	go func() {
+		server.bridging.Wait()
+		close(disconnected)
+	}()
+	select {
+	case <-disconnected:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// publishWills publishes the will of every connected client, before the clients are disconnected
+// so that their subscribers still receive them. The wills are taken, so the client handlers don't
+// publish them again when the connections close.
+func (server *Server) publishWills() {
+	for _, client := range server.connectedClientList() {
+		connection, _ := client.Connection()
+		if will := client.TakeWill(connection); will != nil {
+			log.Printf("+ Publishing will of client '%v' to '%v'\n", client.ClientIdentifier, will.Topic)
+			server.publishWill(client, will)
+		}
+	}
+}
+
+// drain waits until every packet in the MessageHandler's and the MessageSender's channels
+// has been handled and sent, or until the context ends
+func (server *Server) drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		if len(*server.inputChan) == 0 && len(*server.outputChan) == 0 && server.handling.Load() == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// connectedClientList returns every client that is currently connected
+func (server *Server) connectedClientList() []*clients.Client {
+	connected := make([]*clients.Client, 0, server.clientTable.Size())
+	for _, client := range server.clientTable.Values() {
+		if client.IsConnected() {
+			connected = append(connected, client)
+		}
+	}
+	return connected
+}
@@ -0,0 +1,106 @@
+package gobro_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"MQTT-GO/gobro"
+	"MQTT-GO/network"
+	"MQTT-GO/packets"
+)
+
+func TestShutdownDrainsMessagesAndPublishesWills(t *testing.T) {
+	const messages = 1000
+	server := gobro.NewServer(tcpOptions(8026))
+	testErr(t, server.Start(context.Background()))
+
+	subscriber, reader := connectRawClient(t, "drain-subscriber", 8026)
+	defer subscriber.Close()
+	subscribe, _ := packets.EncodeSubscribe(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.SUBSCRIBE, Flags: 2},
+		&packets.SubscribeVariableHeader{PacketIdentifier: 1},
+		&packets.PacketPayload{RawApplicationMessage: []byte{0, 7, 'd', 'r', 'a', 'i', 'n', '/', '#', 0}},
+	))
+	_, err := subscriber.Write(subscribe)
+	testErr(t, err)
+	readPacketOfType(t, reader, packets.SUBACK)
+
+	withWill, err := network.NewConn(network.TCP)
+	testErr(t, err)
+	testErr(t, withWill.Connect("localhost", 8026))
+	defer withWill.Close()
+	connect, err := packets.EncodeConnect(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.CONNECT},
+		&packets.ConnectVariableHeader{ConnectFlags: packets.WillFlag | packets.CleanSessionFlag, KeepAlive: 60},
+		&packets.PacketPayload{ClientID: "drain-will", WillTopic: "drain/will", WillMessage: []byte("offline")},
+	))
+	testErr(t, err)
+	_, err = withWill.Write(connect)
+	testErr(t, err)
+	readPacketOfType(t, bufio.NewReader(withWill), packets.CONNACK)
+
+	// The messages are still being handled when the server shuts down
+	publisher, _ := connectRawClient(t, "drain-publisher", 8026)
+	defer publisher.Close()
+	burst := make([]byte, 0)
+	for i := 0; i < messages; i++ {
+		publish, err := packets.CreatePublish("drain/msg", 0, 0, []byte("hello"))
+		testErr(t, err)
+		burst = append(burst, publish...)
+	}
+	_, err = publisher.Write(burst)
+	testErr(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	testErr(t, server.Shutdown(ctx))
+
+	received, willReceived := 0, false
+	testErr(t, subscriber.SetReadDeadline(time.Now().Add(2*time.Second)))
+	for {
+		packetArr, err := packets.ReadPacketFromConnection(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		testErr(t, err)
+		packet, packetType, err := packets.DecodePacket(packetArr)
+		testErr(t, err)
+		if packetType != packets.PUBLISH {
+			t.Fatal("Expected a PUBLISH but got a", packets.PacketTypeName(packetType))
+		}
+		if packet.VariableLengthHeader.(*packets.PublishVariableHeader).TopicFilter == "drain/will" {
+			willReceived = true
+		} else {
+			received++
+		}
+	}
+
+	if received != messages {
+		t.Errorf("Expected %v messages to be delivered before shutting down, got %v", messages, received)
+	}
+	if !willReceived {
+		t.Error("The will of a connected client wasn't published")
+	}
+}
+
+func TestShutdownClosesConnectionsAfterDeadline(t *testing.T) {
+	server := gobro.NewServer(tcpOptions(8027))
+	testErr(t, server.Start(context.Background()))
+	connection, reader := connectRawClient(t, "deadline", 8027)
+	defer connection.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := server.Shutdown(ctx); err == nil {
+		t.Error("Shutdown with an expired context didn't return an error")
+	}
+	testErr(t, connection.SetReadDeadline(time.Now().Add(time.Second)))
+	if _, err := reader.ReadByte(); err == nil {
+		t.Error("Connection was kept open after the deadline")
+	}
+}
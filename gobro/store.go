@@ -0,0 +1,184 @@
+package gobro
+
+import (
+	"log"
+
+	"MQTT-GO/gobro/clients"
+)
+
+// Store saves the broker's state, so that it survives the broker restarting. It holds the
+// persistent sessions of clients, with their subscriptions, the QoS 1 and 2 messages that
+// haven't been acknowledged yet and the QoS 2 messages they haven't released, and the
+// retained messages. Clean sessions aren't saved.
+//
+// The server calls the Store as the state changes, from many goroutines at once, and loads
+// the saved state when it is created. Saving something that is already saved replaces it.
+type Store interface {
+	// Load returns everything that has been saved
+	Load() (*StoredState, error)
+	// SaveSession saves that a client has a persistent session
+	SaveSession(clientID string) error
+	// DeleteSession deletes a client's session, along with its subscriptions and messages
+	DeleteSession(clientID string) error
+	SaveSubscription(clientID string, topic clients.Topic) error
+	DeleteSubscription(clientID string, topicFilter string) error
+	// SaveMessage saves a message that has been sent or queued for a client, until it is acknowledged
+	SaveMessage(clientID string, message StoredMessage) error
+	DeleteMessage(clientID string, packetID int) error
+	// SaveAwaitingRelease saves that a client has sent a QoS 2 message which it hasn't released yet,
+	// so a duplicate of it isn't forwarded again after a restart
+	SaveAwaitingRelease(clientID string, packetID int) error
+	DeleteAwaitingRelease(clientID string, packetID int) error
+	SaveRetained(message StoredRetained) error
+	DeleteRetained(topicName string) error
+	// Close saves anything that hasn't been saved yet. The Store isn't used after it is closed.
+	Close() error
+}
+
+// StoredState is the state saved in a Store
+type StoredState struct {
+	Sessions []StoredSession
+	Retained []StoredRetained
+}
+
+// StoredSession is the persistent session of a client. Its messages are in the order they were first saved.
+type StoredSession struct {
+	ClientID      string
+	Subscriptions []clients.Topic
+	Messages      []StoredMessage
+	// AwaitingRelease has the packet identifiers of the QoS 2 messages the client has sent, but not released
+	AwaitingRelease []int
+}
+
+// StoredMessage is an encoded PUBLISH sent to a client, which the client hasn't acknowledged.
+// A QoS 2 message is released once the client has sent a PUBREC for it.
+type StoredMessage struct {
+	PacketID int
+	Packet   []byte
+	Released bool
+}
+
+// StoredRetained is the retained message of a topic
+type StoredRetained struct {
+	TopicName string
+	Qos       byte
+	Message   []byte
+}
+
+// restoreState recreates the sessions and retained messages saved in the server's Store.
+// Restored clients are offline until they connect again.
+func (server *Server) restoreState() error {
+	state, err := server.options.Store.Load()
+	if err != nil {
+		return err
+	}
+
+	for _, session := range state.Sessions {
+		client := clients.CreateClient(clients.ClientID(session.ClientID), nil)
+		for _, topic := range session.Subscriptions {
+			if !server.topicTrie.Contains(topic.TopicFilter) {
+				if err := server.topicTrie.AddTopic(topic.TopicFilter); err != nil {
+					return err
+				}
+			}
+			if err := server.topicTrie.PutWithQoS(topic.TopicFilter, client.ClientIdentifier, topic.Qos); err != nil {
+				return err
+			}
+			client.AddTopic(topic)
+		}
+		for _, message := range session.Messages {
+			client.RestoreMessage(message.PacketID, message.Packet, message.Released)
+		}
+		for _, packetID := range session.AwaitingRelease {
+			client.AwaitingRelease.Put(packetID, struct{}{})
+		}
+		server.clientTable.Put(client.ClientIdentifier, client)
+	}
+	for _, retained := range state.Retained {
+		server.retained.Put(retained.TopicName, retainedMessage{
+			topicName:          retained.TopicName,
+			qos:                retained.Qos,
+			applicationMessage: retained.Message,
+		})
+	}
+	log.Printf("+ Restored %v sessions and %v retained messages\n", len(state.Sessions), len(state.Retained))
+	return nil
+}
+
+// persists returns true if the client's session is saved in the server's Store
+func (server *Server) persists(client *clients.Client) bool {
+	return server.options.Store != nil && !client.Settings().CleanSession
+}
+
+// saveSession saves a newly connected client's session if it is persistent, or deletes
+// any session it had saved if it asked for a clean session
+func (server *Server) saveSession(client *clients.Client) {
+	if server.options.Store == nil {
+		return
+	}
+	clientID := string(client.ClientIdentifier)
+	if client.Settings().CleanSession {
+		logStoreError(server.options.Store.DeleteSession(clientID))
+	} else {
+		logStoreError(server.options.Store.SaveSession(clientID))
+	}
+}
+
+// saveSubscriptions saves new subscriptions of a client with a persistent session
+func (server *Server) saveSubscriptions(client *clients.Client, topics []clients.Topic) {
+	if !server.persists(client) {
+		return
+	}
+	for _, topic := range topics {
+		logStoreError(server.options.Store.SaveSubscription(string(client.ClientIdentifier), topic))
+	}
+}
+
+// deleteSubscriptions deletes the saved subscriptions a client has unsubscribed from
+func (server *Server) deleteSubscriptions(client *clients.Client, topicFilters []string) {
+	if !server.persists(client) {
+		return
+	}
+	for _, topicFilter := range topicFilters {
+		logStoreError(server.options.Store.DeleteSubscription(string(client.ClientIdentifier), topicFilter))
+	}
+}
+
+// saveMessage saves a message sent or queued for a client with a persistent session
+func (server *Server) saveMessage(client *clients.Client, packetID int, packet []byte, released bool) {
+	if !server.persists(client) {
+		return
+	}
+	message := StoredMessage{PacketID: packetID, Packet: packet, Released: released}
+	logStoreError(server.options.Store.SaveMessage(string(client.ClientIdentifier), message))
+}
+
+// deleteMessage deletes a saved message once the client has acknowledged it
+func (server *Server) deleteMessage(client *clients.Client, packetID int) {
+	if !server.persists(client) {
+		return
+	}
+	logStoreError(server.options.Store.DeleteMessage(string(client.ClientIdentifier), packetID))
+}
+
+// saveAwaitingRelease saves that a client with a persistent session has sent a QoS 2 message it hasn't released
+func (server *Server) saveAwaitingRelease(client *clients.Client, packetID int) {
+	if !server.persists(client) {
+		return
+	}
+	logStoreError(server.options.Store.SaveAwaitingRelease(string(client.ClientIdentifier), packetID))
+}
+
+// deleteAwaitingRelease deletes a saved QoS 2 message once the client has released it
+func (server *Server) deleteAwaitingRelease(client *clients.Client, packetID int) {
+	if !server.persists(client) {
+		return
+	}
+	logStoreError(server.options.Store.DeleteAwaitingRelease(string(client.ClientIdentifier), packetID))
+}
+
+func logStoreError(err error) {
+	if err != nil {
+		log.Println("- Error while saving to the store:", err)
+	}
+}
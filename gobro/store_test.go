@@ -0,0 +1,208 @@
+package gobro_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"MQTT-GO/client"
+	"MQTT-GO/gobro"
+	"MQTT-GO/gobro/clients"
+	"MQTT-GO/packets"
+)
+
+func TestFileStoreReplaysLogOverSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	store, err := gobro.OpenFileStore(dir)
+	testErr(t, err)
+
+	testErr(t, store.SaveSession("sensor"))
+	testErr(t, store.SaveSubscription("sensor", clients.Topic{TopicFilter: "commands/#", Qos: 1}))
+	testErr(t, store.SaveSubscription("sensor", clients.Topic{TopicFilter: "alerts", Qos: 2}))
+	testErr(t, store.SaveMessage("sensor", gobro.StoredMessage{PacketID: 7, Packet: []byte("first")}))
+	testErr(t, store.SaveMessage("sensor", gobro.StoredMessage{PacketID: 3, Packet: []byte("second")}))
+	testErr(t, store.SaveMessage("sensor", gobro.StoredMessage{PacketID: 4, Packet: []byte("third")}))
+	testErr(t, store.SaveAwaitingRelease("sensor", 9))
+	testErr(t, store.Snapshot())
+
+	// These changes are only in the log
+	testErr(t, store.SaveMessage("sensor", gobro.StoredMessage{PacketID: 7, Packet: []byte("first"), Released: true}))
+	testErr(t, store.DeleteMessage("sensor", 3))
+	testErr(t, store.DeleteSubscription("sensor", "alerts"))
+	testErr(t, store.SaveAwaitingRelease("sensor", 12))
+	testErr(t, store.SaveAwaitingRelease("sensor", 11))
+	testErr(t, store.DeleteAwaitingRelease("sensor", 11))
+	testErr(t, store.SaveRetained(gobro.StoredRetained{TopicName: "status", Qos: 1, Message: []byte("up")}))
+	testErr(t, store.SaveSession("lamp"))
+	testErr(t, store.SaveSubscription("lamp", clients.Topic{TopicFilter: "lamp/set", Qos: 0}))
+	testErr(t, store.DeleteSession("lamp"))
+	// Changes to sessions that aren't saved are ignored
+	testErr(t, store.SaveSubscription("unknown", clients.Topic{TopicFilter: "ignored"}))
+
+	// The broker stopped while writing a change
+	logFile, err := os.OpenFile(filepath.Join(dir, "wal.log"), os.O_APPEND|os.O_WRONLY, 0600)
+	testErr(t, err)
+	_, err = logFile.Write([]byte(`{"op":"saveRetained","topic":"tor`))
+	testErr(t, err)
+	testErr(t, logFile.Close())
+
+	reopened, err := gobro.OpenFileStore(dir)
+	testErr(t, err)
+	state, err := reopened.Load()
+	testErr(t, err)
+	expected := &gobro.StoredState{
+		Sessions: []gobro.StoredSession{{
+			ClientID:      "sensor",
+			Subscriptions: []clients.Topic{{TopicFilter: "commands/#", Qos: 1}},
+			Messages: []gobro.StoredMessage{
+				{PacketID: 7, Packet: []byte("first"), Released: true},
+				{PacketID: 4, Packet: []byte("third")},
+			},
+			AwaitingRelease: []int{9, 12},
+		}},
+		Retained: []gobro.StoredRetained{{TopicName: "status", Qos: 1, Message: []byte("up")}},
+	}
+	if !reflect.DeepEqual(state, expected) {
+		t.Errorf("Expected the state %+v, got %+v", expected, state)
+	}
+
+	// The partly written change was removed, so new changes can be read back
+	testErr(t, reopened.DeleteRetained("status"))
+	testErr(t, reopened.Close())
+	testErr(t, reopened.Close())
+	reopened, err = gobro.OpenFileStore(dir)
+	testErr(t, err)
+	defer reopened.Close()
+	state, err = reopened.Load()
+	testErr(t, err)
+	if len(state.Retained) != 0 || len(state.Sessions) != 1 {
+		t.Errorf("Changes after reopening weren't saved, got %+v", state)
+	}
+}
+
+func TestSessionsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	startWithStore := func() *gobro.Server {
+		store, err := gobro.OpenFileStore(dir)
+		testErr(t, err)
+		opts := tcpOptions(8028)
+		opts.Store = store
+		server := gobro.NewServer(opts)
+		testErr(t, server.Start(context.Background()))
+		return server
+	}
+	server := startWithStore()
+
+	subscriber, reader, _ := connectRawClientWithFlags(t, "survivor", 8028, 60, 0)
+	subscribe, _ := packets.EncodeSubscribe(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.SUBSCRIBE, Flags: 2},
+		&packets.SubscribeVariableHeader{PacketIdentifier: 1},
+		&packets.PacketPayload{RawApplicationMessage: []byte{0, 7, 's', 'a', 'v', 'e', 'd', '/', '#', 1}},
+	))
+	_, err := subscriber.Write(subscribe)
+	testErr(t, err)
+	readPacketOfType(t, reader, packets.SUBACK)
+	_, err = subscriber.Write([]byte{packets.DISCONNECT << 4, 0})
+	testErr(t, err)
+	time.Sleep(100 * time.Millisecond)
+	subscriber.Close()
+
+	publisher, err := client.CreateAndConnectClient("localhost", 8028)
+	testErr(t, err)
+	testErr(t, publisher.SendPublishWithQoS([]byte("queued"), "saved/a", 1))
+	retain, err := packets.CreatePublish("saved/retained", 1, packets.CreatePublishFlags(1, false, true), []byte("kept"))
+	testErr(t, err)
+	_, err = publisher.BrokerConnection.Write(retain)
+	testErr(t, err)
+	time.Sleep(100 * time.Millisecond)
+	testErr(t, server.Shutdown(context.Background()))
+
+	server = startWithStore()
+	defer server.Shutdown(context.Background())
+	subscriber, reader, connack := connectRawClientWithFlags(t, "survivor", 8028, 60, 0)
+	defer subscriber.Close()
+	if connack.VariableLengthHeader.(*packets.ConnackVariableHeader).ConnectAcknowledgementFlags != 1 {
+		t.Error("Restored session wasn't reported as present")
+	}
+	for _, expected := range []string{"queued", "kept"} {
+		publish := readPacketOfType(t, reader, packets.PUBLISH)
+		if string(publish.Payload.RawApplicationMessage) != expected {
+			t.Fatal("Expected queued message", expected, "got", string(publish.Payload.RawApplicationMessage))
+		}
+		packetID := publish.VariableLengthHeader.(*packets.PublishVariableHeader).PacketIdentifier
+		_, err = subscriber.Write(packets.CreatePubAck(packetID))
+		testErr(t, err)
+	}
+
+	// The retained message and the subscription were both restored
+	other, otherReader := connectRawClient(t, "newcomer", 8028)
+	defer other.Close()
+	_, err = other.Write(subscribe)
+	testErr(t, err)
+	readPacketOfType(t, otherReader, packets.SUBACK)
+	publish := readPacketOfType(t, otherReader, packets.PUBLISH)
+	if string(publish.Payload.RawApplicationMessage) != "kept" {
+		t.Error("Expected the retained message, got", string(publish.Payload.RawApplicationMessage))
+	}
+	publishNew, err := packets.CreatePublish("saved/new", 0, 0, []byte("new"))
+	testErr(t, err)
+	_, err = other.Write(publishNew)
+	testErr(t, err)
+	publish = readPacketOfType(t, reader, packets.PUBLISH)
+	if string(publish.Payload.RawApplicationMessage) != "new" {
+		t.Error("Expected a new message, got", string(publish.Payload.RawApplicationMessage))
+	}
+}
+
+func TestUnreleasedMessagesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	startWithStore := func() *gobro.Server {
+		store, err := gobro.OpenFileStore(dir)
+		testErr(t, err)
+		opts := tcpOptions(8044)
+		opts.Store = store
+		server := gobro.NewServer(opts)
+		testErr(t, server.Start(context.Background()))
+		return server
+	}
+	server := startWithStore()
+
+	subscriber, subscriberReader := connectRawClient(t, "exactly-once-subscriber", 8044)
+	subscribeTo(t, subscriber, subscriberReader, "billing")
+	publisher, publisherReader, _ := connectRawClientWithFlags(t, "exactly-once-publisher", 8044, 60, 0)
+	publish, err := packets.CreatePublish("billing", 5, packets.CreatePublishFlags(2, false, false), []byte("charge"))
+	testErr(t, err)
+	_, err = publisher.Write(publish)
+	testErr(t, err)
+	readPacketOfType(t, publisherReader, packets.PUBREC)
+	readPacketOfType(t, subscriberReader, packets.PUBLISH)
+	subscriber.Close()
+	publisher.Close()
+	testErr(t, server.Shutdown(context.Background()))
+
+	// The publisher didn't release the message before the restart, so it sends it again
+	server = startWithStore()
+	defer server.Shutdown(context.Background())
+	subscriber, subscriberReader = connectRawClient(t, "exactly-once-subscriber", 8044)
+	defer subscriber.Close()
+	subscribeTo(t, subscriber, subscriberReader, "billing")
+	publisher, publisherReader, _ = connectRawClientWithFlags(t, "exactly-once-publisher", 8044, 60, 0)
+	defer publisher.Close()
+	duplicate, err := packets.CreatePublish("billing", 5, packets.CreatePublishFlags(2, true, false), []byte("charge"))
+	testErr(t, err)
+	_, err = publisher.Write(duplicate)
+	testErr(t, err)
+	readPacketOfType(t, publisherReader, packets.PUBREC)
+	_, err = publisher.Write(packets.CreatePubRel(5))
+	testErr(t, err)
+	readPacketOfType(t, publisherReader, packets.PUBCOMP)
+
+	testErr(t, subscriber.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	if _, err := packets.ReadPacketFromConnection(subscriberReader); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("The duplicate was forwarded again after the restart", err)
+	}
+}
@@ -0,0 +1,91 @@
+package gobro
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"MQTT-GO/gobro/clients"
+	"MQTT-GO/packets"
+)
+
+// sysClientID is the client the $SYS messages are published as, in the server's logs
+const sysClientID = clients.ClientID("$SYS")
+
+// publishSysPeriodically publishes the server's statistics to the $SYS topics every
+// SysInterval, the same topics Mosquitto uses. It runs until the server is stopped.
+func (server *Server) publishSysPeriodically() {
+	ticker := time.NewTicker(server.options.SysInterval)
+	defer ticker.Stop()
+
+	for {
+		server.publishSys()
+		select {
+		case <-server.stopped:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishSys publishes every $SYS topic once
+func (server *Server) publishSys() {
+	connected := 0
+	sessions := server.clientTable.Values()
+	for _, client := range sessions {
+		if client.IsConnected() {
+			connected++
+		}
+	}
+	var received, sent uint64
+	for packetType := range server.metrics.received {
+		received += server.metrics.received[packetType].Load()
+		sent += server.metrics.sent[packetType].Load()
+	}
+
+	uptime := int(time.Since(server.startTime).Seconds())
+	server.publishSysTopic("$SYS/broker/uptime", fmt.Sprintf("%v seconds", uptime))
+	server.publishSysTopic("$SYS/broker/clients/connected", strconv.Itoa(connected))
+	server.publishSysTopic("$SYS/broker/clients/disconnected", strconv.Itoa(len(sessions)-connected))
+	server.publishSysTopic("$SYS/broker/clients/total", strconv.Itoa(len(sessions)))
+	server.publishSysTopic("$SYS/broker/messages/received", strconv.FormatUint(received, 10))
+	server.publishSysTopic("$SYS/broker/messages/sent", strconv.FormatUint(sent, 10))
+	server.publishSysTopic("$SYS/broker/publish/messages/received",
+		strconv.FormatUint(server.metrics.received[packets.PUBLISH].Load(), 10))
+	server.publishSysTopic("$SYS/broker/publish/messages/sent",
+		strconv.FormatUint(server.metrics.sent[packets.PUBLISH].Load(), 10))
+	server.publishSysTopic("$SYS/broker/bytes/received", strconv.FormatUint(server.metrics.bytesReceived.Load(), 10))
+	server.publishSysTopic("$SYS/broker/bytes/sent", strconv.FormatUint(server.metrics.bytesSent.Load(), 10))
+	server.publishSysTopic("$SYS/broker/subscriptions/count", strconv.Itoa(server.topicTrie.SubscriptionCount()))
+	server.publishSysTopic("$SYS/broker/retained messages/count", strconv.Itoa(server.retained.Size()))
+}
+
+// publishSysTopic publishes a QoS 0 message to a $SYS topic and retains it, so that clients
+// get the latest value as soon as they subscribe. $SYS messages aren't saved to the Store,
+// as they are out of date once the server restarts.
+func (server *Server) publishSysTopic(topicName string, value string) {
+	server.retained.Put(topicName, retainedMessage{
+		topicName:          topicName,
+		qos:                0,
+		applicationMessage: []byte(value),
+	})
+	server.publishAs(sysClientID, topicName, 0, true, []byte(value))
+}
+
+// publishAs publishes a message from within the server to every matching subscriber,
+// as if the given client had published it. retain only tells the bridges to forward the message
+// as retained, so a retained message must already have been stored.
+func (server *Server) publishAs(publisher clients.ClientID, topicName string, qos byte, retain bool,
+	applicationMessage []byte) {
+	publish, err := packets.CreatePublish(topicName, 0, packets.CreatePublishFlags(qos, false, false), applicationMessage)
+	if err != nil {
+		log.Printf("- Error while creating publish to '%v': %v\n", topicName, err)
+		return
+	}
+	topic := clients.Topic{TopicFilter: topicName, Qos: qos}
+	clientMessage := clients.CreateClientMessage(publisher, nil, publish)
+	packetsToSend := make([]*clients.ClientMessage, 0, 10)
+	server.handlePublish(topic, 0, applicationMessage, retain, clientMessage, &packetsToSend)
+	sendAndWait(server.outputChan, packetsToSend)
+}
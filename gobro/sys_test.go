@@ -0,0 +1,80 @@
+package gobro_test
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"MQTT-GO/network"
+	"MQTT-GO/packets"
+)
+
+func TestSysTopicsArePublished(t *testing.T) {
+	opts := tcpOptions(8031)
+	opts.SysInterval = 50 * time.Millisecond
+	startServer(t, opts)
+
+	everything, everythingReader := connectRawClient(t, "sys-everything", 8031)
+	defer everything.Close()
+	subscribeTo(t, everything, everythingReader, "#")
+
+	// The retained value is sent as soon as the client subscribes
+	monitor, monitorReader := connectRawClient(t, "sys-monitor", 8031)
+	defer monitor.Close()
+	subscribeTo(t, monitor, monitorReader, "$SYS/broker/clients/connected")
+	publish := readPacketOfType(t, monitorReader, packets.PUBLISH)
+	if publish.ControlHeader.Flags&1 == 0 {
+		t.Error("The first $SYS message wasn't retained")
+	}
+	// Later values are published as they change
+	for string(publish.Payload.RawApplicationMessage) != "2" {
+		publish = readPacketOfType(t, monitorReader, packets.PUBLISH)
+	}
+
+	// # doesn't match the $SYS topics
+	testErr(t, everything.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	if _, err := packets.ReadPacketFromConnection(everythingReader); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("A subscription to # was sent a $SYS message", err)
+	}
+}
+
+func TestClientsCantPublishToSysTopics(t *testing.T) {
+	opts := tcpOptions(8043)
+	opts.SysInterval = time.Hour
+	startServer(t, opts)
+
+	publisher, publisherReader := connectRawClient(t, "sys-forger", 8043)
+	defer publisher.Close()
+	forged, err := packets.CreatePublish("$SYS/broker/clients/connected", 1, packets.CreatePublishFlags(1, false, true),
+		[]byte("999"))
+	testErr(t, err)
+	_, err = publisher.Write(forged)
+	testErr(t, err)
+	// The publish is still acknowledged, but dropped
+	readPacketOfType(t, publisherReader, packets.PUBACK)
+
+	monitor, monitorReader := connectRawClient(t, "sys-monitor", 8043)
+	defer monitor.Close()
+	subscribeTo(t, monitor, monitorReader, "$SYS/broker/clients/connected")
+	publish := readPacketOfType(t, monitorReader, packets.PUBLISH)
+	if string(publish.Payload.RawApplicationMessage) == "999" {
+		t.Error("A client overwrote the broker's statistics")
+	}
+}
+
+// subscribeTo subscribes the client to a topic filter at QoS 0
+func subscribeTo(t *testing.T, connection network.Conn, reader *bufio.Reader, topicFilter string) {
+	t.Helper()
+	payload := append([]byte{0, byte(len(topicFilter))}, topicFilter...)
+	subscribe, err := packets.EncodeSubscribe(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.SUBSCRIBE, Flags: 2},
+		&packets.SubscribeVariableHeader{PacketIdentifier: 1},
+		&packets.PacketPayload{RawApplicationMessage: append(payload, 0)},
+	))
+	testErr(t, err)
+	_, err = connection.Write(subscribe)
+	testErr(t, err)
+	readPacketOfType(t, reader, packets.SUBACK)
+}
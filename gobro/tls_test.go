@@ -0,0 +1,65 @@
+package gobro_test
+
+import (
+	"bufio"
+	"testing"
+
+	"MQTT-GO/client"
+	"MQTT-GO/gobro"
+	"MQTT-GO/network"
+	"MQTT-GO/packets"
+)
+
+func TestClientCertificateCommonNameIsUsername(t *testing.T) {
+	serverConfig, err := network.LoadServerTLSConfig("../network/testdata/server.crt",
+		"../network/testdata/server.key", "../network/testdata/ca.crt", false)
+	testErr(t, err)
+	startServer(t, gobro.Options{
+		Listeners: []gobro.ListenerConfig{
+			{Transport: network.TLS, IP: "localhost", Port: 8014, TLSConfig: serverConfig},
+		},
+		Authenticator: gobro.NewMemoryAuthenticator(map[string]string{"alice": "secret"}),
+		Authorizer: gobro.NewACL([]gobro.ACLRule{
+			{Allow: true, Access: gobro.AccessAll, TopicFilter: "users/%u/#"},
+		}),
+	})
+
+	client.ConnectionType = network.TLS
+	defer func() { client.ConnectionType = network.TCP }()
+
+	// Clients without a certificate still need a password
+	anonymous := client.CreateClient()
+	anonymous.TLSConfig, err = network.LoadClientTLSConfig("../network/testdata/ca.crt", "", "")
+	testErr(t, err)
+	testErr(t, anonymous.SetClientConnection("localhost", 8014))
+	if err := anonymous.SendConnect("localhost", 8014); err == nil {
+		t.Error("Client without a certificate or password was accepted")
+	}
+
+	sensor := client.CreateClient()
+	sensor.TLSConfig, err = network.LoadClientTLSConfig("../network/testdata/ca.crt",
+		"../network/testdata/client.crt", "../network/testdata/client.key")
+	testErr(t, err)
+	testErr(t, sensor.SetClientConnection("localhost", 8014))
+	if err := sensor.SendConnect("localhost", 8014); err != nil {
+		t.Fatal("Client with a certificate was refused:", err)
+	}
+	defer sensor.BrokerConnection.Close()
+
+	// The client can only subscribe to its own topics, which are named after its certificate
+	subscribe, _ := packets.EncodeSubscribe(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.SUBSCRIBE, Flags: 2},
+		&packets.SubscribeVariableHeader{PacketIdentifier: 1},
+		&packets.PacketPayload{RawApplicationMessage: []byte{
+			0, 16, 'u', 's', 'e', 'r', 's', '/', 's', 'e', 'n', 's', 'o', 'r', '-', '1', '/', '#', 1,
+			0, 13, 'u', 's', 'e', 'r', 's', '/', 'a', 'l', 'i', 'c', 'e', '/', '#', 1,
+		}},
+	))
+	_, err = sensor.BrokerConnection.Write(subscribe)
+	testErr(t, err)
+	suback := readPacketOfType(t, bufio.NewReader(sensor.BrokerConnection), packets.SUBACK)
+	returnCodes := suback.Payload.RawApplicationMessage
+	if len(returnCodes) != 2 || returnCodes[0] != 1 || returnCodes[1] != packets.SubackFailure {
+		t.Error("Expected return codes [1 128], got", returnCodes)
+	}
+}
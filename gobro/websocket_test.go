@@ -0,0 +1,49 @@
+package gobro_test
+
+import (
+	"bufio"
+	"testing"
+
+	"MQTT-GO/gobro"
+	"MQTT-GO/network"
+	"MQTT-GO/packets"
+)
+
+func TestWebSocketAndTCPClientsShareTopics(t *testing.T) {
+	opts := tcpOptions(8018)
+	opts.Listeners = append(opts.Listeners, gobro.ListenerConfig{Transport: network.WebSocket, IP: "localhost", Port: 8019})
+	startServer(t, opts)
+
+	subscriber, reader := connectRawClient(t, "tcp-subscriber", 8018)
+	defer subscriber.Close()
+	subscribe, _ := packets.EncodeSubscribe(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.SUBSCRIBE, Flags: 2},
+		&packets.SubscribeVariableHeader{PacketIdentifier: 1},
+		&packets.PacketPayload{RawApplicationMessage: []byte{0, 9, 'd', 'a', 's', 'h', 'b', 'o', 'a', 'r', 'd', 0}},
+	))
+	_, err := subscriber.Write(subscribe)
+	testErr(t, err)
+	readPacketOfType(t, reader, packets.SUBACK)
+
+	publisher := network.NewWebSocketConn(network.DefaultWebSocketPath)
+	testErr(t, publisher.Connect("localhost", 8019))
+	defer publisher.Close()
+	connect, err := packets.EncodeConnect(packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.CONNECT},
+		&packets.ConnectVariableHeader{KeepAlive: 60, ConnectFlags: packets.CleanSessionFlag},
+		&packets.PacketPayload{ClientID: "browser"},
+	))
+	testErr(t, err)
+	_, err = publisher.Write(connect)
+	testErr(t, err)
+	readPacketOfType(t, bufio.NewReader(publisher), packets.CONNACK)
+
+	publish, err := packets.CreatePublish("dashboard", 0, 0, []byte("hello"))
+	testErr(t, err)
+	_, err = publisher.Write(publish)
+	testErr(t, err)
+	received := readPacketOfType(t, reader, packets.PUBLISH)
+	if string(received.Payload.RawApplicationMessage) != "hello" {
+		t.Error("Expected hello, got", string(received.Payload.RawApplicationMessage))
+	}
+}
@@ -0,0 +1,35 @@
+package gobro
+
+import (
+	"log"
+
+	"MQTT-GO/gobro/clients"
+	"MQTT-GO/packets"
+)
+
+// publishWill publishes a client's will to every matching subscriber, as if
+// the client had published it, and stores it if it is retained.
+// The will is dropped if the client isn't allowed to publish to its topic.
+func (server *Server) publishWill(client *clients.Client, will *clients.Will) {
+	if !server.canPublish(client, will.Topic) {
+		return
+	}
+	if will.Retain {
+		server.storeRetained(will.Topic, will.Qos, will.Message)
+	}
+
+	packetID := client.NextPacketID()
+	flags := packets.CreatePublishFlags(will.Qos, false, false)
+	publish, err := packets.CreatePublish(will.Topic, packetID, flags, will.Message)
+	if err != nil {
+		log.Printf("- Error while creating will for '%v': %v\n", client.ClientIdentifier, err)
+		return
+	}
+
+	topic := clients.Topic{TopicFilter: will.Topic, Qos: will.Qos}
+	connection, _ := client.Connection()
+	clientMessage := clients.CreateClientMessage(client.ClientIdentifier, connection, publish)
+	packetsToSend := make([]*clients.ClientMessage, 0, 10)
+	server.handlePublish(topic, packetID, will.Message, will.Retain, clientMessage, &packetsToSend)
+	sendAndWait(server.outputChan, packetsToSend)
+}
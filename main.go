@@ -5,6 +5,8 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
@@ -14,14 +16,20 @@ import (
 
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"time"
 
 	"MQTT-GO/client"
 	"MQTT-GO/gobro"
+	"MQTT-GO/network"
 	"MQTT-GO/stresstests"
 	"MQTT-GO/structures"
 )
 
+var transportIDs = map[string]byte{"TCP": 0, "QUIC": 1, "UDP": 2, "TLS": 3, "WebSocket": 4}
+
 var (
 	cpuprofile  = flag.String("cpuprofile", "", "Profile code, and write that profile to a file")
 	heapprofile = flag.String("heapprofile", "", "Profile code, and write that profile to a file")
@@ -29,6 +37,21 @@ var (
 	protocol    = flag.String("protocol", "TCP", "Select the transport protocol to use")
 	numClients  = flag.Int("clients", 100, "Profile code, and write that profile to a file")
 
+	scheduledShutdown = flag.Float64("shutdown", 0.0, "Schedule a shutdown after a certain number of hours")
+
+	htpasswd = flag.String("htpasswd", "", "Only allow clients with credentials in this htpasswd file to connect")
+	aclFile  = flag.String("acl", "", "Limit the topics clients can publish and subscribe to with the rules in this file")
+	storeDir = flag.String("store", "", "Save sessions and retained messages in this directory, so they survive a restart")
+	metrics  = flag.String("metrics", "", "Serve Prometheus metrics on /metrics at this address, e.g. :9100")
+	sys      = flag.Duration("sys", gobro.DefaultSysInterval, "How often to publish to the $SYS topics, or -1s to not publish them")
+
+	certFile          = flag.String("cert", "", "The PEM encoded certificate to use for TLS")
+	keyFile           = flag.String("key", "", "The PEM encoded key of the TLS certificate")
+	caFile            = flag.String("ca", "", "The PEM encoded CAs used to verify the other side of TLS connections")
+	requireClientCert = flag.Bool("requireClientCert", false, "Refuse TLS clients without a certificate signed by the -ca")
+
+	extraListeners = flag.String("listen", "", "Also listen on these comma separated endpoints, e.g. QUIC:14567,WebSocket:8080")
+
 	packetSize = flag.Int("packetSize", 100, "Get the packet size for tests")
 	packetNum  = flag.Int("packetNum", 100, "Get the number of packets for tests")
 
@@ -58,27 +81,69 @@ func main() {
 		return
 	}
 
-	connectionType, ok := map[string]byte{"TCP": 0, "QUIC": 1, "UDP": 2}[*protocol]
+	connectionType, ok := transportIDs[*protocol]
 	if !ok {
 		fmt.Println("Malformed input, exiting")
 		return
 	}
 
+	// MQTT over TLS has its own port
+	if connectionType == network.TLS && !isFlagSet("port") {
+		*PORT = network.DefaultTLSPort
+	}
+
 	fmt.Println("Protocol used:", *protocol)
 	client.ConnectionType = connectionType
-	gobro.ConnectionType = connectionType
 	stresstests.ConnectionType = connectionType
 
 	switch args[len(args)-1] {
 	case "gobro":
 		{
-			gobro.PrintOutput = true
-			server := gobro.NewServer()
-			server.StartServer(*IP, *PORT)
+			opts := gobro.Options{PrintOutput: true, Verbose: true, MetricsAddress: *metrics, SysInterval: *sys}
+			if *htpasswd != "" {
+				authenticator, err := gobro.NewHtpasswdAuthenticator(*htpasswd)
+				if err != nil {
+					fmt.Println("Error while reading htpasswd file:", err)
+					return
+				}
+				opts.Authenticator = authenticator
+			}
+			if *aclFile != "" {
+				acl, err := gobro.LoadACLFile(*aclFile)
+				if err != nil {
+					fmt.Println("Error while reading ACL file:", err)
+					return
+				}
+				opts.Authorizer = acl
+			}
+			if *storeDir != "" {
+				store, err := gobro.OpenFileStore(*storeDir)
+				if err != nil {
+					fmt.Println("Error while opening the store:", err)
+					return
+				}
+				opts.Store = store
+			}
+			listeners, err := listenerConfigs(connectionType)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			opts.Listeners = listeners
+			runServer(opts)
 		}
 	case "client":
 		{
-			client.StartClient(*IP, *PORT)
+			var tlsConfig *tls.Config
+			if connectionType == network.TLS {
+				var err error
+				tlsConfig, err = network.LoadClientTLSConfig(*caFile, *certFile, *keyFile)
+				if err != nil {
+					fmt.Println("Error while loading the TLS certificates:", err)
+					return
+				}
+			}
+			client.StartClient(*IP, *PORT, tlsConfig)
 		}
 	case "stresstest":
 		{
@@ -89,8 +154,13 @@ func main() {
 		{
 			location := fmt.Sprint("data/messageSize/", *protocol, "/")
 			go structures.WriteToCsv(fmt.Sprint(location, *numClients, "_clients.csv"))
-			server := gobro.NewServer()
-			server.StartServer(*IP, *PORT)
+			listeners, err := listenerConfigs(connectionType)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			runServer(gobro.Options{Listeners: listeners, Verbose: true})
+			structures.StopWriting()
 		}
 	case "testLocalhost":
 		{
@@ -115,6 +185,82 @@ func main() {
 	}
 }
 
+// listenerConfigs returns a listener for the -protocol on the -ip and -port, and the listeners
+// from the -listen flag. TLS listeners get the certificates from the TLS flags.
+func listenerConfigs(connectionType byte) ([]gobro.ListenerConfig, error) {
+	listeners := []gobro.ListenerConfig{{Transport: connectionType, IP: *IP, Port: *PORT}}
+	for _, endpoint := range strings.Split(*extraListeners, ",") {
+		if endpoint == "" {
+			continue
+		}
+		transport, port, found := strings.Cut(endpoint, ":")
+		transportID, ok := transportIDs[transport]
+		portNumber, err := strconv.Atoi(port)
+		if !found || !ok || err != nil {
+			return nil, fmt.Errorf("error: expected a listener of the form <protocol>:<port>, got '%v'", endpoint)
+		}
+		listeners = append(listeners, gobro.ListenerConfig{Transport: transportID, IP: *IP, Port: portNumber})
+	}
+
+	var tlsConfig *tls.Config
+	for i := range listeners {
+		if listeners[i].Transport != network.TLS {
+			continue
+		}
+		if tlsConfig == nil {
+			var err error
+			tlsConfig, err = network.LoadServerTLSConfig(*certFile, *keyFile, *caFile, *requireClientCert)
+			if err != nil {
+				return nil, fmt.Errorf("error while loading the TLS certificates: %w", err)
+			}
+		}
+		listeners[i].TLSConfig = tlsConfig
+	}
+	return listeners, nil
+}
+
+// runServer runs a server until the program is interrupted, or the -shutdown time has passed.
+// The server logs to logs.txt.
+func runServer(opts gobro.Options) {
+	file, err := os.OpenFile("logs.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		fmt.Println("Error while opening the log file:", err)
+		return
+	}
+	defer file.Close()
+	log.SetOutput(file)
+	// Sets the log to storefile & line numbers
+	log.SetFlags(log.Lshortfile | log.Ldate | log.Ltime)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *scheduledShutdown != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(*scheduledShutdown*float64(time.Hour)))
+		defer cancel()
+	}
+
+	server := gobro.NewServer(opts)
+	err = server.Start(ctx)
+	if err != nil {
+		fmt.Println("Error while starting the server:", err)
+		return
+	}
+	// The ACL file is watched for changes until the server shuts down
+	if acl, ok := opts.Authorizer.(*gobro.ACL); ok {
+		go acl.Watch(5*time.Second, server.Done())
+	}
+	<-ctx.Done()
+
+	fmt.Println("CLOSING")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Println("Error while shutting down the server:", err)
+	}
+}
+
 // I want to be able to put non-options before the flags - to do this we permute the os.args
 func permuteArgs() {
 	for i := 1; i < len(os.Args)-1; i++ {
@@ -122,6 +268,17 @@ func permuteArgs() {
 	}
 }
 
+// isFlagSet checks whether a flag was given on the command line, rather than left at its default
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func profileCPU() {
 	file, err := os.Create(*cpuprofile)
 	if err != nil {
@@ -0,0 +1,202 @@
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// DefaultTLSPort is the port registered for MQTT over TLS
+const DefaultTLSPort = 8883
+
+// TLSConn is a struct that implements the Conn interface for TLS over TCP connections.
+type TLSConn struct {
+	connection *tls.Conn
+	// config is used when connecting. If it is nil the server is verified against the system's roots.
+	config *tls.Config
+}
+
+// TLSListener is a struct that implements the Listener interface for TLS over TCP listeners.
+type TLSListener struct {
+	listener net.Listener
+	config   *tls.Config
+}
+
+// NewTLSConn returns a TLS connection that connects with the given config.
+// The server's certificate is always verified, against config.RootCAs or the system's roots if that isn't set.
+func NewTLSConn(config *tls.Config) *TLSConn {
+	return &TLSConn{config: config}
+}
+
+// NewTLSListener returns a TLS listener that accepts connections with the given config.
+// The config needs at least one certificate.
+func NewTLSListener(config *tls.Config) *TLSListener {
+	return &TLSListener{config: config}
+}
+
+// LoadServerTLSConfig creates the config for a TLS listener from PEM encoded files.
+// If caFile is set, clients can authenticate with a certificate signed by one of its CAs,
+// and if requireClientCert is also set, clients without a valid certificate are refused.
+func LoadServerTLSConfig(certFile string, keyFile string, caFile string, requireClientCert bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if caFile != "" {
+		config.ClientCAs, err = loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if requireClientCert {
+		return nil, errors.New("error: client certificates can't be required without a CA file to verify them")
+	}
+	return config, nil
+}
+
+// LoadClientTLSConfig creates the config for a TLS connection from PEM encoded files.
+// If caFile is set the server is verified against its CAs instead of the system's roots.
+// If certFile and keyFile are set the client authenticates itself with that certificate.
+func LoadClientTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		rootCAs, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = rootCAs
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("error: no certificates found in %v", caFile)
+	}
+	return pool, nil
+}
+
+// VerifiedCommonName returns the Common Name of the certificate the other side of a
+// TLS connection authenticated with. It returns false if the connection isn't a TLS
+// connection, or the other side didn't send a certificate that was verified.
+func VerifiedCommonName(conn Conn) (string, bool) {
+	tlsConn, ok := conn.(*TLSConn)
+	if !ok {
+		return "", false
+	}
+	verifiedChains := tlsConn.connection.ConnectionState().VerifiedChains
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return "", false
+	}
+	return verifiedChains[0][0].Subject.CommonName, true
+}
+
+// First we implement the connection methods
+
+// Connect implements the Connect function for TLS connections.
+// It dials the address and completes the handshake, which verifies the server's certificate.
+func (conn *TLSConn) Connect(ip string, port int) error {
+	connection, err := tls.Dial("tcp", fmt.Sprint(ip, ":", port), conn.config)
+	if err == nil {
+		conn.connection = connection
+	}
+	return err
+}
+
+// Write writes to the TLS connection associated with the TLSConn.
+func (conn *TLSConn) Write(toWrite []byte) (n int, err error) {
+	return conn.connection.Write(toWrite)
+}
+
+// Read reads from the TLS connection associated with the TLSConn.
+func (conn *TLSConn) Read(buffer []byte) (n int, err error) {
+	return conn.connection.Read(buffer)
+}
+
+// Close closes the TLS connection associated with the TLSConn.
+func (conn *TLSConn) Close() error {
+	return conn.connection.Close()
+}
+
+// RemoteAddr returns the remote address of the TLS connection associated with the TLSConn.
+func (conn *TLSConn) RemoteAddr() net.Addr {
+	return conn.connection.RemoteAddr()
+}
+
+// LocalAddr returns the local address of the TLS connection associated with the TLSConn.
+func (conn *TLSConn) LocalAddr() net.Addr {
+	return conn.connection.LocalAddr()
+}
+
+func (conn *TLSConn) SetDeadline(t time.Time) error {
+	return conn.connection.SetDeadline(t)
+}
+
+func (conn *TLSConn) SetReadDeadline(t time.Time) error {
+	return conn.connection.SetReadDeadline(t)
+}
+
+func (conn *TLSConn) SetWriteDeadline(t time.Time) error {
+	return conn.connection.SetWriteDeadline(t)
+}
+
+// Next the listening methods
+
+// Listen implements the Listen function for TLS connections.
+func (tlsListener *TLSListener) Listen(ip string, port int) error {
+	if tlsListener.config == nil || len(tlsListener.config.Certificates) == 0 {
+		return errors.New("error: a TLS listener needs a certificate")
+	}
+	tcpAddr := &net.TCPAddr{
+		IP:   net.ParseIP(ip),
+		Port: port,
+	}
+	listener, err := net.ListenTCP("tcp4", tcpAddr)
+	if err == nil {
+		tlsListener.listener = tls.NewListener(listener, tlsListener.config)
+	}
+	return err
+}
+
+// Close closes the TLS listener.
+func (tlsListener *TLSListener) Close() error {
+	return tlsListener.listener.Close()
+}
+
+// Accept accepts a TLS connection from the TLS listener.
+// The handshake happens when the connection is first read from or written to,
+// so a slow client doesn't hold up the listener.
+func (tlsListener *TLSListener) Accept() (Conn, error) {
+	connection, err := tlsListener.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &TLSConn{
+		connection: connection.(*tls.Conn),
+	}, nil
+}
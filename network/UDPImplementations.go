@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"time"
 )
 
@@ -88,12 +89,22 @@ func (conn *UDPConn) Write(toWrite []byte) (n int, err error) {
 }
 
 func (conn *UDPConn) Read(buffer []byte) (n int, err error) {
-	readData, channelOpen := <-conn.packetBuffer
+	var deadlineExceeded <-chan time.Time
+	if !conn.readDeadline.IsZero() {
+		timer := time.NewTimer(time.Until(conn.readDeadline))
+		defer timer.Stop()
+		deadlineExceeded = timer.C
+	}
 
-	if !channelOpen {
-		return 0, net.ErrClosed
+	select {
+	case readData, channelOpen := <-conn.packetBuffer:
+		if !channelOpen {
+			return 0, net.ErrClosed
+		}
+		return copy(buffer, readData), nil
+	case <-deadlineExceeded:
+		return 0, os.ErrDeadlineExceeded
 	}
-	return copy(buffer, readData), nil
 }
 
 // Close closes the connection.
@@ -129,16 +140,27 @@ func (conn *UDPConn) LocalAddr() net.Addr {
 
 // SetDeadline sets the deadline associated with the connection.
 func (conn *UDPConn) SetDeadline(t time.Time) error {
-	return conn.connection.SetDeadline(t)
+	err := conn.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(t)
 }
 
 // SetReadDeadline sets the deadline for future Read calls.
+// Both client and server connections read from the packet buffer, so the deadline is
+// enforced there rather than on the socket.
 func (conn *UDPConn) SetReadDeadline(t time.Time) error {
-	return conn.connection.SetReadDeadline(t)
+	conn.readDeadline = t
+	return nil
 }
 
 // SetWriteDeadline sets the deadline for future Write calls.
+// Server connections share the listener's socket, so this only affects client connections.
 func (conn *UDPConn) SetWriteDeadline(t time.Time) error {
+	if conn.connectionType == UDPServerConnection {
+		return nil
+	}
 	return conn.connection.SetWriteDeadline(t)
 }
 
@@ -155,6 +177,7 @@ func (udpListener *UDPListener) Listen(ip string, port int) error {
 	udpListener.openConnections = structures.CreateSafeMap[string, chan []byte]()
 	// We can buffer 300 new clients before having to clear them
 	udpListener.newClientBuffer = make(chan net.Addr, 300)
+	udpListener.closed = make(chan struct{})
 	laddr := net.UDPAddr{
 		IP:   net.ParseIP(ip),
 		Port: port,
@@ -234,6 +257,7 @@ func handleMessageForwarding(readMessageBuffer chan *udpMessage, udpListener *UD
 
 // Close closes the listener.
 func (udpListener *UDPListener) Close() error {
+	udpListener.closeOnce.Do(func() { close(udpListener.closed) })
 	return udpListener.listener.Close()
 }
 
@@ -242,7 +266,12 @@ func (udpListener *UDPListener) Close() error {
 
 // Accept waits connections from the newClientBuffer from the background listener, and returns a new connection.
 func (udpListener *UDPListener) Accept() (Conn, error) {
-	newClientAddress := <-udpListener.newClientBuffer
+	var newClientAddress net.Addr
+	select {
+	case newClientAddress = <-udpListener.newClientBuffer:
+	case <-udpListener.closed:
+		return nil, net.ErrClosed
+	}
 	newClientUDPAddress := newClientAddress.(*net.UDPAddr)
 	stringAddress := fmt.Sprint(newClientUDPAddress.IP, ":", newClientUDPAddress.Port)
 
@@ -0,0 +1,198 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"MQTT-GO/structures"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// DefaultWebSocketPath is the HTTP path WebSocket connections are made to
+	DefaultWebSocketPath = "/mqtt"
+	// WebSocketSubprotocol is the subprotocol MQTT over WebSockets has to negotiate
+	WebSocketSubprotocol = "mqtt"
+)
+
+// WebSocketConn is a struct that implements the Conn interface for WebSocket connections.
+// Every write is sent as one binary message, and reads see the messages as a stream of bytes,
+// so MQTT packets can be split across messages.
+type WebSocketConn struct {
+	connection *websocket.Conn
+	path       string
+	// closed is closed when the connection is, which lets the listener's HTTP handler return
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+// WebSocketListener is a struct that implements the Listener interface for WebSocket listeners.
+// It serves WebSocket connections on a single HTTP path.
+type WebSocketListener struct {
+	server         *http.Server
+	path           string
+	newConnections chan *WebSocketConn
+	closed         chan struct{}
+	closeOnce      sync.Once
+}
+
+// NewWebSocketConn returns a WebSocket connection that connects to the given HTTP path
+func NewWebSocketConn(path string) *WebSocketConn {
+	return &WebSocketConn{path: path}
+}
+
+// NewWebSocketListener returns a WebSocket listener that serves connections on the given HTTP path
+func NewWebSocketListener(path string) *WebSocketListener {
+	return &WebSocketListener{path: path}
+}
+
+// First we implement the connection methods
+
+// Connect implements the Connect function for WebSocket connections.
+// It dials the address and asks for the mqtt subprotocol.
+func (conn *WebSocketConn) Connect(ip string, port int) error {
+	address := net.JoinHostPort(ip, fmt.Sprint(port))
+	config, err := websocket.NewConfig("ws://"+address+conn.path, "http://"+address)
+	if err != nil {
+		return err
+	}
+	config.Protocol = []string{WebSocketSubprotocol}
+
+	connection, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	connection.PayloadType = websocket.BinaryFrame
+	conn.connection = connection
+	conn.closed = make(chan struct{})
+	conn.closeOnce = &sync.Once{}
+	return nil
+}
+
+// Write writes to the WebSocket connection associated with the WebSocketConn, as a single binary message.
+func (conn *WebSocketConn) Write(toWrite []byte) (n int, err error) {
+	return conn.connection.Write(toWrite)
+}
+
+// Read reads from the WebSocket connection associated with the WebSocketConn.
+func (conn *WebSocketConn) Read(buffer []byte) (n int, err error) {
+	return conn.connection.Read(buffer)
+}
+
+// Close closes the WebSocket connection associated with the WebSocketConn.
+func (conn *WebSocketConn) Close() error {
+	err := conn.connection.Close()
+	conn.closeOnce.Do(func() { close(conn.closed) })
+	return err
+}
+
+// RemoteAddr returns the remote address of the WebSocket connection associated with the WebSocketConn.
+func (conn *WebSocketConn) RemoteAddr() net.Addr {
+	// The websocket package returns the URL as the address, so we ask the request instead
+	if request := conn.connection.Request(); request != nil {
+		if addr, err := net.ResolveTCPAddr("tcp", request.RemoteAddr); err == nil {
+			return addr
+		}
+	}
+	return conn.connection.RemoteAddr()
+}
+
+// LocalAddr returns the local address of the WebSocket connection associated with the WebSocketConn.
+func (conn *WebSocketConn) LocalAddr() net.Addr {
+	return conn.connection.LocalAddr()
+}
+
+func (conn *WebSocketConn) SetDeadline(t time.Time) error {
+	return conn.connection.SetDeadline(t)
+}
+
+func (conn *WebSocketConn) SetReadDeadline(t time.Time) error {
+	return conn.connection.SetReadDeadline(t)
+}
+
+func (conn *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	return conn.connection.SetWriteDeadline(t)
+}
+
+// Next the listening methods
+
+// Listen implements the Listen function for WebSocket connections.
+// It starts an HTTP server, which hands new connections to Accept.
+func (wsListener *WebSocketListener) Listen(ip string, port int) error {
+	tcpAddr := &net.TCPAddr{
+		IP:   net.ParseIP(ip),
+		Port: port,
+	}
+	listener, err := net.ListenTCP("tcp4", tcpAddr)
+	if err != nil {
+		return err
+	}
+
+	wsListener.newConnections = make(chan *WebSocketConn)
+	wsListener.closed = make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle(wsListener.path, websocket.Server{
+		Handshake: negotiateSubprotocol,
+		Handler:   wsListener.handleConnection,
+	})
+	wsListener.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		err := wsListener.server.Serve(listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			structures.Println("Error while serving WebSocket connections:", err)
+		}
+	}()
+	return nil
+}
+
+// negotiateSubprotocol refuses clients that don't offer the mqtt subprotocol, and selects it for the rest.
+// Browsers send an Origin header, so any origin is accepted.
+func negotiateSubprotocol(config *websocket.Config, _ *http.Request) error {
+	for _, protocol := range config.Protocol {
+		if protocol == WebSocketSubprotocol {
+			config.Protocol = []string{WebSocketSubprotocol}
+			return nil
+		}
+	}
+	return fmt.Errorf("error: the client didn't offer the %v subprotocol", WebSocketSubprotocol)
+}
+
+// handleConnection passes a new connection to Accept, and keeps it open until it is closed.
+func (wsListener *WebSocketListener) handleConnection(connection *websocket.Conn) {
+	connection.PayloadType = websocket.BinaryFrame
+	conn := &WebSocketConn{
+		connection: connection,
+		closed:     make(chan struct{}),
+		closeOnce:  &sync.Once{},
+	}
+
+	select {
+	case wsListener.newConnections <- conn:
+	case <-wsListener.closed:
+		return
+	}
+	// The connection is closed as soon as the handler returns
+	<-conn.closed
+}
+
+// Close closes the WebSocket listener, and stops accepting connections.
+func (wsListener *WebSocketListener) Close() error {
+	wsListener.closeOnce.Do(func() { close(wsListener.closed) })
+	return wsListener.server.Close()
+}
+
+// Accept accepts a WebSocket connection from the WebSocket listener.
+func (wsListener *WebSocketListener) Accept() (Conn, error) {
+	select {
+	case conn := <-wsListener.newConnections:
+		return conn, nil
+	case <-wsListener.closed:
+		return nil, net.ErrClosed
+	}
+}
@@ -1,5 +1,5 @@
 // Package network contains all the code for the network layer.
-// This includes the connection and listener interfaces, as well as the implementations for TCP, UDP and QUIC.
+// This includes the connection and listener interfaces, as well as the implementations for TCP, UDP, QUIC, TLS and WebSockets.
 package network
 
 import (
@@ -13,11 +13,16 @@ import (
 
 // This is a list of all the transport types we support and their IDs.
 const (
-	TCP  byte = 0
-	QUIC byte = 1
-	UDP  byte = 2
+	TCP       byte = 0
+	QUIC      byte = 1
+	UDP       byte = 2
+	TLS       byte = 3
+	WebSocket byte = 4
 )
 
+// TransportNames is the name of every transport type, indexed by its ID
+var TransportNames = []string{"TCP", "QUIC", "UDP", "TLS", "WebSocket"}
+
 // We want to be able to switch easily between sending via TCP, UDP and QUIC.
 // We want to be able to use the same functions for all three.
 
@@ -37,6 +42,7 @@ type Conn interface {
 }
 
 // NewConn returns a new connection of the type specified by the networkID.
+// TLS connections verify the server against the system's roots, use NewTLSConn to configure them.
 func NewConn(networkID byte) (Conn, error) {
 	switch networkID {
 	case TCP:
@@ -54,6 +60,14 @@ func NewConn(networkID byte) (Conn, error) {
 				streamWriteLock: &sync.Mutex{},
 			}, nil
 		}
+	case TLS:
+		{
+			return NewTLSConn(nil), nil
+		}
+	case WebSocket:
+		{
+			return NewWebSocketConn(DefaultWebSocketPath), nil
+		}
 	}
 	return nil, fmt.Errorf("error: Supplied networkID %v is not defined", networkID)
 }
@@ -78,6 +92,9 @@ type UDPConn struct {
 	remoteAddr     net.Addr
 	connected      bool
 	connectionType byte
+	// Server connections share the listener's socket, so read deadlines
+	// are applied when reading from the packet buffer instead
+	readDeadline time.Time
 
 	serverConnectionDeleter func()
 }
@@ -25,6 +25,7 @@ type TCPListener struct {
 }
 
 // NewListener returns a new listener of the type specified by the networkID.
+// TLS listeners need a certificate, so they have to be created with NewTLSListener.
 func NewListener(networkID byte) (Listener, error) {
 	switch networkID {
 	case TCP:
@@ -39,6 +40,14 @@ func NewListener(networkID byte) (Listener, error) {
 		{
 			return &QUICListener{}, nil
 		}
+	case TLS:
+		{
+			return nil, fmt.Errorf("error: TLS listeners need a certificate, create them with NewTLSListener")
+		}
+	case WebSocket:
+		{
+			return NewWebSocketListener(DefaultWebSocketPath), nil
+		}
 	}
 	return nil, fmt.Errorf("error: Supplied networkID %v is not defined", networkID)
 }
@@ -54,6 +63,9 @@ type UDPListener struct {
 	// these then get picked up by Accept.
 	newClientBuffer chan net.Addr
 	localAddr       *net.UDPAddr
+	// closed is closed when the listener is, so Accept stops waiting for new clients
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 // QUICListener is a struct that implements the Listener interface for QUIC listeners.
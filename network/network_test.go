@@ -3,7 +3,9 @@ package network_test
 import (
 	"MQTT-GO/network"
 	"MQTT-GO/structures"
+	"errors"
 	"net"
+	"os"
 	"sync"
 	"testing"
 	"time"
@@ -48,3 +50,28 @@ func TestUDPnetwork(t *testing.T) {
 	structures.Println(buffer)
 
 }
+
+func TestUDPReadDeadline(t *testing.T) {
+	listener, _ := network.NewListener(network.UDP)
+	err := listener.Listen("localhost", 8010)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	connection, _ := network.NewConn(network.UDP)
+	if err := connection.Connect("localhost", 8010); err != nil {
+		t.Fatal(err)
+	}
+	connection.Write([]byte("hello"))
+
+	serverConn, _ := listener.Accept()
+	buffer := make([]byte, 100)
+	serverConn.Read(buffer)
+
+	serverConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = serverConn.Read(buffer)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("Expected the read deadline to be exceeded, got", err)
+	}
+}
@@ -0,0 +1,109 @@
+package network_test
+
+import (
+	"MQTT-GO/network"
+	"testing"
+)
+
+func TestTLSClientCertificates(t *testing.T) {
+	serverConfig, err := network.LoadServerTLSConfig("testdata/server.crt", "testdata/server.key", "testdata/ca.crt", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := network.NewTLSListener(serverConfig)
+	if err := listener.Listen("localhost", 8013); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	commonNames := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buffer := make([]byte, 5)
+				if _, err := conn.Read(buffer); err != nil {
+					commonNames <- ""
+					return
+				}
+				commonName, _ := network.VerifiedCommonName(conn)
+				commonNames <- commonName
+			}()
+		}
+	}()
+
+	clientConfig, err := network.LoadClientTLSConfig("testdata/ca.crt", "testdata/client.crt", "testdata/client.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := network.NewTLSConn(clientConfig)
+	if err := conn.Connect("localhost", 8013); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if commonName := <-commonNames; commonName != "sensor-1" {
+		t.Errorf("Expected the Common Name sensor-1, got '%v'", commonName)
+	}
+
+	// Without a certificate the server refuses the client
+	clientConfig, err = network.LoadClientTLSConfig("testdata/ca.crt", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = network.NewTLSConn(clientConfig)
+	if err := conn.Connect("localhost", 8013); err == nil {
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+	}
+	if commonName := <-commonNames; commonName != "" {
+		t.Error("Client without a certificate was accepted")
+	}
+}
+
+func TestTLSServerIsVerified(t *testing.T) {
+	serverConfig, err := network.LoadServerTLSConfig("testdata/server.crt", "testdata/server.key", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := network.NewTLSListener(serverConfig)
+	if err := listener.Listen("localhost", 8015); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go conn.Read(make([]byte, 1))
+		}
+	}()
+
+	clientConfig, err := network.LoadClientTLSConfig("testdata/other-ca.crt", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := network.NewTLSConn(clientConfig)
+	if err := conn.Connect("localhost", 8015); err == nil {
+		conn.Close()
+		t.Error("Server with a certificate from an untrusted CA was accepted")
+	}
+
+	clientConfig, err = network.LoadClientTLSConfig("testdata/ca.crt", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = network.NewTLSConn(clientConfig)
+	if err := conn.Connect("localhost", 8015); err != nil {
+		t.Fatal("Couldn't connect to a trusted server:", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,71 @@
+package network_test
+
+import (
+	"MQTT-GO/network"
+	"MQTT-GO/packets"
+	"bufio"
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocketPacketsCanSpanMessages(t *testing.T) {
+	listener := network.NewWebSocketListener(network.DefaultWebSocketPath)
+	if err := listener.Listen("localhost", 8016); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan []byte, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			packet, err := packets.ReadPacketFromConnection(reader)
+			if err != nil {
+				break
+			}
+			received <- packet
+		}
+		close(received)
+	}()
+
+	conn := network.NewWebSocketConn(network.DefaultWebSocketPath)
+	if err := conn.Connect("localhost", 8016); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	first, _ := packets.CreatePublish("a", 1, 0, []byte("first"))
+	second, _ := packets.CreatePublish("b", 1, 0, []byte("second"))
+	// The second packet is split across two messages
+	for _, message := range [][]byte{first, second[:3], second[3:]} {
+		if _, err := conn.Write(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expected := range [][]byte{first, second} {
+		if packet := <-received; !bytes.Equal(packet, expected) {
+			t.Errorf("Expected %v, got %v", expected, packet)
+		}
+	}
+}
+
+func TestWebSocketNeedsMQTTSubprotocol(t *testing.T) {
+	listener := network.NewWebSocketListener(network.DefaultWebSocketPath)
+	if err := listener.Listen("localhost", 8017); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, err := websocket.Dial("ws://localhost:8017"+network.DefaultWebSocketPath, "", "http://localhost:8017")
+	if err == nil {
+		conn.Close()
+		t.Error("Client that didn't offer the mqtt subprotocol was accepted")
+	}
+}
@@ -72,10 +72,55 @@ func CreateUnSuback(packetIdentifier int) []byte {
 	return result
 }
 
+// CreatePingReq creates a PingReq packet, used by clients to keep their connection alive
+func CreatePingReq() []byte {
+	return []byte{PINGREQ << 4, 0}
+}
+
+// CreatePingResp creates a PingResp packet, the reply to a PINGREQ
+func CreatePingResp() []byte {
+	return []byte{PINGRESP << 4, 0}
+}
+
+// CreateDisconnect creates a DISCONNECT packet, which the broker sends when it is shutting down
+func CreateDisconnect() []byte {
+	return []byte{DISCONNECT << 4, 0}
+}
+
+// CreatePublish creates a PUBLISH packet with the given topic name, packet identifier,
+// control header flags and application message
+func CreatePublish(topicName string, packetIdentifier int, flags byte, applicationMessage []byte) ([]byte, error) {
+	controlHeader := ControlHeader{Type: PUBLISH, Flags: flags}
+	varHeader := PublishVariableHeader{TopicFilter: topicName, PacketIdentifier: packetIdentifier}
+	payload := PacketPayload{RawApplicationMessage: applicationMessage}
+
+	return EncodePublish(CombinePacketSections(&controlHeader, &varHeader, &payload))
+}
+
 // CreatePubAck creates an PubAck packet
 func CreatePubAck(packetIdentifier int) []byte {
+	return createPublishAcknowledgement(PUBACK, 0, packetIdentifier)
+}
+
+// CreatePubRec creates a PubRec packet, the first reply to a QoS 2 PUBLISH
+func CreatePubRec(packetIdentifier int) []byte {
+	return createPublishAcknowledgement(PUBREC, 0, packetIdentifier)
+}
+
+// CreatePubRel creates a PubRel packet, the reply to a PUBREC
+func CreatePubRel(packetIdentifier int) []byte {
+	return createPublishAcknowledgement(PUBREL, PubrelFlags, packetIdentifier)
+}
+
+// CreatePubComp creates a PubComp packet, the final packet in the QoS 2 exchange
+func CreatePubComp(packetIdentifier int) []byte {
+	return createPublishAcknowledgement(PUBCOMP, 0, packetIdentifier)
+}
+
+// PUBACK, PUBREC, PUBREL and PUBCOMP only differ by their type and flags.
+func createPublishAcknowledgement(packetType byte, flags byte, packetIdentifier int) []byte {
 	result := make([]byte, 4)
-	result[0] = PUBACK << 4
+	result[0] = packetType<<4 | flags
 	result[1] = 2
 
 	idMSB, idLSB := getMSBandLSB(packetIdentifier)
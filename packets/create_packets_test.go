@@ -65,6 +65,32 @@ func TestEncodingAndDecodingConnect(t *testing.T) {
 
 }
 
+func TestEncodingAndDecodingConnectWithWill(t *testing.T) {
+	connectFlags := packets.WillFlag | packets.WillRetainFlag | 1<<3
+	packet := packets.CombinePacketSections(
+		&packets.ControlHeader{Type: packets.CONNECT},
+		&packets.ConnectVariableHeader{ConnectFlags: connectFlags, KeepAlive: 60},
+		&packets.PacketPayload{ClientID: "sensor", WillTopic: "status/sensor", WillMessage: []byte("offline")},
+	)
+
+	encodedPacket, err := packets.EncodeConnect(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedPacket, err := packets.DecodeConnect(encodedPacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decodedFlags := decodedPacket.VariableLengthHeader.(*packets.ConnectVariableHeader).ConnectFlags
+	if packets.GetWillQoS(decodedFlags) != 1 || decodedFlags&packets.WillRetainFlag == 0 {
+		t.Error("Will flags are not symmetrical")
+	}
+	if decodedPacket.Payload.WillTopic != "status/sensor" || string(decodedPacket.Payload.WillMessage) != "offline" {
+		t.Error("Will is not symmetrical")
+	}
+}
+
 func TestEncodingAndDecodingSubscribe(t *testing.T) {
 	packet := packets.Packet{}
 	packet.ControlHeader = &packets.ControlHeader{Type: packets.SUBSCRIBE, RemainingLength: 25, Flags: 2}
@@ -228,3 +254,89 @@ func TestEncodingAndDecodingUnsubscribe(t *testing.T) {
 	}
 
 }
+
+func TestEncodingAndDecodingPuback(t *testing.T) {
+	packet := packets.Packet{}
+	packet.ControlHeader = &packets.ControlHeader{Type: packets.PUBACK, RemainingLength: 2, Flags: 0}
+	packet.VariableLengthHeader = &packets.PubackVariableHeader{PacketIdentifier: 300}
+
+	encodedPacket := packets.CreatePubAck(300)
+	decodedPacket, packetType, err := packets.DecodePacket(encodedPacket)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if packetType != packets.PUBACK {
+		t.Error("Decoded packet type is not PUBACK")
+	}
+	if !reflect.DeepEqual(*packet.ControlHeader, *decodedPacket.ControlHeader) {
+		t.Error("Control headers are not symmetrical")
+	}
+	if !reflect.DeepEqual(packet.VariableLengthHeader, decodedPacket.VariableLengthHeader) {
+		t.Error("Variable length headers are not symmetrical")
+	}
+}
+
+func TestPublishFlags(t *testing.T) {
+	flags := packets.CreatePublishFlags(1, true, false)
+	encodedPacket, err := packets.CreatePublish("test", 5, flags, []byte{1, 2, 3})
+	if err != nil {
+		t.Error(err)
+	}
+
+	decodedPacket, err := packets.DecodePublish(encodedPacket)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if packets.GetQoS(decodedPacket.ControlHeader.Flags) != 1 {
+		t.Error("QoS was not encoded correctly")
+	}
+	if decodedPacket.ControlHeader.Flags&packets.DupFlag == 0 || decodedPacket.ControlHeader.Flags&packets.RetainFlag != 0 {
+		t.Error("DUP and RETAIN flags were not encoded correctly")
+	}
+}
+
+func TestEncodingAndDecodingQoS2Acknowledgements(t *testing.T) {
+	for _, packetType := range []byte{packets.PUBREC, packets.PUBREL, packets.PUBCOMP} {
+		packet := packets.Packet{}
+		packet.ControlHeader = &packets.ControlHeader{Type: packetType, RemainingLength: 2}
+		packet.VariableLengthHeader = &packets.PubackVariableHeader{PacketIdentifier: 12}
+
+		encodedPacket, err := packets.EncodePublishAcknowledgement(&packet)
+		if err != nil {
+			t.Error(err)
+		}
+
+		decodedPacket, decodedType, err := packets.DecodePacket(encodedPacket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decodedType != packetType {
+			t.Error("Decoded", packets.PacketTypeName(decodedType), "instead of", packets.PacketTypeName(packetType))
+		}
+		if !reflect.DeepEqual(packet.VariableLengthHeader, decodedPacket.VariableLengthHeader) {
+			t.Error("Variable length headers are not symmetrical")
+		}
+	}
+}
+
+func TestDecodingMalformedPubrel(t *testing.T) {
+	pubrel := packets.CreatePubRel(1)
+	// PUBREL must have its reserved flags set to 0010
+	pubrel[0] &^= packets.PubrelFlags
+
+	if _, err := packets.DecodePublishAcknowledgement(pubrel); err == nil {
+		t.Error("Decoded a PUBREL with malformed flags")
+	}
+}
+
+func TestDecodingPingResp(t *testing.T) {
+	packet, packetType, err := packets.DecodePacket(packets.CreatePingResp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packetType != packets.PINGRESP || packet.ControlHeader.RemainingLength != 0 {
+		t.Error("PINGRESP was decoded incorrectly")
+	}
+}
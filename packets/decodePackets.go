@@ -11,6 +11,7 @@ var (
 	errPacketTooShort = errors.New("error: cannot decode packet: packet too short to be a connect packet")
 	errInvalidType    = errors.New("error: cannot decode packet: invalid control type")
 	errInvalidLength  = errors.New("error: packet length differs from the advertised fixed length")
+	errMalformedFlags = errors.New("error: packet has malformed control header flags")
 )
 
 // DecodeFixedHeader takes a packet and decodes the fixed header.
@@ -139,10 +140,16 @@ func DecodePacket(packet []byte) (*Packet, byte, error) {
 	case PUBLISH:
 		result, err = DecodePublish(packet)
 
+	case PUBACK, PUBREC, PUBREL, PUBCOMP:
+		result, err = DecodePublishAcknowledgement(packet)
+
 	case PINGREQ:
 		structures.Println("Ping")
 		result, err = DecodePingreq(packet)
 
+	case PINGRESP:
+		result, err = DecodePingreq(packet)
+
 	case DISCONNECT:
 		result, err = DecodeDisconnect(packet)
 
@@ -426,6 +433,42 @@ func DecodePublish(packet []byte) (*Packet, error) {
 	return resultPacket, nil
 }
 
+// DecodePublishAcknowledgement takes a byte array encoding a PUBACK, PUBREC, PUBREL
+// or PUBCOMP packet and returns (*Packet, error)
+func DecodePublishAcknowledgement(packetArr []byte) (*Packet, error) {
+	fixedHeader, offset, err := DecodeFixedHeader(packetArr)
+	if err != nil {
+		return nil, err
+	}
+	if len(packetArr) != offset+2 {
+		return nil, errInvalidLength
+	}
+
+	switch fixedHeader.Type {
+	case PUBACK, PUBREC, PUBCOMP:
+		if fixedHeader.Flags != 0 {
+			return nil, errMalformedFlags
+		}
+	case PUBREL:
+		if fixedHeader.Flags != PubrelFlags {
+			return nil, errMalformedFlags
+		}
+	default:
+		return nil, fmt.Errorf("error: %v is not a publish acknowledgement", PacketTypeName(fixedHeader.Type))
+	}
+
+	variableHeader := PubackVariableHeader{
+		PacketIdentifier: CombineMsbLsb(packetArr[offset], packetArr[offset+1]),
+	}
+
+	resultPacket := Packet{
+		ControlHeader:        fixedHeader,
+		VariableLengthHeader: &variableHeader,
+	}
+	return &resultPacket, nil
+}
+
+// DecodePingreq decodes a PINGREQ or PINGRESP packet, as both consist of just a fixed header
 func DecodePingreq(packet []byte) (*Packet, error) {
 	resultPacket := &Packet{}
 	// Handle the fixed length header
@@ -39,8 +39,11 @@ func EncodeConnect(packet *Packet) ([]byte, error) {
 	resultVarHeader := make([]byte, 0, preallocatedVarHeaderSize)
 	protocolNameArr, _, _ := EncodeUTFString("MQTT")
 
-	// Version 3.1.1 has a protocol version of 4
-	protocol := byte(4)
+	// Version 3.1.1 has a protocol version of 4, which is used if none is set
+	protocol := varLengthHeader.ProtocolLevel
+	if protocol == 0 {
+		protocol = ProtocolLevel
+	}
 	connectFlags := varLengthHeader.ConnectFlags
 	keepAliveMsb, keepAliveLsb := getMSBandLSB(varLengthHeader.KeepAlive)
 
@@ -58,14 +61,15 @@ func EncodeConnect(packet *Packet) ([]byte, error) {
 	resultPayload = append(resultPayload, clientIdentifier...)
 
 	// Will Topic & Will Message (If the will flag is set to 1)
-	if (varLengthHeader.ConnectFlags & 4) > 0 {
-		if payload.WillTopic != "" || payload.WillMessage == nil {
+	if (varLengthHeader.ConnectFlags & WillFlag) > 0 {
+		if payload.WillTopic == "" || payload.WillMessage == nil {
 			return nil, errors.New("error: Will metadata not provided")
 		}
 		willTopic, _, _ := EncodeUTFString(payload.WillTopic)
-		willMessage, _, _ := EncodeUTFString(payload.WillTopic)
 		resultPayload = append(resultPayload, willTopic...)
-		resultPayload = append(resultPayload, willMessage...)
+		willMessageLenMSB, willMessageLenLSB := getMSBandLSB(len(payload.WillMessage))
+		resultPayload = append(resultPayload, willMessageLenMSB, willMessageLenLSB)
+		resultPayload = append(resultPayload, payload.WillMessage...)
 	}
 	// User Name
 	if (varLengthHeader.ConnectFlags & 128) > 0 {
@@ -172,6 +176,26 @@ func EncodeSuback(packet *Packet) ([]byte, error) {
 	return CombineEncodedPacketSections(resultControlHeader, resultVarHeader, resultPayload), nil
 }
 
+// EncodePublishAcknowledgement encodes a PUBACK, PUBREC, PUBREL or PUBCOMP packet into a byte array
+func EncodePublishAcknowledgement(packet *Packet) ([]byte, error) {
+	varHeader, ok := packet.VariableLengthHeader.(*PubackVariableHeader)
+	if !ok {
+		return nil, errors.New("error: Variable length header is not of type PubackVariableHeader")
+	}
+
+	switch packet.ControlHeader.Type {
+	case PUBACK:
+		return CreatePubAck(varHeader.PacketIdentifier), nil
+	case PUBREC:
+		return CreatePubRec(varHeader.PacketIdentifier), nil
+	case PUBREL:
+		return CreatePubRel(varHeader.PacketIdentifier), nil
+	case PUBCOMP:
+		return CreatePubComp(varHeader.PacketIdentifier), nil
+	}
+	return nil, errors.New("error: Tried to encode a publish acknowledgement from a different packet type")
+}
+
 // ConvertStringsToTopicsWithQos converts a list of strings to a list of TopicWithQoS
 func ConvertStringsToTopicsWithQos(topics ...string) []TopicWithQoS {
 	result := make([]TopicWithQoS, 0, len(topics))
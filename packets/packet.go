@@ -39,6 +39,56 @@ func isValidControlType(controlType byte) bool {
 	return ((RESERVED < controlType) && (controlType <= AUTH))
 }
 
+// These are the flags that can be set in the control header of a PUBLISH packet
+const (
+	RetainFlag byte = 1
+	QoSFlags   byte = 6
+	DupFlag    byte = 8
+)
+
+// These are the flags that can be set in the variable header of a CONNECT packet
+const (
+	CleanSessionFlag byte = 2
+	WillFlag         byte = 4
+	WillQoSFlags     byte = 24
+	WillRetainFlag   byte = 32
+	PasswordFlag     byte = 64
+	UsernameFlag     byte = 128
+)
+
+const (
+	// ProtocolLevel is the protocol level of MQTT 3.1.1
+	ProtocolLevel byte = 4
+	// BridgeFlag is set in the protocol level of a CONNECT by bridges. Brokers that support it
+	// don't send a bridge the messages it published, so that messages don't loop between brokers.
+	BridgeFlag byte = 0x80
+)
+
+// GetWillQoS returns the QoS level of the will stored in the flags of a CONNECT variable header
+func GetWillQoS(connectFlags byte) byte {
+	return (connectFlags & WillQoSFlags) >> 3
+}
+
+// PubrelFlags are the reserved flags that must be set in the control header of a PUBREL packet
+const PubrelFlags byte = 2
+
+// GetQoS returns the QoS level stored in the flags of a PUBLISH control header
+func GetQoS(flags byte) byte {
+	return (flags & QoSFlags) >> 1
+}
+
+// CreatePublishFlags creates the control header flags for a PUBLISH packet
+func CreatePublishFlags(qos byte, dup bool, retain bool) byte {
+	flags := (qos << 1) & QoSFlags
+	if dup {
+		flags |= DupFlag
+	}
+	if retain {
+		flags |= RetainFlag
+	}
+	return flags
+}
+
 // Packet is the main struct for an MQTT packet
 // It consists of a ControlHeader, a VariableLengthHeader and a Payload
 type Packet struct {
@@ -109,15 +159,30 @@ type ConnectVariableHeader struct {
 	// User Name Flag (1 bit)
 }
 
+// These are the return codes a broker can send in a CONNACK
+const (
+	ConnackAccepted byte = iota
+	ConnackUnacceptableProtocolVersion
+	ConnackIdentifierRejected
+	ConnackServerUnavailable
+	ConnackBadUsernameOrPassword
+	ConnackNotAuthorized
+)
+
 type ConnackVariableHeader struct {
 	ConnectAcknowledgementFlags byte
 	ConnectReturnCode           byte
 }
 
+// SubackFailure is the SUBACK return code for a subscription the broker refused
+const SubackFailure byte = 0x80
+
 type SubackVariableHeader struct {
 	PacketIdentifier int
 }
 
+// PubackVariableHeader is the variable header for PUBACK, PUBREC, PUBREL and PUBCOMP packets,
+// all of which only contain a packet identifier
 type PubackVariableHeader struct {
 	PacketIdentifier int
 }
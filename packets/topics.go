@@ -0,0 +1,30 @@
+package packets
+
+import "strings"
+
+// TopicMatchesFilter checks whether a topic name matches a topic filter, which can
+// contain the single level (+) and multi level (#) wildcards.
+// For example "a/+/c" matches "a/b/c", and "a/#" matches "a", "a/b" and "a/b/c".
+// Topic names starting with $ aren't matched by a wildcard at the first level.
+func TopicMatchesFilter(topicFilter string, topicName string) bool {
+	filterLevels := strings.Split(topicFilter, "/")
+	topicLevels := strings.Split(topicName, "/")
+
+	if strings.HasPrefix(topicName, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+
+	for i, level := range filterLevels {
+		// # matches the parent level and everything below it
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,38 @@
+package packets_test
+
+import (
+	"testing"
+
+	"MQTT-GO/packets"
+)
+
+func TestTopicMatchesFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		topic   string
+		matches bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/b", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"+/+", "a/b", true},
+		{"+", "a/b", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b/c", true},
+		{"a/+", "a/", true},
+		{"b/#", "a/b", false},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/+/uptime", "$SYS/broker/uptime", true},
+	}
+
+	for _, test := range tests {
+		if packets.TopicMatchesFilter(test.filter, test.topic) != test.matches {
+			t.Errorf("Expected TopicMatchesFilter(%q, %q) to be %v", test.filter, test.topic, test.matches)
+		}
+	}
+}
@@ -1,12 +1,10 @@
 package stresstests
 
 import (
-	"MQTT-GO/gobro"
 	"MQTT-GO/network"
 	"MQTT-GO/structures"
 	"fmt"
 	"os"
-	"time"
 )
 
 var (
@@ -14,7 +12,7 @@ var (
 )
 
 func TestManyClients(numClients int, ip string, port int, packetSize int) {
-	transportProtocol := []string{"TCP", "QUIC", "UDP"}[ConnectionType]
+	transportProtocol := network.TransportNames[ConnectionType]
 	fmt.Println("Transport protocol:", transportProtocol)
 
 	location := fmt.Sprint("data/messageSize/", packetSize, "/", transportProtocol, "/")
@@ -24,12 +22,10 @@ func TestManyClients(numClients int, ip string, port int, packetSize int) {
 		panic(err)
 	}
 
-	server := gobro.NewServer()
-	go server.StartServer("localhost", 80)
-	time.Sleep(time.Second)
+	server := startServer(false)
 	go structures.WriteToCsv(fmt.Sprint(location, numClients, "_clients.csv"))
 
 	ManyClientsPublish(ip, port, packetSize, numClients)
 	structures.StopWriting()
-	server.StopServer(false)
+	stopServer(server)
 }
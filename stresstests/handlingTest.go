@@ -2,18 +2,16 @@ package stresstests
 
 import (
 	"MQTT-GO/client"
-	"MQTT-GO/gobro"
-	"MQTT-GO/gobro/clients"
+	"MQTT-GO/network"
 	"MQTT-GO/structures"
 	"fmt"
 	"os"
-	"time"
 )
 
 func TestHandleTime(numPackets int, ip string, port int, packetSize int, numberOfClients int) {
 	fmt.Println("Testing Latency")
 
-	transportProtocol := []string{"TCP", "QUIC", "UDP"}[ConnectionType]
+	transportProtocol := network.TransportNames[ConnectionType]
 	location := fmt.Sprint("data/handlingTest/", transportProtocol, "/clients_", numberOfClients, "/")
 	os.MkdirAll(location, os.ModePerm)
 	go structures.WriteToCsv(fmt.Sprint(location, "packet_", packetSize, "B", ".csv"))
@@ -21,12 +19,9 @@ func TestHandleTime(numPackets int, ip string, port int, packetSize int, numberO
 
 	fmt.Println("Transport protocol:", transportProtocol)
 	client.LogLatency = true
-	clients.LogLatency = true
 
-	server := gobro.NewServer()
-	go server.StartServer("localhost", 80)
-	defer server.StopServer(true)
-	time.Sleep(1500 * time.Millisecond)
+	server := startServer(true)
+	defer stopServer(server)
 
 	ManyClientsPublish(ip, port, packetSize, numberOfClients)
 
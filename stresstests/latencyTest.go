@@ -2,8 +2,6 @@ package stresstests
 
 import (
 	"MQTT-GO/client"
-	"MQTT-GO/gobro"
-	"MQTT-GO/gobro/clients"
 	"MQTT-GO/network"
 	"MQTT-GO/packets"
 	"fmt"
@@ -14,21 +12,19 @@ import (
 func TestLatency(numPackets int, ip string, port int, packetSize int, numberOfClients int) {
 	fmt.Println("Testing Latency")
 
-	transportProtocol := []string{"TCP", "QUIC", "UDP"}[ConnectionType]
+	transportProtocol := network.TransportNames[ConnectionType]
 	fmt.Println("Transport protocol:", transportProtocol)
 	client.LogLatency = true
-	clients.LogLatency = true
 
-	server := gobro.NewServer()
-	go server.StartServer("localhost", 80)
-	defer server.StopServer(true)
-	time.Sleep(1500 * time.Millisecond)
+	server := startServer(true)
+	defer stopServer(server)
 
 	newClient, err := client.CreateAndConnectClient(ip, port)
 
 	if err != nil {
 		panic(err)
 	}
+	newClient.StoreReceivedPackets(true)
 
 	newClient.SendPublish([]byte("test"), "abc")
 	newClient.SendSubscribe(packets.TopicWithQoS{Topic: "abc"})
@@ -58,8 +54,9 @@ func TestLatency(numPackets int, ip string, port int, packetSize int, numberOfCl
 		fmt.Print("\rWaiting for all packets to be received", newClient.ReceivedPackets.Size(), numPackets, counter)
 	}
 
-	LogLatencies(client.SendingLatencyChannel, clients.ReceivingLatencyChannel, transportProtocol, numberOfClients, packetSize, true)
-	LogLatencies(clients.SendingLatencyChannel, client.ReceivingLatencyChannel, transportProtocol, numberOfClients, packetSize, false)
+	serverReceived, serverSent := server.Latencies()
+	LogLatencies(client.SendingLatencyChannel, serverReceived, transportProtocol, numberOfClients, packetSize, true)
+	LogLatencies(serverSent, client.ReceivingLatencyChannel, transportProtocol, numberOfClients, packetSize, false)
 }
 
 func LogLatencies(clientChannel chan *network.LatencyStruct, gobroChannel chan *network.LatencyStruct,
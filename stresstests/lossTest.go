@@ -2,7 +2,7 @@ package stresstests
 
 import (
 	"MQTT-GO/client"
-	"MQTT-GO/gobro"
+	"MQTT-GO/network"
 	"MQTT-GO/packets"
 	"fmt"
 	"os"
@@ -12,19 +12,18 @@ import (
 func TestUDPLoss(numPackets int, ip string, port int, packetSize int, numberOfClients int) {
 	fmt.Println("Testing UDP Loss")
 
-	transportProtocol := []string{"TCP", "QUIC", "UDP"}[ConnectionType]
+	transportProtocol := network.TransportNames[ConnectionType]
 	fmt.Println("Transport protocol:", transportProtocol)
 
-	server := gobro.NewServer()
-	go server.StartServer("localhost", 80)
-	defer server.StopServer(true)
-	time.Sleep(1500 * time.Millisecond)
+	server := startServer(false)
+	defer stopServer(server)
 
 	newClient, err := client.CreateAndConnectClient(ip, port)
 
 	if err != nil {
 		panic(err)
 	}
+	newClient.StoreReceivedPackets(true)
 
 	newClient.SendPublish([]byte("test"), "abc")
 	newClient.SendSubscribe(packets.TopicWithQoS{Topic: "abc"})
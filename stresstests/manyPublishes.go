@@ -34,6 +34,7 @@ func ManyClientsPublish(ip string, port int, messageSize int, numberOfClients in
 
 	queue := sync.WaitGroup{}
 	firstSubscriber := clients[0]
+	firstSubscriber.StoreReceivedPackets(true)
 	firstSubscriber.SendPublish([]byte("Test"), "abc")
 	err := firstSubscriber.SendSubscribe(packets.TopicWithQoS{Topic: "abc", QoS: 0})
 	if err != nil {
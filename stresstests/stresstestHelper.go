@@ -2,7 +2,9 @@ package stresstests
 
 import (
 	"MQTT-GO/client"
+	"MQTT-GO/gobro"
 	"MQTT-GO/structures"
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
@@ -13,6 +15,30 @@ import (
 
 var numPublished atomic.Int32
 
+// startServer starts a server for the tests, listening on port 80 with the ConnectionType
+func startServer(logLatency bool) *gobro.Server {
+	server := gobro.NewServer(gobro.Options{
+		Listeners:  []gobro.ListenerConfig{{Transport: ConnectionType, IP: "localhost", Port: 80}},
+		Verbose:    true,
+		LogLatency: logLatency,
+	})
+	err := server.Start(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	return server
+}
+
+// stopServer shuts down a server started for the tests
+func stopServer(server *gobro.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		fmt.Println("Error while shutting down the server:", err)
+	}
+}
+
 func connectAllClients(clientList []*client.Client, ip string, port int, storedStdout *os.File) {
 	queue := sync.WaitGroup{}
 	queue.Add(len(clientList))
@@ -42,7 +42,7 @@ func (ll *LinkedList[T]) GetItems() []T {
 }
 
 // DeleteLinkedList deletes the linked list, setting all pointers to nil.
-// This is useful for garbage collection.
+// This is useful for garbage collection. The list is left empty, so it can still be used.
 func (ll *LinkedList[T]) DeleteLinkedList() {
 	if ll == nil {
 		return
@@ -56,6 +56,8 @@ func (ll *LinkedList[T]) DeleteLinkedList() {
 		node.next = nil
 		node = nextNode
 	}
+	ll.head, ll.tail = nil, nil
+	ll.size = 0
 }
 
 // Concatenate takes two linked lists and returns a new linked list that is the concatenation of the two.
@@ -230,12 +232,13 @@ func (ll *LinkedList[T]) Delete(val T) error {
 	defer ll.lock.Unlock()
 
 	// If we've removed an item and left one item in the list - we need to ensure that
-	// we don't get infinite loops when we go to search our list.
+	// we don't get infinite loops when we go to search our list, and that the remaining
+	// item is both the head and the tail.
 	defer func(linkedList *LinkedList[T]) {
 		if linkedList.size == 1 {
-			ll.head.next = nil
-			ll.tail.prev = nil
-			ll.tail = nil
+			linkedList.tail = linkedList.head
+			linkedList.head.next = nil
+			linkedList.head.prev = nil
 		}
 	}(ll)
 
@@ -255,10 +258,12 @@ func (ll *LinkedList[T]) Delete(val T) error {
 
 	if ll.head.val == val {
 		ll.head = ll.head.next
+		ll.head.prev = nil
 		ll.size--
 		return nil
 	} else if ll.tail.val == val {
 		ll.tail = ll.tail.prev
+		ll.tail.next = nil
 		ll.size--
 		return nil
 	}
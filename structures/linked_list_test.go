@@ -50,3 +50,37 @@ func TestRemovingDuplicates(t *testing.T) {
 		t.Error("Remove duplicates not working correctly.")
 	}
 }
+
+func TestAppendingAfterRemovingDownToOneItem(t *testing.T) {
+	linkedList := structures.CreateLinkedList[int]()
+	linkedList.Append(1)
+	linkedList.Append(2)
+
+	if err := linkedList.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+	linkedList.Append(3)
+	if err := linkedList.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	linkedList.Append(4)
+
+	if !slices.Equal(linkedList.GetItems(), []int{3, 4}) {
+		t.Error("Appending after removing items not working correctly.", linkedList.GetItems())
+	}
+}
+
+func TestDeletedListIsEmpty(t *testing.T) {
+	linkedList := structures.CreateLinkedList[int]()
+	linkedList.Append(1)
+	linkedList.Append(2)
+
+	linkedList.DeleteLinkedList()
+	if linkedList.Size() != 0 || linkedList.Delete(1) == nil {
+		t.Error("Deleted linked list isn't empty.", linkedList.GetItems())
+	}
+	linkedList.Append(3)
+	if !slices.Equal(linkedList.GetItems(), []int{3}) {
+		t.Error("Appending to a deleted linked list not working correctly.", linkedList.GetItems())
+	}
+}
@@ -13,6 +13,9 @@ var (
 	terminalWidth = getTerminalWidth()
 )
 
+// verbosePrinting turns on Println and PrintCentrally, which slow the broker down too much to leave on
+const verbosePrinting = false
+
 // PrintInterface prints an interface in a nice format.
 func PrintInterface(i interface{}) {
 	s, _ := json.MarshalIndent(i, "", "\t")
@@ -31,14 +34,12 @@ func getTerminalWidth() uint {
 // PrintCentrally prints a string in the center of the terminal.
 // It uses the Println function so it is thread safe.
 func PrintCentrally(toPrint ...any) {
-	return
+	if !verbosePrinting {
+		return
+	}
 	output := fmt.Sprint(toPrint...)
 	padding := (int(terminalWidth) - len(output)) / 2
-	fmt.Println(strings.Repeat(" ", padding) + output)
-	return
 	Println(strings.Repeat(" ", padding) + output)
-	go func() {
-	}()
 }
 
 // PrintItems prints the items in the linked list.
@@ -73,7 +74,9 @@ var (
 
 // Println is a thread safe version of fmt.Println.
 func Println(a ...any) (int, error) {
-	return 0, nil
+	if !verbosePrinting {
+		return 0, nil
+	}
 	// printingMutex.Lock()
 	// defer printingMutex.Unlock()
 	return fmt.Println(a...)
@@ -3,6 +3,7 @@ package structures
 import (
 	"fmt"
 	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -18,6 +19,8 @@ type TicketStand struct {
 	startTimes     *SafeMap[int64, int64]
 	closed         chan struct{}
 	tStandClosed   atomic.Bool
+	// queueLock stops a ticket from being handed out while the ticket before it completes
+	queueLock sync.Mutex
 }
 
 // CreateTicketStand creates a new TicketStand.
@@ -46,6 +49,8 @@ func (tHolder *TicketStand) CloseTicketStand() error {
 		recover()
 	}()
 
+	tHolder.queueLock.Lock()
+	defer tHolder.queueLock.Unlock()
 	queueList := tHolder.waitingTickets.Values()
 	for _, queue := range queueList {
 		close(queue)
@@ -55,22 +60,34 @@ func (tHolder *TicketStand) CloseTicketStand() error {
 
 // GetTicket returns a new ticket. The ticket number is the next ticket number.
 func (tHolder *TicketStand) GetTicket() Ticket {
+	tHolder.queueLock.Lock()
+	defer tHolder.queueLock.Unlock()
 	ticketNumber := tHolder.latestTicket.Add(1) - 1
 
 	tHolder.startTimes.Put(ticketNumber, time.Now().UnixNano())
 
-	queue := make(chan struct{}, 2)
-	if ticketNumber == tHolder.earliestTicket.Load() {
+	// The previous ticket may have already completed and signalled this one
+	queue := tHolder.queue(ticketNumber)
+	if ticketNumber == tHolder.earliestTicket.Load() && len(queue) == 0 {
 		queue <- struct{}{}
 	}
-
-	tHolder.waitingTickets.Put(ticketNumber, queue)
 	return Ticket{
 		ticketNumber: ticketNumber,
 		ticketStand:  tHolder,
 	}
 }
 
+// queue returns the channel a ticket waits on, creating it if the ticket hasn't been handed out yet.
+// It must be called with the queueLock held.
+func (tHolder *TicketStand) queue(ticketNumber int64) chan struct{} {
+	queue := tHolder.waitingTickets.Get(ticketNumber)
+	if queue == nil {
+		queue = make(chan struct{}, 2)
+		tHolder.waitingTickets.Put(ticketNumber, queue)
+	}
+	return queue
+}
+
 // Ticket is a ticket that can be used to wait on a ticket stand.
 type Ticket struct {
 	ticketNumber int64
@@ -147,8 +164,16 @@ func (ticket *Ticket) Complete() {
 		panic("??")
 	}
 
+	// The next ticket may not have been handed out yet, in which case it's ready as soon as it is
+	ticket.ticketStand.queueLock.Lock()
+	defer ticket.ticketStand.queueLock.Unlock()
+	if ticket.ticketStand.tStandClosed.Load() {
+		return
+	}
 	newTicket := ticket.ticketStand.earliestTicket.Add(1)
-	waitingChannel := ticket.ticketStand.waitingTickets.Get(newTicket)
-	waitingChannel <- struct{}{}
+	waitingChannel := ticket.ticketStand.queue(newTicket)
+	if len(waitingChannel) == 0 {
+		waitingChannel <- struct{}{}
+	}
 
 }